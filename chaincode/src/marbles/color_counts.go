@@ -0,0 +1,208 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Color Counts - a running count of marbles per color under "colorcount~color" keys, so popularity is one GetState
+//
+// init_marble() and split_marble() add to it, remove_marble() takes away, and repainting moves counts between colors.
+// A count never goes below 0, marbles from before the counts existed would otherwise push it negative as they go.
+// rebuild_color_counts() recounts everything from the color~id index if they drift.
+//
+// A purge batch can change the same color many times in one tx, so the counts go through the tx cache, see tx_cache.go.
+// ============================================================================================================================
+func adjust_color_count(stub shim.ChaincodeStubInterface, color string, delta int) error {
+	key, err := stub.CreateCompositeKey("colorcount~color", []string{color})
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	_, err = tx_get_state_as(stub, key, &count)                    //missing means 0
+	if err != nil {
+		return err
+	}
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+	if count == 0 {
+		return tx_del_state(stub, key)
+	}
+	countAsBytes, _ := json.Marshal(count)
+	return tx_put_state(stub, key, countAsBytes)
+}
+
+// ============================================================================================================================
+// Get Color Count - how many marbles have a color
+//
+// Inputs - Array of Strings
+//    0
+//  color
+//  "blue"
+//
+// Returns:
+// {
+//	"color": "blue",
+//	"count": 12
+// }
+// ============================================================================================================================
+func get_color_count(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ColorCount struct {
+		Color string `json:"color"`
+		Count int    `json:"count"`
+	}
+	var result ColorCount
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result.Color = normalize_color(args[0])                        //match how colors are stored
+
+	key, err := stub.CreateCompositeKey("colorcount~color", []string{result.Color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = get_state_as(stub, key, &result.Count)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                       //convert to array of bytes
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Rebuild Color Counts - admin only, recount every color from the color~id index and overwrite the counts
+//
+// The counts can't be better than the index, check_index_consistency() recounts on its own after repairing color~id.
+//
+// Returns:
+// {
+//	"blue": 12,
+//	"red": 3
+// }
+// ============================================================================================================================
+func rebuild_color_counts(stub shim.ChaincodeStubInterface) pb.Response {
+	fmt.Println("starting rebuild_color_counts")
+
+	err := require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	counts, err := recount_colors(stub, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	countsAsBytes, _ := json.Marshal(counts)                       //convert to array of bytes
+	fmt.Println("- end rebuild_color_counts")
+	return shim.Success(countsAsBytes)
+}
+
+// ============================================================================================================================
+// Recount Colors - count the color~id index and overwrite the color counts with it
+//
+// The index walk only sees what is committed, a tx that also changed color~id passes those changes in as color -> entries
+// added (negative for removed) so they are counted too.
+// ============================================================================================================================
+func recount_colors(stub shim.ChaincodeStubInterface, changed map[string]int) (map[string]int, error) {
+	counts := map[string]int{}
+	for color, delta := range changed {
+		counts[color] += delta
+	}
+
+	// count the index
+	indexIterator, err := stub.GetStateByPartialCompositeKey("color~id", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer indexIterator.Close()
+
+	for indexIterator.HasNext() {
+		indexKey, _, err := indexIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return nil, err
+		}
+		counts[keyParts[0]]++
+	}
+
+	// drop counts for colors nobody has anymore
+	countsIterator, err := stub.GetStateByPartialCompositeKey("colorcount~color", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer countsIterator.Close()
+
+	for countsIterator.HasNext() {
+		countKey, _, err := countsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(countKey)
+		if err != nil {
+			return nil, err
+		}
+		if counts[keyParts[0]] <= 0 {
+			err = stub.DelState(countKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// write the rest
+	for color, count := range counts {
+		if count <= 0 {
+			delete(counts, color)
+			continue
+		}
+		key, err := stub.CreateCompositeKey("colorcount~color", []string{color})
+		if err != nil {
+			return nil, err
+		}
+		countAsBytes, _ := json.Marshal(count)
+		err = stub.PutState(key, countAsBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
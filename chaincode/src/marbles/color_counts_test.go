@@ -0,0 +1,92 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Color Counts - follow creates, deletes and repaints, and a rebuild fixes a drifted count
+// ============================================================================================================================
+func TestColorCounts(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+
+	count := func(color string) int {
+		var result struct {
+			Color string `json:"color"`
+			Count int    `json:"count"`
+		}
+		must_decode(t, must_ok(t, stub.invoke("get_color_count", color)), &result)
+		return result.Count
+	}
+	expect := func(when string, red int, blue int) {
+		if got := count("red"); got != red {
+			t.Fatalf("expected %d red after %s, got %d", red, when, got)
+		}
+		if got := count(" Blue"); got != blue {
+			t.Fatalf("expected %d blue after %s, got %d", blue, when, got)
+		}
+	}
+
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000001", "Alpha")
+	expect("creating", 2, 1)
+
+	must_ok(t, stub.invoke("delete_marble", "m0000000000002", "Alpha"))
+	expect("deleting", 1, 1)
+
+	must_ok(t, stub.invoke("repaint_marbles_by_color", "red", "blue", "10"))
+	expect("repainting", 0, 2)
+	redKey, _ := stub.CreateCompositeKey("colorcount~color", []string{"red"})
+	if found, _ := get_state_as(stub, redKey, new(int)); found {
+		t.Fatal("expected a count of 0 to be deleted")
+	}
+
+	// drift, then rebuild
+	stub.run(func() pb.Response {
+		key, _ := stub.CreateCompositeKey("colorcount~color", []string{"blue"})
+		stub.PutState(key, []byte("7"))
+		key, _ = stub.CreateCompositeKey("colorcount~color", []string{"green"})
+		stub.PutState(key, []byte("3"))
+		return shim.Success(nil)
+	}, []string{"seed"})
+	expect("drifting", 0, 7)
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("rebuild_color_counts"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+	var counts map[string]int
+	must_decode(t, must_ok(t, stub.invoke("rebuild_color_counts")), &counts)
+	if len(counts) != 1 || counts["blue"] != 2 {
+		t.Fatalf("expected the rebuild to find 2 blue, got %v", counts)
+	}
+	expect("rebuilding", 0, 2)
+	if got := count("green"); got != 0 {
+		t.Fatalf("expected the green count nobody has to be dropped, got %d", got)
+	}
+}
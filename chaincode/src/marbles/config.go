@@ -0,0 +1,207 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Config - optional settings passed to Init() as a JSON string, stored on the ledger so every Invoke() sees them
+//
+// Example Init args:
+//  ["314", "{\"namespace\": \"tenant1\"}"]
+// ============================================================================================================================
+type Config struct {
+	Namespace               string          `json:"namespace,omitempty"`               //prefix for all marble/owner keys, empty for none
+	TransferCooldownSeconds int             `json:"transferCooldownSeconds,omitempty"` //min time between transfers of a marble, counted from its lastTransfer, 0 for none
+	ColorCaps               map[string]int  `json:"colorCaps,omitempty"`               //most marbles that can exist per color, colors left out are unlimited
+	CompanyCaps             map[string]int  `json:"companyCaps,omitempty"`             //most marbles all owners of a company can hold together, companies left out are unlimited
+	Admins                  []string        `json:"admins,omitempty"`                  //MSP ids whose members may call admin functions, none means nobody
+	Palette                 []string        `json:"palette,omitempty"`                 //the only colors marbles may have, none means any color
+	Limits                  Limits          `json:"limits"`                            //see limits.go
+	SeedDemo                bool            `json:"seedDemo,omitempty"`                //write the demo owners and marbles in seed.go during Init
+	TransferFee             int64           `json:"transferFee,omitempty"`             //charged to the new owner on every transfer, 0 for none
+	Treasury                string          `json:"treasury,omitempty"`                //owner id credited with transfer fees
+	EventPrefix             string          `json:"eventPrefix"`                       //put in front of every event name, see events.go, empty for none
+}
+
+const config_key = "marbles_config"
+
+var namespace_format = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,16}$`)
+var event_prefix_format = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,32}$`)
+
+// ============================================================================================================================
+// Parse Init Config - check every Init() argument, Init() refuses to start on any error
+//
+// Inputs - Array of Strings
+//    0   ,          1
+//  value , config (optional)
+//  "314" , "{\"namespace\": \"tenant1\"}"
+//
+// Returns the selftest value and the config, the defaults if no config was passed.
+// ============================================================================================================================
+func parse_init_config(args []string) (int, Config, error) {
+	var config Config
+	if len(args) != 1 && len(args) != 2 {
+		return 0, config, errors.New("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	// convert numeric string to integer
+	selftest, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, config, errors.New("Expecting a numeric string argument to Init()")
+	}
+
+	if len(args) == 2 {
+		config, err = parse_config(args[1])
+		if err != nil {
+			return 0, config, err
+		}
+	}
+	return selftest, config, nil
+}
+
+// ============================================================================================================================
+// Parse Config - decode and check the Init() config argument
+// ============================================================================================================================
+func parse_config(str string) (Config, error) {
+	var config Config
+	err := json.Unmarshal([]byte(str), &config)
+	if err != nil {
+		return config, errors.New("Config must be a JSON object - " + err.Error())
+	}
+
+	if len(config.Namespace) > 0 && !namespace_format.MatchString(config.Namespace) {
+		return config, errors.New("Config namespace must be 1-16 letters, numbers, '_' or '-'")
+	}
+	if len(config.EventPrefix) > 0 && !event_prefix_format.MatchString(config.EventPrefix) {
+		return config, errors.New("Config eventPrefix must be 1-32 letters, numbers, '_', '-' or '.'")
+	}
+	if config.TransferCooldownSeconds < 0 {
+		return config, errors.New("Config transferCooldownSeconds must be >= 0")
+	}
+	colorCaps := map[string]int{}
+	for color, limit := range config.ColorCaps {
+		if len(strings.TrimSpace(color)) == 0 {
+			return config, errors.New("Config colorCaps colors must be non-empty")
+		}
+		if limit < 0 {
+			return config, errors.New("Config colorCaps for '" + color + "' must be >= 0")
+		}
+		colorCaps[strings.ToLower(color)] = limit            //colors are stored lower case
+	}
+	config.ColorCaps = colorCaps
+	for company, limit := range config.CompanyCaps {
+		if limit < 0 {
+			return config, errors.New("Config companyCaps for '" + company + "' must be >= 0")
+		}
+	}
+	inPalette := map[string]bool{}
+	for i, color := range config.Palette {
+		config.Palette[i] = normalize_color(color)
+		if len(config.Palette[i]) == 0 {
+			return config, errors.New("Config palette colors must be non-empty")
+		}
+		if inPalette[config.Palette[i]] {
+			return config, errors.New("Config palette lists '" + config.Palette[i] + "' more than once")
+		}
+		inPalette[config.Palette[i]] = true
+	}
+	for _, admin := range config.Admins {
+		if len(admin) == 0 {
+			return config, errors.New("Config admins must be non-empty MSP ids")
+		}
+	}
+	if config.TransferFee < 0 {
+		return config, errors.New("Config transferFee must be >= 0")
+	}
+	if config.TransferFee > 0 && len(config.Treasury) == 0 {
+		return config, errors.New("Config treasury must be set to charge a transferFee")
+	}
+	if config.Limits.MaxRecords < 0 || config.Limits.MaxResponseBytes < 0 || config.Limits.MaxHistory < 0 {
+		return config, errors.New("Config limits must be >= 0")
+	}
+	return config, nil
+}
+
+// ============================================================================================================================
+// Load Config - read the config stored by Init(), an older deployment without one gets the defaults
+// ============================================================================================================================
+func load_config(stub shim.ChaincodeStubInterface) (Config, error) {
+	var config Config
+	_, err := get_state_as(stub, config_key, &config)
+	return config, err
+}
+
+// ============================================================================================================================
+// Check Color - error if a palette is configured and the (normalized) color isn't in it
+// ============================================================================================================================
+func (config Config) check_color(color string) error {
+	if len(config.Palette) == 0 {
+		return nil
+	}
+	for _, allowed := range config.Palette {
+		if allowed == color {
+			return nil
+		}
+	}
+	return errors.New("Color " + color + " is not in the palette")
+}
+
+// ============================================================================================================================
+// Get Config - read the config this instance is running with, as stored by Init()
+//
+// The admin list is only shown to admins, everyone else gets it left out and named under "redacted".
+//
+// Returns:
+// {
+//	"namespace": "tenant1",
+//	"limits": {"maxRecords": 500},
+//	"eventPrefix": "shop1.",
+//	"redacted": ["admins"]
+// }
+// ============================================================================================================================
+func get_config(stub shim.ChaincodeStubInterface) pb.Response {
+	type ConfigView struct {
+		Config
+		Redacted []string `json:"redacted,omitempty"`                        //fields left out for this caller
+	}
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	view := ConfigView{Config: config}
+	if len(config.Admins) > 0 && require_admin(stub) != nil {
+		view.Admins = nil
+		view.Redacted = append(view.Redacted, "admins")
+	}
+
+	configAsBytes, _ := json.Marshal(view)                                 //convert to array of bytes
+	return shim.Success(configAsBytes)
+}
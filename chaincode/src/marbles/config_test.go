@@ -0,0 +1,127 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// get_config() - what Init() was given, with the admins only shown to admins
+// ============================================================================================================================
+func TestGetConfig(t *testing.T) {
+	stub := new_test_stub(t, `{"namespace": "tenant1", "transferCooldownSeconds": 60, "colorCaps": {"Red": 5}, "admins": ["AdminMSP"], "limits": {"maxRecords": 500}, "eventPrefix": "shop1."}`)
+
+	type ConfigView struct {
+		Config
+		Redacted []string `json:"redacted"`
+	}
+	stub.as(t, "AdminMSP", "admin", nil)
+	var view ConfigView
+	must_decode(t, must_ok(t, stub.invoke("get_config")), &view)
+	if view.Namespace != "tenant1" || view.TransferCooldownSeconds != 60 || view.ColorCaps["red"] != 5 || view.Limits.MaxRecords != 500 || view.EventPrefix != "shop1." {
+		t.Fatalf("expected the config from Init, got %+v", view)
+	}
+	if len(view.Admins) != 1 || view.Admins[0] != "AdminMSP" || len(view.Redacted) != 0 {
+		t.Fatalf("expected an admin to see the admins, got %+v", view)
+	}
+
+	stub.as(t, "Org1MSP", "user", nil)
+	view = ConfigView{}
+	must_decode(t, must_ok(t, stub.invoke("get_config")), &view)
+	if view.Namespace != "tenant1" || len(view.Admins) != 0 || len(view.Redacted) != 1 || view.Redacted[0] != "admins" {
+		t.Fatalf("expected everyone else to get the admins redacted, got %+v", view)
+	}
+
+	// no config is the defaults
+	stub = new_test_stub(t, "")
+	view = ConfigView{}
+	must_decode(t, must_ok(t, stub.invoke("get_config")), &view)
+	if len(view.Namespace) != 0 || len(view.ColorCaps) != 0 || view.Limits.any() || len(view.Redacted) != 0 {
+		t.Fatalf("expected the defaults without a config, got %+v", view)
+	}
+}
+
+// ============================================================================================================================
+// parse_init_config() - a full config is normalized, every kind of bad argument is refused
+// ============================================================================================================================
+func TestParseInitConfig(t *testing.T) {
+	selftest, config, err := parse_init_config([]string{"314", `{
+		"namespace": "tenant_1", "eventPrefix": "shop1.", "transferCooldownSeconds": 60,
+		"colorCaps": {"Red": 5}, "companyCaps": {"Alpha": 10}, "palette": [" Red", "BLUE"], "admins": ["AdminMSP"],
+		"transferFee": 5, "treasury": "o0000000000009", "limits": {"maxRecords": 500, "maxResponseBytes": 4096, "maxHistory": 10}
+	}`})
+	if err != nil {
+		t.Fatalf("expected the config to be valid, got %s", err)
+	}
+	if selftest != 314 || config.Namespace != "tenant_1" || config.EventPrefix != "shop1." || config.TransferCooldownSeconds != 60 {
+		t.Fatalf("expected the config to be kept, got %d and %+v", selftest, config)
+	}
+	if config.ColorCaps["red"] != 5 || len(config.ColorCaps) != 1 || strings.Join(config.Palette, ",") != "red,blue" {
+		t.Fatalf("expected colors to be stored lower case, got %v and %v", config.ColorCaps, config.Palette)
+	}
+	if config.TransferFee != 5 || config.Treasury != "o0000000000009" || config.Limits.MaxHistory != 10 {
+		t.Fatalf("expected the fee and limits to be kept, got %+v", config)
+	}
+
+	// no config is the defaults
+	selftest, config, err = parse_init_config([]string{"42"})
+	if err != nil || selftest != 42 || len(config.Namespace) != 0 || config.Limits.any() {
+		t.Fatalf("expected the defaults without a config, got %d, %+v and %v", selftest, config, err)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{}, "Expecting 1 or 2"},
+		{[]string{"314", "{}", "extra"}, "Expecting 1 or 2"},
+		{[]string{"pi"}, "numeric string"},
+		{[]string{"314", "not json"}, "must be a JSON object"},
+		{[]string{"314", `{"namespace": "tenant 1"}`}, "Config namespace"},
+		{[]string{"314", `{"namespace": "a_namespace_too_long"}`}, "Config namespace"},
+		{[]string{"314", `{"eventPrefix": "shop/1"}`}, "Config eventPrefix"},
+		{[]string{"314", `{"transferCooldownSeconds": -1}`}, "transferCooldownSeconds must be >= 0"},
+		{[]string{"314", `{"colorCaps": {" ": 5}}`}, "colorCaps colors must be non-empty"},
+		{[]string{"314", `{"colorCaps": {"red": -1}}`}, "colorCaps for 'red'"},
+		{[]string{"314", `{"companyCaps": {"Alpha": -1}}`}, "companyCaps for 'Alpha'"},
+		{[]string{"314", `{"palette": ["red", ""]}`}, "palette colors must be non-empty"},
+		{[]string{"314", `{"palette": ["red", "RED"]}`}, "lists 'red' more than once"},
+		{[]string{"314", `{"admins": [""]}`}, "admins must be non-empty"},
+		{[]string{"314", `{"transferFee": -5, "treasury": "o0000000000009"}`}, "transferFee must be >= 0"},
+		{[]string{"314", `{"transferFee": 5}`}, "treasury must be set"},
+		{[]string{"314", `{"limits": {"maxHistory": -1}}`}, "limits must be >= 0"},
+		{[]string{"314", `{"transferCooldownSeconds": "60"}`}, "must be a JSON object"},
+	}
+	for _, test := range tests {
+		_, _, err := parse_init_config(test.args)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Fatalf("expected %q to be refused with %q, got %v", test.args, test.want, err)
+		}
+	}
+
+	// Init() refuses to start on the same errors
+	stub := new_test_stub(t, "")
+	must_fail(t, stub.run(func() pb.Response { return new(SimpleChaincode).Init(stub) }, []string{"init", "314", `{"transferFee": 5}`}), "treasury must be set")
+}
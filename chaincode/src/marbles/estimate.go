@@ -0,0 +1,126 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Estimate Write Set - run a create, transfer or delete without writing anything, report the keys it would write
+//
+// The real function runs against a recording_stub, which keeps its PutState() and DelState() calls to itself. Reads
+// still hit the ledger, so the estimate is exactly what the op would write right now. A key written twice counts once,
+// as it does in the real write set. Keys are reported without the config namespace prefix.
+//
+// Inputs - Array of Strings
+//      0    ,   1 ...
+//  operation, the args the operation takes
+//  "transfer", "m999999999", "o99999999999", "united marbles"
+//
+// Returns:
+// {
+//	"keys": 3,
+//	"bytes": 412,
+//	"writes": [{"key": "m999999999", "bytes": 300}, {"key": "\u0000owner~id\u0000o88888888888\u0000m999999999\u0000", "delete": true}]
+// }
+// ============================================================================================================================
+var write_set_operations = map[string]func(shim.ChaincodeStubInterface, []string) pb.Response{
+	"create":   init_marble,
+	"transfer": set_owner,
+	"delete":   delete_marble,
+}
+
+func estimate_write_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Write struct {
+		Key    string `json:"key"`
+		Bytes  int    `json:"bytes"`                                      //size of the value, 0 for deletes
+		Delete bool   `json:"delete,omitempty"`
+	}
+	type WriteSet struct {
+		Keys   int     `json:"keys"`
+		Bytes  int     `json:"bytes"`                                     //key and value bytes together
+		Writes []Write `json:"writes"`
+	}
+	writeSet := WriteSet{Writes: []Write{}}
+	fmt.Println("starting estimate_write_set")
+
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting an operation and its arguments")
+	}
+	operation, ok := write_set_operations[args[0]]
+	if !ok {
+		return shim.Error("Operation must be 'create', 'transfer' or 'delete'")
+	}
+
+	recorder := &recording_stub{ChaincodeStubInterface: stub, writes: map[string][]byte{}}
+	res := operation(recorder, args[1:])
+	if res.Status >= 400 {                                                 //shim.Error() uses 500
+		return shim.Error("The " + args[0] + " would fail - " + res.Message)
+	}
+
+	keys := []string{}
+	for key := range recorder.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)                                                     //map order is random, endorsers have to agree
+	for _, key := range keys {
+		value := recorder.writes[key]
+		writeSet.Writes = append(writeSet.Writes, Write{Key: key, Bytes: len(value), Delete: value == nil})
+		writeSet.Keys++
+		writeSet.Bytes += len(key) + len(value)
+	}
+
+	writeSetAsBytes, _ := json.Marshal(writeSet)                           //convert to array of bytes
+	fmt.Println("- end estimate_write_set")
+	return shim.Success(writeSetAsBytes)
+}
+
+// ============================================================================================================================
+// Recording Stub - keeps writes and events in memory instead of sending them to the peer, a nil value is a delete
+// ============================================================================================================================
+type recording_stub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte
+}
+
+func (s *recording_stub) PutState(key string, value []byte) error {
+	if value == nil {
+		return errors.New("PutState of a nil value for key " + key)
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *recording_stub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *recording_stub) SetEvent(name string, payload []byte) error {
+	return nil                                                             //events aren't part of the write set
+}
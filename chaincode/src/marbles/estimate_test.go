@@ -0,0 +1,83 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ============================================================================================================================
+// estimate_write_set() - the estimate is what the operation then writes
+// ============================================================================================================================
+func TestEstimateWriteSet(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	type Write struct {
+		Key    string `json:"key"`
+		Bytes  int    `json:"bytes"`
+		Delete bool   `json:"delete"`
+	}
+	type WriteSet struct {
+		Keys   int     `json:"keys"`
+		Bytes  int     `json:"bytes"`
+		Writes []Write `json:"writes"`
+	}
+	describe := func(writes []Write) string {                      //order doesn't matter
+		var lines []string
+		for _, write := range writes {
+			lines = append(lines, strconv.Quote(write.Key) + " " + strconv.Itoa(write.Bytes) + " " + strconv.FormatBool(write.Delete))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	check := func(operation string, function string, args ...string) {
+		var estimate WriteSet
+		must_decode(t, must_ok(t, stub.invoke(append([]string{"estimate_write_set", operation}, args...)...)), &estimate)
+
+		must_ok(t, stub.invoke(append([]string{function}, args...)...))
+		var actual []Write
+		bytes := 0
+		for key, value := range stub.writes {                      //what that tx wrote
+			actual = append(actual, Write{Key: key, Bytes: len(value), Delete: value == nil})
+			bytes += len(key) + len(value)
+		}
+		if describe(estimate.Writes) != describe(actual) || estimate.Keys != len(actual) || estimate.Bytes != bytes {
+			t.Fatalf("expected the %s estimate to match what it wrote\n%s\n%d keys %d bytes, got\n%s\n%d keys %d bytes", operation, describe(actual), len(actual), bytes, describe(estimate.Writes), estimate.Keys, estimate.Bytes)
+		}
+	}
+	check("create", "init_marble", "m0000000000002", "blue", "20", "o0000000000001", "Alpha")
+	check("transfer", "set_owner", "m0000000000002", "o0000000000002", "Alpha")
+	check("delete", "delete_marble", "m0000000000002", "Alpha")
+
+	// nothing is written by the estimate itself
+	must_ok(t, stub.invoke("estimate_write_set", "create", "m0000000000003", "blue", "20", "o0000000000001", "Alpha"))
+	if len(stub.writes) != 0 {
+		t.Fatalf("expected the estimate not to write, got %d keys", len(stub.writes))
+	}
+	must_fail(t, stub.invoke("estimate_write_set", "create", "m0000000000001", "blue", "20", "o0000000000001", "Alpha"), "The create would fail")
+	must_fail(t, stub.invoke("estimate_write_set", "paint"), "Operation must be")
+}
@@ -0,0 +1,38 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Event Stub - puts the configured event prefix in front of every event name, e.g. "shop1.marble_transferred"
+//
+// Invoke() wraps the stub in one of these when the config has an eventPrefix, so listeners of several chaincodes on one
+// channel can tell their events apart. Handlers keep calling SetEvent() with the plain names.
+// ============================================================================================================================
+type event_stub struct {
+	shim.ChaincodeStubInterface
+	prefix string
+}
+
+func (s *event_stub) SetEvent(name string, payload []byte) error {
+	return s.ChaincodeStubInterface.SetEvent(s.prefix + name, payload)
+}
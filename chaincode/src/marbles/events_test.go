@@ -0,0 +1,51 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"testing"
+)
+
+// ============================================================================================================================
+// Event Prefix - every event name gets the configured prefix, and no prefix leaves the names alone
+// ============================================================================================================================
+func TestEventPrefix(t *testing.T) {
+	emit := func(config string) map[string][]byte {
+		stub := new_test_stub(t, config)
+		stub.as(t, "AdminMSP", "admin", nil)
+		stub.owner(t, "o0000000000001", "amy", "Alpha")
+		stub.owner(t, "o0000000000002", "bob", "Alpha")
+		stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+		must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+		must_ok(t, stub.invoke("repaint_marbles_by_color", "red", "blue", "10"))
+		return stub.events
+	}
+
+	events := emit(`{"admins": ["AdminMSP"], "eventPrefix": "shop1."}`)
+	if len(events) != 2 || events["shop1.marble_transferred"] == nil || events["shop1.marbles_repainted"] == nil {
+		t.Fatalf("expected both events with the shop1. prefix, got %v", events)
+	}
+
+	events = emit(`{"admins": ["AdminMSP"]}`)
+	if len(events) != 2 || events["marble_transferred"] == nil || events["marbles_repainted"] == nil {
+		t.Fatalf("expected both events with their plain names, got %v", events)
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	mspprotos "github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Test Stub - a shim.MockStub with the parts it leaves out filled in
+//
+// The MockStub keeps state, keys and composite keys. Unlike a peer it lets a tx read its own writes, so writes are held
+// back here until the tx ends and only kept if it succeeded. The caller's identity, the tx timestamp, the transient map
+// and events are set by the test instead, so a test can pick who is calling and when.
+// ============================================================================================================================
+type test_stub struct {
+	*shim.MockStub
+	args      []string
+	now       time.Time
+	creator   []byte
+	transient map[string][]byte
+	events    map[string][]byte         //last payload per event name, across every tx
+	history   map[string][]test_history //every committed value per key, oldest first, nil for a delete
+	writes    map[string][]byte         //this tx's writes, nil for a delete
+	txs       int
+}
+
+type test_history struct {
+	txId  string
+	value []byte
+}
+
+var test_start = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// a chaincode with Init() already run, config may be "" for none
+func new_test_stub(t *testing.T, config string) *test_stub {
+	s := &test_stub{MockStub: shim.NewMockStub("marbles", new(SimpleChaincode)), now: test_start, events: map[string][]byte{}, history: map[string][]test_history{}}
+	args := []string{"init", "314"}
+	if len(config) > 0 {
+		args = append(args, config)
+	}
+	res := s.run(func() pb.Response { return new(SimpleChaincode).Init(s) }, args)
+	if res.Status >= 400 {
+		t.Fatalf("Init failed - %s", res.Message)
+	}
+	return s
+}
+
+func (s *test_stub) GetArgs() [][]byte {
+	args := [][]byte{}
+	for _, arg := range s.args {
+		args = append(args, []byte(arg))
+	}
+	return args
+}
+
+func (s *test_stub) GetStringArgs() []string {
+	return s.args
+}
+
+func (s *test_stub) GetFunctionAndParameters() (string, []string) {
+	if len(s.args) == 0 {
+		return "", []string{}
+	}
+	return s.args[0], s.args[1:]
+}
+
+func (s *test_stub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now.Unix(), Nanos: int32(s.now.Nanosecond())}, nil
+}
+
+func (s *test_stub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *test_stub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *test_stub) SetEvent(name string, payload []byte) error {
+	s.events[name] = payload
+	return nil
+}
+
+func (s *test_stub) PutState(key string, value []byte) error {
+	if len(s.TxID) == 0 {
+		return errors.New("PutState outside of a tx")
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *test_stub) DelState(key string) error {
+	if len(s.TxID) == 0 {
+		return errors.New("DelState outside of a tx")
+	}
+	s.writes[key] = nil
+	return nil
+}
+
+// write what the tx wrote to the MockStub, and keep a history like the peer would since the MockStub has none
+func (s *test_stub) commit() {
+	for key, value := range s.writes {
+		s.history[key] = append(s.history[key], test_history{txId: s.TxID, value: value})
+		if value == nil {
+			s.MockStub.DelState(key)
+		} else {
+			s.MockStub.PutState(key, value)
+		}
+	}
+}
+
+func (s *test_stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &test_history_iterator{entries: s.history[key]}, nil
+}
+
+type test_history_iterator struct {
+	entries []test_history
+}
+
+func (iter *test_history_iterator) HasNext() bool {
+	return len(iter.entries) > 0
+}
+
+func (iter *test_history_iterator) Next() (string, []byte, error) {
+	entry := iter.entries[0]
+	iter.entries = iter.entries[1:]
+	return entry.txId, entry.value, nil
+}
+
+func (iter *test_history_iterator) Close() error {
+	return nil
+}
+
+// run f as one tx with args as the function and its parameters, its writes are kept if it succeeds
+func (s *test_stub) run(f func() pb.Response, args []string) pb.Response {
+	s.txs++
+	txId := "tx" + strconv.Itoa(s.txs)
+	s.args = args
+	s.writes = map[string][]byte{}
+	s.MockTransactionStart(txId)
+	defer s.MockTransactionEnd(txId)
+	defer forget_tx(txId)                                     //Invoke() does this too, call() skips Invoke() and tx ids repeat across stubs
+	res := f()
+	if res.Status < 400 {
+		s.commit()
+	}
+	return res
+}
+
+// call the chaincode through Invoke(), the response comes back in the envelope
+func (s *test_stub) invoke(args ...string) pb.Response {
+	return s.run(func() pb.Response { return new(SimpleChaincode).Invoke(s) }, args)
+}
+
+// call one handler directly in its own tx, skipping Invoke()'s wrapping
+func (s *test_stub) call(handler func(shim.ChaincodeStubInterface, []string) pb.Response, args ...string) pb.Response {
+	return s.run(func() pb.Response { return handler(s, args) }, append([]string{"call"}, args...))
+}
+
+// make the following txs come from a member of mspId, attrs are fabric-ca style cert attributes
+func (s *test_stub) as(t *testing.T, mspId string, commonName string, attrs map[string]string) {
+	identityAsBytes, err := proto.Marshal(&mspprotos.SerializedIdentity{Mspid: mspId, IdBytes: test_cert(t, commonName, attrs)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.creator = identityAsBytes
+}
+
+// a throwaway self signed PEM cert
+func test_cert(t *testing.T, commonName string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    test_start.Add(-time.Hour),
+		NotAfter:     test_start.Add(24 * 365 * time.Hour),
+	}
+	if attrs != nil {
+		attrsAsBytes, _ := json.Marshal(map[string]interface{}{"attrs": attrs})
+		template.ExtraExtensions = []pkix.Extension{{Id: attribute_oid, Value: attrsAsBytes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// ============================================================================================================================
+// Checks - pass/fail a response, and decode what came back
+// ============================================================================================================================
+
+// the payload of a successful response, unwrapped from the envelope if there is one
+func must_ok(t *testing.T, res pb.Response) []byte {
+	if res.Status >= 400 {
+		t.Fatalf("expected success, got %d - %s", res.Status, res.Message)
+	}
+	var envelope ResponseEnvelope
+	if json.Unmarshal(res.Payload, &envelope) == nil && envelope.Version == response_version {
+		data, _ := json.Marshal(envelope.Data)
+		return data
+	}
+	return res.Payload
+}
+
+// fail unless the response is an error mentioning want
+func must_fail(t *testing.T, res pb.Response, want string) {
+	if res.Status < 400 {
+		t.Fatalf("expected an error containing %q, got success - %s", want, string(res.Payload))
+	}
+	if !strings.Contains(res.Message, want) {
+		t.Fatalf("expected an error containing %q, got %q", want, res.Message)
+	}
+}
+
+func must_decode(t *testing.T, data []byte, out interface{}) {
+	err := json.Unmarshal(data, out)
+	if err != nil {
+		t.Fatalf("bad JSON %s - %s", string(data), err)
+	}
+}
+
+// ============================================================================================================================
+// Fixtures - owners and marbles through the real init functions
+// ============================================================================================================================
+func (s *test_stub) owner(t *testing.T, id string, username string, company string) {
+	must_ok(t, s.call(init_owner, id, username, company))
+}
+
+func (s *test_stub) marble(t *testing.T, id string, color string, size int, owner_id string, company string) {
+	must_ok(t, s.call(init_marble, id, color, strconv.Itoa(size), owner_id, company))
+}
+
+func (s *test_stub) set(t *testing.T, id string, name string, owner_id string, company string) {
+	must_ok(t, s.call(create_set, id, name, owner_id, company, ""))
+}
+
+func (s *test_stub) get_marble(t *testing.T, id string) Marble {
+	var marble Marble
+	found, err := get_state_as(s, id, &marble)
+	if err != nil || !found {
+		t.Fatalf("marble %s not found - %v", id, err)
+	}
+	return marble
+}
+
+func (s *test_stub) get_owner(t *testing.T, id string) Owner {
+	var owner Owner
+	found, err := get_state_as(s, id, &owner)
+	if err != nil || !found {
+		t.Fatalf("owner %s not found - %v", id, err)
+	}
+	return owner
+}
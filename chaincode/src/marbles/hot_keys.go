@@ -0,0 +1,143 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const max_hot_keys = 100                                            //most keys get_hot_keys will return
+const max_tracked_hot_keys = 10000                                  //most keys counted at once, see evict_cold_keys()
+
+// ============================================================================================================================
+// Hot Keys - how often each marble key has been written, to find the keys most likely to hit MVCC conflicts
+//
+// Chaincode never sees commit conflicts, so this counts writes instead. Invoke() wraps the stub in a hot_key_stub which
+// counts every PutState() and DelState() on a marble key. The counts are:
+//  - per peer, each peer only counts the proposals it endorsed
+//  - in memory, they reset when the chaincode container restarts
+//  - counted at endorsement, a proposal that is never submitted or fails validation still counts
+//  - bounded, once max_tracked_hot_keys keys are counted the least written half is forgotten to make room
+// They are not on the ledger, so get_hot_keys() answers differ between peers. Use it for debugging, never in a tx.
+// ============================================================================================================================
+var hot_key_writes = map[string]int{}
+var hot_key_writes_lock sync.Mutex                                  //the shim runs txs concurrently
+
+type hot_key_stub struct {
+	shim.ChaincodeStubInterface
+}
+
+func (s *hot_key_stub) PutState(key string, value []byte) error {
+	count_hot_key(key)
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
+
+func (s *hot_key_stub) DelState(key string) error {
+	count_hot_key(key)
+	return s.ChaincodeStubInterface.DelState(key)
+}
+
+func count_hot_key(key string) {
+	if key < "m0" || key > "m9999999999999999999" {                //only marbles, same range the marble scans use
+		return
+	}
+	hot_key_writes_lock.Lock()
+	defer hot_key_writes_lock.Unlock()
+	if _, counted := hot_key_writes[key]; !counted && len(hot_key_writes) >= max_tracked_hot_keys {
+		evict_cold_keys()
+	}
+	hot_key_writes[key]++
+}
+
+// drop the least written half of the counts, the caller holds hot_key_writes_lock
+func evict_cold_keys() {
+	hot := hot_key_list{}
+	for key, writes := range hot_key_writes {
+		hot = append(hot, HotKey{key, writes})
+	}
+	sort.Sort(hot)
+	for _, cold := range hot[len(hot) / 2:] {
+		delete(hot_key_writes, cold.Key)
+	}
+}
+
+// ============================================================================================================================
+// Get Hot Keys - the N marble keys this peer has seen written the most, ties by key
+//
+// Inputs - Array of Strings
+//   0
+//   N
+//  "10"
+//
+// Returns:
+// [{
+//	"key": "m999999999",
+//	"writes": 42
+// }]
+// ============================================================================================================================
+func get_hot_keys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	hot := hot_key_list{}
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 || n > max_hot_keys {
+		return shim.Error("N must be a number from 1 to " + strconv.Itoa(max_hot_keys))
+	}
+
+	hot_key_writes_lock.Lock()
+	for key, writes := range hot_key_writes {
+		hot = append(hot, HotKey{key, writes})
+	}
+	hot_key_writes_lock.Unlock()
+
+	sort.Sort(hot)
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+
+	hotAsBytes, _ := json.Marshal(hot)                             //convert to array of bytes
+	return shim.Success(hotAsBytes)
+}
+
+type HotKey struct {
+	Key    string `json:"key"`
+	Writes int    `json:"writes"`
+}
+
+// most writes first, ties by key
+type hot_key_list []HotKey
+
+func (l hot_key_list) Len() int      { return len(l) }
+func (l hot_key_list) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l hot_key_list) Less(i, j int) bool {
+	if l[i].Writes != l[j].Writes {
+		return l[i].Writes > l[j].Writes
+	}
+	return l[i].Key < l[j].Key
+}
@@ -0,0 +1,62 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"testing"
+)
+
+// ============================================================================================================================
+// Hot Keys - a marble written over and over comes out on top, owners and other keys are not counted
+// ============================================================================================================================
+func TestGetHotKeys(t *testing.T) {
+	hot_key_writes_lock.Lock()
+	hot_key_writes = map[string]int{}                              //counts are global, start clean
+	hot_key_writes_lock.Unlock()
+
+	stub := new_test_stub(t, "")
+	must_ok(t, stub.invoke("init_owner", "o0000000000001", "amy", "Alpha"))
+	must_ok(t, stub.invoke("init_owner", "o0000000000002", "bob", "Alpha"))
+	must_ok(t, stub.invoke("init_marble", "m0000000000001", "red", "10", "o0000000000001", "Alpha"))
+	must_ok(t, stub.invoke("init_marble", "m0000000000002", "blue", "10", "o0000000000001", "Alpha"))
+	for i := 0; i < 3; i++ {
+		must_ok(t, stub.invoke("set_owner", "m0000000000002", "o0000000000002", "Alpha"))
+		must_ok(t, stub.invoke("set_owner", "m0000000000002", "o0000000000001", "Alpha"))
+	}
+
+	var hot []HotKey
+	must_decode(t, must_ok(t, stub.invoke("get_hot_keys", "10")), &hot)
+	if len(hot) != 2 {
+		t.Fatalf("expected only the 2 marbles to be counted, got %v", hot)
+	}
+	if hot[0].Key != "m0000000000002" || hot[0].Writes != 7 {
+		t.Fatalf("expected m0000000000002 with 7 writes first, got %v", hot)
+	}
+	if hot[1].Key != "m0000000000001" || hot[1].Writes != 1 {
+		t.Fatalf("expected m0000000000001 with 1 write second, got %v", hot)
+	}
+
+	must_decode(t, must_ok(t, stub.invoke("get_hot_keys", "1")), &hot)
+	if len(hot) != 1 || hot[0].Key != "m0000000000002" {
+		t.Fatalf("expected just the hottest key, got %v", hot)
+	}
+	must_fail(t, stub.invoke("get_hot_keys", "0"), "N must be a number")
+}
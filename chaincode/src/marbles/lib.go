@@ -20,49 +20,235 @@ under the License.
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	mspprotos "github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// ============================================================================================================================
+// Get State As - read a key from the ledger and unmarshal it into out
+//
+// Returns false for a key that does not exist, and an error if the ledger read or the JSON decode fails
+// ============================================================================================================================
+func get_state_as(stub shim.ChaincodeStubInterface, key string, out interface{}) (bool, error) {
+	valAsBytes, err := stub.GetState(key)                    //getState retreives a key/value from the ledger
+	if err != nil {
+		return false, errors.New("Failed to get state for " + key + " - " + err.Error())
+	}
+	if valAsBytes == nil {                                   //a missing key comes back as nil, not as an error
+		return false, nil
+	}
+	err = json.Unmarshal(valAsBytes, out)                    //un stringify it aka JSON.parse()
+	if err != nil {
+		return true, errors.New("Failed to decode state for " + key + " - " + err.Error())
+	}
+	return true, nil
+}
+
 // ============================================================================================================================
 // Get Marble - get a marble asset from ledger
 // ============================================================================================================================
 func get_marble(stub shim.ChaincodeStubInterface, id string) (Marble, error) {
 	var marble Marble
-	marbleAsBytes, err := stub.GetState(id)                  //getState retreives a key/value from the ledger
-	if err != nil {                                          //this seems to always succeed, even if key didn't exist
-		return marble, errors.New("Failed to find marble - " + id)
+	found, err := get_state_as(stub, id, &marble)
+	if err != nil {
+		return marble, err
 	}
-	json.Unmarshal(marbleAsBytes, &marble)                   //un stringify it aka JSON.parse()
-
-	if marble.Id != id {                                     //test if marble is actually here or just nil
+	if !found || marble.Id != id {                           //test if marble is actually here or just some other asset
 		return marble, errors.New("Marble does not exist - " + id)
 	}
 
 	return marble, nil
 }
 
+// ============================================================================================================================
+// Quantity - how many marbles are in this stack, marbles from before stacks existed are 1
+// ============================================================================================================================
+func (marble Marble) quantity() int {
+	if marble.Quantity <= 0 {
+		return 1
+	}
+	return marble.Quantity
+}
+
+// ============================================================================================================================
+// Has Tag - true if the marble carries the (normalized) tag
+// ============================================================================================================================
+func (marble Marble) has_tag(tag string) bool {
+	for _, t := range marble.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Marble Fields - the JSON names of the Marble struct's fields, the only names a fields argument may ask for
+// ============================================================================================================================
+var marble_fields = json_field_names(reflect.TypeOf(Marble{}))
+
+func json_field_names(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// ============================================================================================================================
+// Parse Fields - split a comma separated fields argument, "id,owner", erroring on names the Marble struct doesn't have
+// ============================================================================================================================
+func parse_fields(str string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(str, ",") {
+		field = strings.TrimSpace(field)
+		if !marble_fields[field] {
+			return nil, errors.New("Unknown marble field '" + field + "'")
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// ============================================================================================================================
+// Project Marble - just the requested fields of a marble, fields the marble leaves out stay out
+// ============================================================================================================================
+func project_marble(marble Marble, fields []string) map[string]interface{} {
+	var full map[string]interface{}
+	marbleAsBytes, _ := json.Marshal(marble)
+	json.Unmarshal(marbleAsBytes, &full)
+
+	projected := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := full[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// ============================================================================================================================
+// Marbles Response - the marbles as a JSON array, projected down to the fields if there are any
+// ============================================================================================================================
+func marbles_response(marbles []Marble, fields []string) []byte {
+	if len(fields) == 0 {
+		marblesAsBytes, _ := json.Marshal(marbles)
+		return marblesAsBytes
+	}
+	projected := []map[string]interface{}{}
+	for _, marble := range marbles {
+		projected = append(projected, project_marble(marble, fields))
+	}
+	projectedAsBytes, _ := json.Marshal(projected)
+	return projectedAsBytes
+}
+
 // ============================================================================================================================
 // Get Owner - get the owner asset from ledger
 // ============================================================================================================================
 func get_owner(stub shim.ChaincodeStubInterface, id string) (Owner, error) {
 	var owner Owner
-	ownerAsBytes, err := stub.GetState(id)                     //getState retreives a key/value from the ledger
-	if err != nil {                                            //this seems to always succeed, even if key didn't exist
-		return owner, errors.New("Failed to get owner - " + id)
+	found, err := get_state_as(stub, id, &owner)
+	if err != nil {
+		return owner, err
 	}
-	json.Unmarshal(ownerAsBytes, &owner)                       //un stringify it aka JSON.parse()
+	if !found || len(owner.Username) == 0 {                  //test if owner is actually here or just some other asset
+		return owner, errors.New("Owner does not exist - " + id)
+	}
+
+	return owner, nil
+}
+
+// ============================================================================================================================
+// Owner Cache - get_owner() that reads each owner at most once, for functions that resolve an owner per marble
+//
+// Make one with new_owner_cache() inside the function that needs it and let it go when the function returns. It is never
+// kept between calls, or it would hand one tx the owners another tx read. Misses are remembered too.
+// ============================================================================================================================
+type owner_lookup struct {
+	owner Owner
+	err   error
+}
+
+type owner_cache struct {
+	stub   shim.ChaincodeStubInterface
+	lock   sync.Mutex                                        //safe to share between goroutines of the same call
+	owners map[string]owner_lookup
+}
+
+func new_owner_cache(stub shim.ChaincodeStubInterface) *owner_cache {
+	return &owner_cache{stub: stub, owners: map[string]owner_lookup{}}
+}
 
-	if len(owner.Username) == 0 {                              //test if owner is actually here or just nil
-		return owner, errors.New("Owner does not exist - " + id + ", '" + owner.Username + "' '" + owner.Company + "'")
+func (c *owner_cache) get(id string) (Owner, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lookup, found := c.owners[id]
+	if !found {
+		lookup.owner, lookup.err = get_owner(c.stub, id)
+		c.owners[id] = lookup
+	}
+	return lookup.owner, lookup.err
+}
+
+// ============================================================================================================================
+// Require Enabled Owner - get the owner asset from ledger, error if it is missing or disabled
+//
+// Owners written before the enabled field existed don't have it, they count as enabled.
+// ============================================================================================================================
+func require_enabled_owner(stub shim.ChaincodeStubInterface, id string) (Owner, error) {
+	owner, err := get_owner(stub, id)
+	if err != nil {
+		return owner, err
+	}
+	if !owner.is_enabled() {
+		return owner, errors.New("Owner " + id + " is disabled")
 	}
-	
 	return owner, nil
 }
 
+// ============================================================================================================================
+// Is Enabled - true unless the owner was explicitly disabled
+// ============================================================================================================================
+func (owner Owner) is_enabled() bool {
+	return owner.Enabled == nil || *owner.Enabled
+}
+
+// ============================================================================================================================
+// Get Marble Set - get a marble set from ledger
+// ============================================================================================================================
+func get_marble_set(stub shim.ChaincodeStubInterface, id string) (MarbleSet, error) {
+	var set MarbleSet
+	found, err := get_state_as(stub, id, &set)
+	if err != nil {
+		return set, err
+	}
+	if !found || set.ObjectType != "marble_set" || set.Id != id {  //test if set is actually here or just some other asset
+		return set, errors.New("Set does not exist - " + id)
+	}
+
+	return set, nil
+}
+
 // ========================================================
 // Input Sanitation - dumb input checking, look for empty strings
 // ========================================================
@@ -77,3 +263,398 @@ func sanitize_arguments(strs []string) error{
 	}
 	return nil
 }
+
+// ========================================================
+// UTF-8 Sanitation - reject strings that aren't valid UTF-8, they break JSON and CouchDB, names[i] labels strs[i]
+// ========================================================
+func sanitize_utf8(names []string, strs []string) error{
+	for i, val:= range strs {
+		if !utf8.ValidString(val) {
+			name := "Argument " + strconv.Itoa(i)
+			if i < len(names) {
+				name = names[i]
+			}
+			return errors.New(name + " must be valid UTF-8")
+		}
+	}
+	return nil
+}
+
+
+// ========================================================
+// Sanitize Memo - strip control characters from a transfer memo and check its length in characters, empty is fine
+// ========================================================
+func sanitize_memo(memo string) (string, error) {
+	memo = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {                            //drop newlines, escapes, etc
+			return -1
+		}
+		return r
+	}, memo)
+	if utf8.RuneCountInString(memo) > max_memo_length {
+		return "", errors.New("Memo must be <= " + strconv.Itoa(max_memo_length) + " characters")
+	}
+	return memo, nil
+}
+
+// timestamps we write are RFC3339 in UTC with fixed width, so they also sort correctly as strings
+const time_format = "2006-01-02T15:04:05.000Z07:00"
+
+// ========================================================
+// Get Tx Time - the timestamp the client put on the proposal, same for every endorser
+// ========================================================
+func get_tx_time(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Failed to get tx timestamp - " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// ========================================================
+// Is Expired - true if the marble has an expiration and it is not after now
+// ========================================================
+func is_expired(marble Marble, now time.Time) bool {
+	if len(marble.ExpiresAt) == 0 {                         //most marbles never expire
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, marble.ExpiresAt)
+	if err != nil {                                          //validated on write, treat garbage as never expiring
+		return false
+	}
+	return !now.Before(expiresAt)
+}
+
+// ========================================================
+// Is Hidden - true if queries should leave the marble out, because it expired or is quarantined
+// ========================================================
+func is_hidden(marble Marble, now time.Time) bool {
+	return marble.Quarantine != nil || is_expired(marble, now)
+}
+
+// ========================================================
+// Include Expired - parse the optional "include expired marbles" query flag, missing or empty means false
+// ========================================================
+func include_expired_flag(args []string, pos int) (bool, error) {
+	if len(args) <= pos || len(args[pos]) == 0 {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(args[pos])
+	if err != nil {
+		return false, errors.New("Include expired flag must be 'true' or 'false'")
+	}
+	return include, nil
+}
+
+// ========================================================
+// Get Caller - MSP id and certificate of the client that signed the proposal
+// ========================================================
+func get_caller(stub shim.ChaincodeStubInterface) (string, *x509.Certificate, error) {
+	creator, err := stub.GetCreator()                        //the serialized identity from the proposal's signature header
+	if err != nil {
+		return "", nil, errors.New("Failed to get caller identity - " + err.Error())
+	}
+	if len(creator) == 0 {
+		return "", nil, errors.New("No caller identity available on this transaction")
+	}
+
+	var identity mspprotos.SerializedIdentity
+	err = proto.Unmarshal(creator, &identity)
+	if err != nil {
+		return "", nil, errors.New("Failed to decode caller identity - " + err.Error())
+	}
+
+	block, _ := pem.Decode(identity.IdBytes)                 //the identity bytes are a PEM encoded x509 cert
+	if block == nil {
+		return "", nil, errors.New("Caller identity does not contain a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, errors.New("Failed to parse caller certificate - " + err.Error())
+	}
+	return identity.Mspid, cert, nil
+}
+
+// ========================================================
+// Marble Indexes - each index kept on marbles and the attributes its entry for a marble should have, nil for no entry
+// ========================================================
+var marble_indexes = map[string]func(marble Marble) []string{
+	"owner~id": func(marble Marble) []string { return []string{marble.Owner.Id, marble.Id} },
+	"color~id": func(marble Marble) []string { return []string{marble.Color, marble.Id} },
+	"secondary~id": func(marble Marble) []string {
+		if len(marble.SecondaryColor) == 0 {
+			return nil
+		}
+		return []string{marble.SecondaryColor, marble.Id}
+	},
+}
+
+// ========================================================
+// Put Index - write an index entry, the composite key holds everything so the value is just a placeholder
+// ========================================================
+func put_index(stub shim.ChaincodeStubInterface, index string, attributes []string) error {
+	key, err := stub.CreateCompositeKey(index, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte{0x00})                  //value can't be nil, a nil value deletes the key
+}
+
+// ========================================================
+// Delete Index - remove an index entry
+// ========================================================
+func delete_index(stub shim.ChaincodeStubInterface, index string, attributes []string) error {
+	key, err := stub.CreateCompositeKey(index, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// ========================================================
+// Result Writer - streams query results into a response as they are read
+//
+// "json" (the default) builds one array:  [{"Key":"m1", "Record":{...}},{"Key":"m2", "Record":{...}}]
+// "ndjson" writes one object per line:    {"Key":"m1", "Record":{...}}\n{"Key":"m2", "Record":{...}}\n
+// so a client can handle each record as it arrives. Either way the records are never unmarshalled/remarshalled, NDJSON
+// only has the whitespace taken out of them so each stays on its line.
+// ========================================================
+type result_writer struct {
+	buffer bytes.Buffer
+	ndjson bool
+	count  int
+	done   bool
+}
+
+func new_result_writer(format string) (*result_writer, error) {
+	writer := &result_writer{}
+	switch format {
+	case "", "json":
+		writer.buffer.WriteString("[")
+	case "ndjson":
+		writer.ndjson = true
+	default:
+		return nil, errors.New("Format must be 'json' or 'ndjson'")
+	}
+	return writer, nil
+}
+
+// add a record, the value must already be a JSON object
+func (w *result_writer) write(key string, value []byte) {
+	if !w.ndjson && w.count > 0 {
+		w.buffer.WriteString(",")                            //add a comma before array members, suppress it for the first
+	}
+	w.buffer.WriteString("{\"Key\":")
+	w.buffer.WriteString("\"")
+	w.buffer.WriteString(key)
+	w.buffer.WriteString("\"")
+	w.buffer.WriteString(", \"Record\":")
+	if w.ndjson {
+		if json.Compact(&w.buffer, value) != nil {           //one line per record, init_marble's JSON spans several
+			w.buffer.Write(value)
+		}
+	} else {
+		w.buffer.Write(value)                                //Record is a JSON object, so we write as-is
+	}
+	w.buffer.WriteString("}")
+	if w.ndjson {
+		w.buffer.WriteString("\n")
+	}
+	w.count++
+}
+
+// finished response, no more writes after this
+func (w *result_writer) bytes() []byte {
+	if !w.ndjson && !w.done {
+		w.buffer.WriteString("]")
+	}
+	w.done = true
+	return w.buffer.Bytes()
+}
+
+// the finished response to send back, NDJSON is marked so Invoke() passes it through
+func (w *result_writer) response() pb.Response {
+	if w.ndjson {
+		return ndjson_response(w.bytes())
+	}
+	return shim.Success(w.bytes())
+}
+
+// ========================================================
+// Count Index - how many entries an index has under a partial key
+// ========================================================
+func count_index(stub shim.ChaincodeStubInterface, index string, attributes []string) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, attributes)
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		_, _, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ========================================================
+// Index Ids - the last key part of every entry an index has under a partial key, e.g. the marble ids of a color
+// ========================================================
+func index_ids(stub shim.ChaincodeStubInterface, index string, attributes []string) ([]string, error) {
+	ids := []string{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, keyParts[len(keyParts)-1])
+	}
+	return ids, nil
+}
+
+// ========================================================
+// Get Caller Attribute - value of a fabric-ca attribute on the caller's enrollment cert, false if it doesn't have it
+//
+// fabric-ca puts attributes in a cert extension as JSON, {"attrs": {"name": "value"}}
+// ========================================================
+var attribute_oid = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+func get_caller_attribute(stub shim.ChaincodeStubInterface, name string) (string, bool, error) {
+	_, cert, err := get_caller(stub)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attribute_oid) {
+			continue
+		}
+		var attributes struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		err = json.Unmarshal(ext.Value, &attributes)
+		if err != nil {
+			return "", false, errors.New("Failed to decode caller cert attributes - " + err.Error())
+		}
+		value, found := attributes.Attrs[name]
+		return value, found, nil
+	}
+	return "", false, nil                                    //no attributes at all
+}
+
+// ========================================================
+// Require Admin - error unless the caller's MSP is in the config's admin list
+// ========================================================
+func require_admin(stub shim.ChaincodeStubInterface) error {
+	config, err := load_config(stub)
+	if err != nil {
+		return err
+	}
+	mspId, _, err := get_caller(stub)
+	if err != nil {
+		return err
+	}
+	for _, admin := range config.Admins {
+		if admin == mspId {
+			return nil
+		}
+	}
+	return errors.New("Caller from " + mspId + " is not an admin")
+}
+
+// ========================================================
+// Normalize - the current formatting rules for stored fields, new writes and canonicalize_marbles both use these
+// ========================================================
+func normalize_color(color string) string {
+	return strings.ToLower(strings.TrimSpace(color))
+}
+
+func normalize_username(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func normalize_tag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func normalize_company(company string) string {
+	return strings.TrimSpace(company)
+}
+
+// ========================================================
+// Response Envelope - every function's result is wrapped the same way so clients don't have to guess what came back
+//
+//  {"version": 1, "ok": true, "data": <function's JSON result, or a string if it wasn't JSON, or null>}
+//  {"version": 1, "ok": false, "error": "what went wrong"}
+//
+// Failures still go back as shim.Error() so a failed invoke is never endorsed, the envelope is the error message.
+// The one exception is NDJSON (the "ndjson" format of the range queries, getHistoryForMarblePaged), it goes back as is so
+// a client can still read it a line at a time. Handlers send it with ndjson_response() so it's marked, never guessed.
+// Bump response_version if the shape ever changes.
+// ========================================================
+const response_version = 1
+
+type ResponseEnvelope struct {
+	Version int         `json:"version"`
+	Ok      bool        `json:"ok"`
+	Data    interface{} `json:"data"`
+	Error   string      `json:"error,omitempty"`
+}
+
+func respondOK(v interface{}) pb.Response {
+	envelopeAsBytes, err := json.Marshal(ResponseEnvelope{Version: response_version, Ok: true, Data: v})
+	if err != nil {
+		return respondErr(errors.New("Failed to encode response - " + err.Error()))
+	}
+	return shim.Success(envelopeAsBytes)
+}
+
+func respondErr(err error) pb.Response {
+	envelopeAsBytes, _ := json.Marshal(ResponseEnvelope{Version: response_version, Ok: false, Error: err.Error()})
+	return shim.Error(string(envelopeAsBytes))
+}
+
+// ========================================================
+// NDJSON Response - a successful response whose payload is NDJSON, wrap_response() passes these through unwrapped
+// ========================================================
+const ndjson_message = "ndjson"
+
+func ndjson_response(payload []byte) pb.Response {
+	resp := shim.Success(payload)
+	resp.Message = ndjson_message
+	return resp
+}
+
+// ========================================================
+// Wrap Response - put a handler's plain response into the envelope, Invoke() runs every result through this
+// ========================================================
+func wrap_response(resp pb.Response) pb.Response {
+	if resp.Status >= 400 {                                  //shim.Error() uses 500
+		return respondErr(errors.New(resp.Message))
+	}
+	if resp.Message == ndjson_message {                      //ndjson, pass it through, see above
+		return resp
+	}
+	if len(resp.Payload) == 0 {                              //writes usually return nothing
+		return respondOK(nil)
+	}
+	var data json.RawMessage
+	if json.Unmarshal(resp.Payload, &data) == nil {          //already JSON, embed it as is
+		return respondOK(data)
+	}
+	return respondOK(string(resp.Payload))                   //raw values from read(), etc
+}
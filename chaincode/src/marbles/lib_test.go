@@ -0,0 +1,291 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// wrap_response() - the envelope, and NDJSON passed through
+// ============================================================================================================================
+func TestResponseEnvelope(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	// a successful read
+	res := stub.invoke("read", "m0000000000001")
+	var envelope struct {
+		Version int              `json:"version"`
+		Ok      bool             `json:"ok"`
+		Data    *json.RawMessage `json:"data"`
+		Error   string           `json:"error"`
+	}
+	must_decode(t, res.Payload, &envelope)
+	if envelope.Version != response_version || !envelope.Ok || envelope.Data == nil || len(envelope.Error) != 0 {
+		t.Fatalf("expected an ok envelope with data, got %s", string(res.Payload))
+	}
+	var marble Marble
+	must_decode(t, *envelope.Data, &marble)
+	if marble.Id != "m0000000000001" {
+		t.Fatalf("expected the marble in the data, got %s", string(*envelope.Data))
+	}
+
+	// a raw value that happens to end in a newline is still wrapped
+	must_ok(t, stub.invoke("write", "abc", "not ndjson\n"))
+	res = stub.invoke("read", "abc")
+	envelope.Data = nil
+	must_decode(t, res.Payload, &envelope)
+	if !envelope.Ok || string(*envelope.Data) != `"not ndjson\n"` {
+		t.Fatalf("expected the raw value in an envelope, got %s", string(res.Payload))
+	}
+
+	// an error
+	res = stub.invoke("read")
+	if res.Status < 400 {
+		t.Fatal("expected read with no key to fail")
+	}
+	envelope.Data = nil
+	must_decode(t, []byte(res.Message), &envelope)
+	if envelope.Version != response_version || envelope.Ok || envelope.Data != nil || len(envelope.Error) == 0 {
+		t.Fatalf("expected a failed envelope with an error, got %s", res.Message)
+	}
+
+	// ndjson goes back as is, even when there is nothing in it
+	res = stub.invoke("getMarblesByRange", "m0", "m9", "", "ndjson")
+	if res.Status >= 400 || !strings.HasPrefix(string(res.Payload), `{"Key":"m0000000000001"`) {
+		t.Fatalf("expected unwrapped ndjson, got %s", string(res.Payload))
+	}
+	res = stub.invoke("getMarblesByRange", "n0", "n9", "", "ndjson")
+	if res.Status >= 400 || len(res.Payload) != 0 {
+		t.Fatalf("expected an empty ndjson response, got %s", string(res.Payload))
+	}
+}
+
+// ============================================================================================================================
+// sanitize_memo() - control characters and length
+// ============================================================================================================================
+func TestSanitizeMemo(t *testing.T) {
+	memo, err := sanitize_memo("thanks\n for\tthe marble\x1b")
+	if err != nil || memo != "thanks forthe marble" {
+		t.Fatalf("expected control characters stripped, got %q %v", memo, err)
+	}
+
+	// the limit is in characters, not bytes
+	memo, err = sanitize_memo(strings.Repeat("é", max_memo_length))
+	if err != nil || memo != strings.Repeat("é", max_memo_length) {
+		t.Fatalf("expected %d two byte characters to fit, got %v", max_memo_length, err)
+	}
+	_, err = sanitize_memo(strings.Repeat("é", max_memo_length + 1))
+	if err == nil {
+		t.Fatal("expected one character over the limit to fail")
+	}
+}
+
+// ============================================================================================================================
+// sanitize_utf8() - invalid bytes are named in the error, and nothing is written
+// ============================================================================================================================
+func TestSanitizeUtf8(t *testing.T) {
+	err := sanitize_utf8([]string{"Color"}, []string{"r\xffd"})
+	if err == nil || err.Error() != "Color must be valid UTF-8" {
+		t.Fatalf("expected the color to be rejected, got %v", err)
+	}
+	err = sanitize_utf8([]string{"Color"}, []string{"bleu ciel é", "\xc3\x28"})
+	if err == nil || err.Error() != "Argument 1 must be valid UTF-8" {
+		t.Fatalf("expected an unnamed argument to be labeled by position, got %v", err)
+	}
+
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	must_fail(t, stub.invoke("init_marble", "m0000000000002", "r\xffd", "10", "o0000000000001", "Alpha"), "Color must be valid UTF-8")
+	must_fail(t, stub.invoke("init_owner", "o0000000000002", "b\xc3\x28b", "Alpha"), "Username must be valid UTF-8")
+	must_fail(t, stub.invoke("set_secondary_color", "m0000000000001", "\xe2\x82", "Alpha"), "Secondary color must be valid UTF-8")
+	if found, _ := get_state_as(stub, "m0000000000002", &Marble{}); found {
+		t.Fatal("expected the marble with a bad color not to be written")
+	}
+	must_ok(t, stub.invoke("init_marble", "m0000000000002", "bleu ciel é", "10", "o0000000000001", "Alpha"))
+}
+
+// ============================================================================================================================
+// get_state_as() - present, absent and corrupt values
+// ============================================================================================================================
+func TestGetStateAs(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	must_ok(t, stub.invoke("write", "junk", "{not json"))
+
+	var owner Owner
+	found, err := get_state_as(stub, "o0000000000001", &owner)
+	if !found || err != nil || owner.Username != "amy" {
+		t.Fatalf("expected amy, got %v %v %+v", found, err, owner)
+	}
+
+	found, err = get_state_as(stub, "o0000000000009", &owner)
+	if found || err != nil {
+		t.Fatalf("expected a missing key to be not found without an error, got %v %v", found, err)
+	}
+
+	found, err = get_state_as(stub, "junk", &owner)
+	if !found || err == nil || !strings.Contains(err.Error(), "Failed to decode state for junk") {
+		t.Fatalf("expected a decode error for junk, got %v %v", found, err)
+	}
+}
+
+// ============================================================================================================================
+// require_enabled_owner() - enabled, enabled by default, disabled and missing owners
+// ============================================================================================================================
+func TestRequireEnabledOwner(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("update_owner", "o0000000000001", "Alpha", "false", "none", "true"))
+	must_ok(t, stub.invoke("update_owner", "o0000000000002", "Alpha", "false", "none", "false"))
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"o0000000000001", ""},
+		{"o0000000000003", ""},                                    //never set, enabled
+		{"o0000000000002", "Owner o0000000000002 is disabled"},
+		{"o0000000000009", "Owner does not exist - o0000000000009"},
+	}
+	for _, test := range tests {
+		owner, err := require_enabled_owner(stub, test.id)
+		if len(test.want) == 0 && (err != nil || owner.Id != test.id) {
+			t.Fatalf("expected %s to be enabled, got %v", test.id, err)
+		}
+		if len(test.want) > 0 && (err == nil || err.Error() != test.want) {
+			t.Fatalf("expected %q for %s, got %v", test.want, test.id, err)
+		}
+	}
+
+	// and the functions that use it
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"), "is disabled")
+	must_ok(t, stub.invoke("update_owner", "o0000000000002", "Alpha", "false", "none", "true"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("update_owner", "o0000000000002", "Alpha", "false", "none", "false"))
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"), "Owner o0000000000002 is disabled")
+}
+
+// ============================================================================================================================
+// parse_fields() and project_marble() - a subset of a marble's fields, unknown names rejected
+// ============================================================================================================================
+func TestProjections(t *testing.T) {
+	fields, err := parse_fields(" id, owner ,size")
+	if err != nil || strings.Join(fields, ",") != "id,owner,size" {
+		t.Fatalf("expected id, owner and size, got %v %v", fields, err)
+	}
+	_, err = parse_fields("id,weight")
+	if err == nil || err.Error() != "Unknown marble field 'weight'" {
+		t.Fatalf("expected weight to be unknown, got %v", err)
+	}
+	_, err = parse_fields("Color")                                  //the JSON names, not the Go ones
+	if err == nil {
+		t.Fatal("expected Color to be unknown")
+	}
+
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000001", "Alpha")
+
+	var projected map[string]interface{}
+	must_decode(t, must_ok(t, stub.invoke("read", "m0000000000001", "color,owner,expiresAt")), &projected)
+	owner, _ := projected["owner"].(map[string]interface{})
+	if len(projected) != 2 || projected["color"] != "red" || owner["username"] != "amy" {
+		t.Fatalf("expected just color and owner, expiresAt isn't set, got %v", projected)
+	}
+
+	var projectedList []map[string]interface{}
+	must_decode(t, must_ok(t, stub.invoke("read_marbles_by_filter", `{"ownerId": "o0000000000001"}`, "size")), &projectedList)
+	if len(projectedList) != 2 || len(projectedList[0]) != 1 || projectedList[1]["size"] != float64(20) {
+		t.Fatalf("expected just the sizes, got %v", projectedList)
+	}
+
+	must_fail(t, stub.invoke("read", "m0000000000001", "id,weight"), "Unknown marble field 'weight'")
+	must_fail(t, stub.invoke("read_marbles_by_filter", `{}`, "weight"), "Unknown marble field")
+	must_fail(t, stub.invoke("read", "o0000000000001", "id"), "o0000000000001 is not a marble")
+	must_ok(t, stub.invoke("read", "o0000000000001"))
+}
+
+// ============================================================================================================================
+// owner_cache - each distinct owner is read once however many marbles name it, misses too, and from many goroutines
+// ============================================================================================================================
+type counting_stub struct {
+	*test_stub
+	lock  sync.Mutex
+	reads map[string]int
+}
+
+func (s *counting_stub) GetState(key string) ([]byte, error) {
+	s.lock.Lock()
+	s.reads[key]++
+	s.lock.Unlock()
+	return s.test_stub.GetState(key)
+}
+
+func TestOwnerCache(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+
+	counter := &counting_stub{test_stub: stub, reads: map[string]int{}}
+	owners := new_owner_cache(counter)
+	var wait sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			id := []string{"o0000000000001", "o0000000000002", "o0000000000009"}[i % 3]
+			owner, err := owners.get(id)
+			if id == "o0000000000009" && err == nil {
+				t.Errorf("expected o0000000000009 to be missing")
+			} else if id != "o0000000000009" && owner.Id != id {
+				t.Errorf("expected owner %s, got %+v %v", id, owner, err)
+			}
+		}(i)
+	}
+	wait.Wait()
+	if len(counter.reads) != 3 || counter.reads["o0000000000001"] != 1 || counter.reads["o0000000000002"] != 1 || counter.reads["o0000000000009"] != 1 {
+		t.Fatalf("expected one read per owner, got %v", counter.reads)
+	}
+
+	// the same through a handler, a long history naming two owners over and over
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	for i := 0; i < 5; i++ {
+		must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+		must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	}
+	counter.reads = map[string]int{}
+	must_ok(t, stub.run(func() pb.Response { return get_audit_trail(counter, []string{"m0000000000001"}) }, []string{"get_audit_trail"}))
+	if counter.reads["o0000000000001"] != 1 || counter.reads["o0000000000002"] != 1 {
+		t.Fatalf("expected one read per owner across 11 versions, got %v", counter.reads)
+	}
+}
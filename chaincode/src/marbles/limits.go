@@ -0,0 +1,146 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Limits - caps set at Init() to protect the peers, 0 means unlimited
+//
+// Rather than every function counting for itself, Invoke() wraps the stub in a limit_stub when any are set. Each range,
+// composite key, rich query and history iterator it hands out errors once it has returned its max, so every scanning
+// function stops the same way. The response size is checked in Invoke() once the function returns.
+// ============================================================================================================================
+type Limits struct {
+	MaxRecords       int `json:"maxRecords"`       //most results a single query iterator may return
+	MaxResponseBytes int `json:"maxResponseBytes"` //biggest response payload
+	MaxHistory       int `json:"maxHistory"`       //most entries a single history iterator may return
+}
+
+func (l Limits) any() bool {
+	return l.MaxRecords > 0 || l.MaxResponseBytes > 0 || l.MaxHistory > 0
+}
+
+func limit_error(what string, max int) error {
+	return errors.New("Limit exceeded - more than " + strconv.Itoa(max) + " " + what + ", paginate or narrow the query")
+}
+
+// ============================================================================================================================
+// Limit Stub - hands out iterators that stop at the configured limits
+// ============================================================================================================================
+type limit_stub struct {
+	shim.ChaincodeStubInterface
+	limits Limits
+}
+
+func (s *limit_stub) wrap(iter shim.StateQueryIteratorInterface, err error) (shim.StateQueryIteratorInterface, error) {
+	if err != nil || s.limits.MaxRecords == 0 {
+		return iter, err
+	}
+	return &limit_iterator{StateQueryIteratorInterface: iter, max: s.limits.MaxRecords}, nil
+}
+
+func (s *limit_stub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return s.wrap(s.ChaincodeStubInterface.GetStateByRange(startKey, endKey))
+}
+
+func (s *limit_stub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	return s.wrap(s.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, attributes))
+}
+
+func (s *limit_stub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return s.wrap(s.ChaincodeStubInterface.GetQueryResult(query))
+}
+
+func (s *limit_stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	iter, err := s.ChaincodeStubInterface.GetHistoryForKey(key)
+	if err != nil || s.limits.MaxHistory == 0 {
+		return iter, err
+	}
+	return &limit_history_iterator{HistoryQueryIteratorInterface: iter, max: s.limits.MaxHistory}, nil
+}
+
+type limit_iterator struct {
+	shim.StateQueryIteratorInterface
+	max   int
+	count int
+}
+
+func (it *limit_iterator) Next() (string, []byte, error) {
+	if it.count == it.max {
+		return "", nil, limit_error("records", it.max)
+	}
+	it.count++
+	return it.StateQueryIteratorInterface.Next()
+}
+
+type limit_history_iterator struct {
+	shim.HistoryQueryIteratorInterface
+	max   int
+	count int
+}
+
+func (it *limit_history_iterator) Next() (string, []byte, error) {
+	if it.count == it.max {
+		return "", nil, limit_error("history entries", it.max)
+	}
+	it.count++
+	return it.HistoryQueryIteratorInterface.Next()
+}
+
+// ============================================================================================================================
+// Check Response Size - turn an oversized response into an error
+//
+// Invoke() runs this on the wrapped response, see wrap_response(), so the envelope counts toward the limit too.
+// ============================================================================================================================
+func check_response_size(resp pb.Response, limits Limits) pb.Response {
+	if limits.MaxResponseBytes > 0 && len(resp.Payload) > limits.MaxResponseBytes {
+		return respondErr(limit_error("response bytes", limits.MaxResponseBytes))
+	}
+	return resp
+}
+
+// ============================================================================================================================
+// Get Limits - the limits this instance is running with, 0 means unlimited
+//
+// Inputs - none
+//
+// Returns:
+// {
+//	"maxRecords": 500,
+//	"maxResponseBytes": 1048576,
+//	"maxHistory": 100
+// }
+// ============================================================================================================================
+func get_limits(stub shim.ChaincodeStubInterface) pb.Response {
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limitsAsBytes, _ := json.Marshal(config.Limits)
+	return shim.Success(limitsAsBytes)
+}
@@ -20,6 +20,8 @@ under the License.
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -40,16 +42,69 @@ type Marble struct {
 	ObjectType string        `json:"docType"` //field for couchdb
 	Id       string          `json:"id"`      //the fieldtags are needed to keep case from bouncing around
 	Color      string        `json:"color"`
+	SecondaryColor string    `json:"secondaryColor,omitempty"` //optional, see set_secondary_color()
 	Size       int           `json:"size"`    //size in mm of marble
 	Owner      OwnerRelation `json:"owner"`
+	ExpiresAt  string        `json:"expiresAt,omitempty"` //optional RFC3339 time, after this the marble is hidden from queries
+	Gift       *Gift         `json:"gift,omitempty"`      //set while the marble is waiting to be claimed
+	Pool       *Pool         `json:"pool,omitempty"`      //set while the marble waits for a caller with this cert attribute
+	Collateral *Collateral   `json:"collateral,omitempty"` //set while the marble secures a loan, it can't be moved or deleted
+	LastModified string      `json:"lastModified,omitempty"` //tx timestamp of the last write, see time_format
+	LastTransfer string      `json:"lastTransfer,omitempty"` //tx timestamp of the last change of owner, the transfer cooldown runs from here
+	Quantity   int           `json:"quantity,omitempty"`  //marbles in this stack, see split_marble(), missing means a single marble
+	Tags       []string      `json:"tags,omitempty"`      //lower case labels, each one indexed under tag~id
+	Views      int64         `json:"views,omitempty"`     //counters, see increment_marble_counter()
+	Score      int64         `json:"score,omitempty"`
+	InsuredValue int64       `json:"insuredValue,omitempty"` //admin set, see set_insured_value(), missing means 0
+	InsuredValueSet *AuditStamp `json:"insuredValueSet,omitempty"` //who last set the insured value and when
+	TransferAttempts *TransferAttempts `json:"transferAttempts,omitempty"` //failed transfers a client is retrying, see record_transfer_attempt()
+	TransferCount *int          `json:"transferCount,omitempty"` //times it changed owner, missing until backfill_transfer_counts() gets to it
+	Quarantine *Quarantine      `json:"quarantine,omitempty"` //set by an admin while the marble is under investigation, see quarantine_marble()
+}
+
+type Gift struct {
+	CodeHash   string `json:"codeHash"`    //sha256 of the claim code, the code itself is never stored
+	ExpiresAt  string `json:"expiresAt,omitempty"`
+}
+
+type AuditStamp struct {
+	By         string `json:"by"`          //"<msp id>/<cert common name>" of the caller
+	At         string `json:"at"`          //tx timestamp, see time_format
+}
+
+type TransferAttempts struct {
+	Count        int    `json:"count"`
+	LastError    string `json:"lastError"`
+	NextEligible string `json:"nextEligible"` //don't retry before this, see time_format
+	NeedsReview  bool   `json:"needsReview,omitempty"` //hit max_transfer_attempts, a person has to look at it
+}
+
+type Quarantine struct {
+	Reason     string `json:"reason"`
+	AuditStamp                             //the admin who quarantined it, and when
+}
+
+type Collateral struct {
+	LoanId     string `json:"loanId"`
+	LenderId   string `json:"lenderId"`    //owner id that gets the marble if the loan defaults
+}
+
+type Pool struct {
+	Attribute  string `json:"attribute"`   //fabric-ca attribute name on the claimer's enrollment cert, ie "department"
+	Value      string `json:"value"`       //the value it must have, ie "sales"
 }
 
 // ----- Owners ----- //
 type Owner struct {
-	ObjectType string `json:"docType"`     //field for couchdb
-	Id         string `json:"id"`
-	Username   string `json:"username"`
-	Company    string `json:"company"`
+	ObjectType    string `json:"docType"`     //field for couchdb
+	Id            string `json:"id"`
+	Username      string `json:"username"`
+	Company       string `json:"company"`
+	Notify        bool   `json:"notify"`      //include this owner in notification events, older owners default to false
+	ContactMethod string `json:"contactMethod,omitempty"` //one of contact_methods
+	Enabled       *bool  `json:"enabled,omitempty"`       //disabled owners can't send or receive marbles, missing means enabled
+	PublicKey     string `json:"publicKey,omitempty"`     //PEM ECDSA key, lets the owner sign transfers for transfer_marble_signed()
+	Balance       int64  `json:"balance,omitempty"`       //transfer fees paid (negative) or, for the treasury, collected
 }
 
 type OwnerRelation struct {
@@ -58,6 +113,64 @@ type OwnerRelation struct {
 	Company    string `json:"company"`     //this is mostly cosmetic/handy, the real relation is by Id not Company
 }
 
+// ----- Sets ----- //
+type MarbleSet struct {
+	ObjectType  string        `json:"docType"`     //field for couchdb
+	Id          string        `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Owner       OwnerRelation `json:"owner"`       //the set's owner, marbles in the set can belong to anyone
+}
+
+// ----- Transfer Queue ----- //
+type TransferRequest struct {
+	ObjectType string `json:"docType"`     //field for couchdb
+	MarbleId   string `json:"marbleId"`
+	OwnerId    string `json:"ownerId"`     //who wants the marble
+	Seq        int    `json:"seq"`
+	Timestamp  string `json:"timestamp"`   //tx timestamp, RFC3339
+}
+
+// ----- Condition Reports ----- //
+type ConditionReport struct {
+	ObjectType  string `json:"docType"`     //field for couchdb
+	MarbleId    string `json:"marbleId"`
+	InspectorId string `json:"inspectorId"` //from the caller's cert, see inspector_attribute
+	Findings    string `json:"findings"`
+	Grade       int    `json:"grade"`       //1 (poor) to 10 (mint)
+	Timestamp   string `json:"timestamp"`   //tx timestamp, RFC3339
+}
+
+// ----- Messages ----- //
+type Message struct {
+	ObjectType  string `json:"docType"`     //field for couchdb
+	FromOwnerId string `json:"fromOwnerId"`
+	ToOwnerId   string `json:"toOwnerId"`
+	MarbleId    string `json:"marbleId"`    //the marble it's about
+	Text        string `json:"text"`
+	Timestamp   string `json:"timestamp"`   //tx timestamp, RFC3339
+}
+
+// ----- Trade Offers ----- //
+type Offer struct {
+	ObjectType string `json:"docType"`     //field for couchdb
+	Id         string `json:"id"`          //the tx id that made the offer
+	CreatedAt  string `json:"createdAt"`   //tx timestamp, offers are matched oldest first
+	OwnerId    string `json:"ownerId"`
+	MarbleId   string `json:"marbleId"`    //what the owner gives
+	WantColor  string `json:"wantColor"`   //what they want for it, "" for any color
+	WantSize   int    `json:"wantSize"`    //0 for any size
+}
+
+// ----- Comments ----- //
+type Comment struct {
+	ObjectType string `json:"docType"`     //field for couchdb
+	MarbleId   string `json:"marbleId"`
+	AuthorId   string `json:"authorId"`    //owner id of the author
+	Text       string `json:"text"`
+	Timestamp  string `json:"timestamp"`   //tx timestamp, RFC3339
+}
+
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
@@ -75,17 +188,29 @@ func main() {
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("Marbles Is Starting Up")
 	_, args := stub.GetFunctionAndParameters()
-	var Aval int
-	var err error
+	defer forget_tx(stub.GetTxID())                            //demo seeding uses the tx cache
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	// check every argument up front, see config.go
+	Aval, config, err := parse_init_config(args)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// convert numeric string to integer
-	Aval, err = strconv.Atoi(args[0])
+	configAsBytes, _ := json.Marshal(config)
+	err = stub.PutState(config_key, configAsBytes)
 	if err != nil {
-		return shim.Error("Expecting a numeric string argument to Init()")
+		return shim.Error(err.Error())
+	}
+
+	// optional demo data, kept inside the namespace like everything else
+	if config.SeedDemo {
+		var seedStub shim.ChaincodeStubInterface = stub
+		if len(config.Namespace) > 0 {
+			seedStub = new_namespace_stub(stub, config.Namespace)
+		}
+		err = seed_demo_data(seedStub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
 	// store compaitible marbles application version
@@ -104,6 +229,237 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
 
+// ============================================================================================================================
+// Reinit - Init() called through Invoke(), used as reset
+//
+// Init() stores a new config, and the config's admin list is what require_admin() checks. So once a config exists only an
+// admin may run it again, or anyone could name themselves admin (or move everyone to a new namespace). With no admins
+// configured nobody can, change the config with a chaincode upgrade instead, which calls Init() directly.
+// ============================================================================================================================
+func reinit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	existing, err := stub.GetState(config_key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		err = require_admin(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return new(SimpleChaincode).Init(stub)
+}
+
+// ============================================================================================================================
+// API - every function Invoke() can dispatch to, and the argument spec describe_api() reports for it
+// ============================================================================================================================
+type ArgSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`                 //string, int, bool, json, timestamp (RFC3339)
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type ApiFunction struct {
+	Function    string    `json:"function"`
+	Args        []ArgSpec `json:"args"`
+	Description string    `json:"description"`
+	handler     func(stub shim.ChaincodeStubInterface, args []string) pb.Response
+}
+
+var api []ApiFunction
+
+// the table is filled in here and not in api's declaration because describe_api reads api
+func init() {
+	api = []ApiFunction{
+		{"init", []ArgSpec{{"selftest value", "int", false}, {"config", "json", true}},
+			"initialize the chaincode state, used as reset - admin only once a config is stored",
+			reinit},
+		{"read", []ArgSpec{{"key", "string", false}, {"fields", "string", true}, {"include expired", "bool", true}},
+			"generic read ledger, expired marbles only if asked for", read},
+		{"write", []ArgSpec{{"key", "string", false}, {"value", "string", false}},
+			"generic writes to ledger", write},
+		{"delete_marble", []ArgSpec{{"marble id", "string", false}, {"authing company", "string", false}, {"expected owner id", "string", true}},
+			"deletes a marble from state, optionally only if it has the expected owner", delete_marble},
+		{"delete_marble_admin", []ArgSpec{{"marble id", "string", false}},
+			"admin - deletes a marble from state without owner checks", delete_marble_admin},
+		{"init_marble", []ArgSpec{{"marble id", "string", false}, {"color", "string", false}, {"size", "int", false}, {"owner id", "string", false}, {"authing company", "string", false}, {"expires at", "timestamp", true}},
+			"create a new marble", init_marble},
+		{"set_owner", []ArgSpec{{"marble id", "string", false}, {"new owner id", "string", false}, {"authing company", "string", false}, {"memo", "string", true}},
+			"change owner of a marble", set_owner},
+		{"init_owner", []ArgSpec{{"owner id", "string", false}, {"username", "string", false}, {"company", "string", false}},
+			"create a new marble owner", init_owner},
+		{"read_everything", []ArgSpec{{"include expired", "bool", true}},
+			"read everything, (owners + marbles + companies)", read_everything},
+		{"getHistory", []ArgSpec{{"marble id", "string", false}},
+			"read history of a marble (audit)", getHistory},
+		{"getMarblesByRange", []ArgSpec{{"start key", "string", false}, {"end key", "string", false}, {"include expired", "bool", true}, {"format", "string", true}},
+			"read a bunch of marbles by start and stop id", getMarblesByRange},
+		{"add_comment", []ArgSpec{{"marble id", "string", false}, {"author owner id", "string", false}, {"text", "string", false}},
+			"leave a note on a marble", add_comment},
+		{"get_comments", []ArgSpec{{"marble id", "string", false}},
+			"read the notes on a marble, oldest first", get_comments},
+		{"get_color_stats", []ArgSpec{},
+			"read count and sizes of marbles per color",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return get_color_stats(stub) }},
+		{"delete_expired_marbles", []ArgSpec{{"batch size", "int", false}},
+			"purge a batch of expired marbles", delete_expired_marbles},
+		{"get_caller_org", []ArgSpec{},
+			"read the msp id and name of whoever is calling",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return get_caller_org(stub) }},
+		{"get_owner_color_inventory", []ArgSpec{{"owner id", "string", false}},
+			"read how many of each color an owner holds", get_owner_color_inventory},
+		{"create_gift", []ArgSpec{{"marble id", "string", false}, {"authing company", "string", false}, {"expires at", "timestamp", true}},
+			"make a marble claimable with a one time code, code goes in transient 'claim_code'", create_gift},
+		{"claim_gift", []ArgSpec{{"marble id", "string", false}, {"claimer owner id", "string", false}},
+			"take a gifted marble, code goes in transient 'claim_code'", claim_gift},
+		{"get_marble_tx_count", []ArgSpec{{"marble id", "string", false}},
+			"read how many transactions modified a marble, capped", get_marble_tx_count},
+		{"read_marbles_by_filter", []ArgSpec{{"filter", "json", false}, {"fields", "string", true}},
+			"read marbles matching a color, owner id and/or size range", read_marbles_by_filter},
+		{"read_marble_expanded", []ArgSpec{{"marble id", "string", false}},
+			"read a marble with its full owner record inlined", read_marble_expanded},
+		{"canonicalize_marbles", []ArgSpec{{"bookmark", "string", false}, {"page size", "int", false}},
+			"admin - rewrite a page of marbles and owners that don't follow the current formatting rules", canonicalize_marbles},
+		{"update_owner", []ArgSpec{{"owner id", "string", false}, {"authing company", "string", false}, {"notify", "bool", false}, {"contact method", "string", false}, {"enabled", "bool", true}},
+			"change an owner's notification preferences, and enable or disable them", update_owner},
+		{"getMarblesChangedBetween", []ArgSpec{{"start", "timestamp", false}, {"end", "timestamp", false}},
+			"read marbles whose lastModified falls in a time window", getMarblesChangedBetween},
+		{"create_set", []ArgSpec{{"set id", "string", false}, {"name", "string", false}, {"owner id", "string", false}, {"authing company", "string", false}, {"description", "string", false}},
+			"create a themed set of marbles", create_set},
+		{"add_marble_to_set", []ArgSpec{{"set id", "string", false}, {"marble id", "string", false}, {"authing company", "string", false}},
+			"put a marble in a set", add_marble_to_set},
+		{"remove_marble_from_set", []ArgSpec{{"set id", "string", false}, {"marble id", "string", false}, {"authing company", "string", false}},
+			"take a marble out of a set", remove_marble_from_set},
+		{"add_set_to_set", []ArgSpec{{"parent set id", "string", false}, {"child set id", "string", false}, {"authing company", "string", false}},
+			"nest a set inside another, refused if it would put a set inside itself", add_set_to_set},
+		{"merge_sets", []ArgSpec{{"into set id", "string", false}, {"from set id", "string", false}, {"authing company", "string", false}, {"batch size", "int", false}},
+			"move a batch of the second set's marbles into the first, the second set is deleted once empty", merge_sets},
+		{"get_set", []ArgSpec{{"set id", "string", false}},
+			"read a set and the marbles in it", get_set},
+		{"get_set_marbles_for_owner", []ArgSpec{{"set id", "string", false}, {"owner id", "string", false}},
+			"read the marbles of a set that one owner holds", get_set_marbles_for_owner},
+		{"check_index_consistency", []ArgSpec{{"index name", "string", false}, {"check or repair", "string", false}, {"bookmark", "string", false}, {"page size", "int", false}},
+			"report (admin - and fix) marble index entries that don't match the marbles", check_index_consistency},
+		{"get_limits", []ArgSpec{},
+			"read the record, response size and history limits, 0 means unlimited",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return get_limits(stub) }},
+		{"enqueue_transfer", []ArgSpec{{"marble id", "string", false}, {"requesting owner id", "string", false}, {"authing company", "string", false}},
+			"get in line for a marble", enqueue_transfer},
+		{"process_transfer_queue", []ArgSpec{{"marble id", "string", false}},
+			"admin - give a marble to the first valid request in its queue", process_transfer_queue},
+		{"find_incomplete_marbles", []ArgSpec{{"field names...", "string", false}},
+			"list marbles missing any of the given fields", find_incomplete_marbles},
+		{"sweep_expired_reservations", []ArgSpec{{"batch size", "int", false}},
+			"clear up to a batch of gifts that expired unclaimed", sweep_expired_reservations},
+		{"get_ledger_stats", []ArgSpec{{"scan cap", "int", true}},
+			"read a health summary of marbles, owners and indexes", get_ledger_stats},
+		{"repaint_marbles_by_color", []ArgSpec{{"from color", "string", false}, {"to color", "string", false}, {"page size", "int", false}},
+			"admin - change up to a page of marbles from one color to another", repaint_marbles_by_color},
+		{"put_marble_in_pool", []ArgSpec{{"marble id", "string", false}, {"attribute name", "string", false}, {"attribute value", "string", false}, {"authing company", "string", false}},
+			"let any caller whose cert has this attribute value claim the marble", put_marble_in_pool},
+		{"claim_marbles_by_attribute", []ArgSpec{{"attribute name", "string", false}, {"owner id", "string", false}, {"authing company", "string", false}},
+			"claim every pooled marble matching the caller's cert attribute", claim_marbles_by_attribute},
+		{"set_owner_public_key", []ArgSpec{{"owner id", "string", false}, {"authing company", "string", false}, {"public key", "string", false}},
+			"store the PEM ECDSA public key an owner signs transfers with", set_owner_public_key},
+		{"transfer_marble_signed", []ArgSpec{{"marble id", "string", false}, {"to owner id", "string", false}, {"signature", "string", false}, {"memo", "string", true}},
+			"transfer a marble on the strength of its owner's signature", transfer_marble_signed},
+		{"split_marble", []ArgSpec{{"marble id", "string", false}, {"new marble id", "string", false}, {"quantity", "int", false}, {"authing company", "string", false}},
+			"move part of a marble stack into a new marble", split_marble},
+		{"merge_marbles", []ArgSpec{{"marble id", "string", false}, {"merged marble id", "string", false}, {"authing company", "string", false}},
+			"combine a matching marble stack into another, deleting it", merge_marbles},
+		{"get_config", []ArgSpec{},
+			"read the config this instance was started with, admins only shown to admins",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return get_config(stub) }},
+		{"estimate_write_set", []ArgSpec{{"operation", "string", false}, {"operation args...", "string", false}},
+			"report the keys a create, transfer or delete would write, without writing them", estimate_write_set},
+		{"set_secondary_color", []ArgSpec{{"marble id", "string", false}, {"secondary color", "string", false}, {"authing company", "string", false}},
+			"set or clear (with \"\") a marble's secondary color", set_secondary_color},
+		{"queryMarblesBySecondaryColor", []ArgSpec{{"secondary color", "string", false}, {"fields", "string", true}},
+			"read the unexpired marbles with a secondary color", queryMarblesBySecondaryColor},
+		{"lock_as_collateral", []ArgSpec{{"marble id", "string", false}, {"loan id", "string", false}, {"lender id", "string", false}, {"authing company", "string", false}},
+			"lock a marble against a loan, it can't be moved or deleted until released", lock_as_collateral},
+		{"release_collateral", []ArgSpec{{"marble id", "string", false}, {"lender's authing company", "string", false}},
+			"unlock a marble once its loan is repaid", release_collateral},
+		{"liquidate_collateral", []ArgSpec{{"marble id", "string", false}},
+			"admin - give a locked marble to its lender when the loan defaults", liquidate_collateral},
+		{"get_top_owners", []ArgSpec{{"k", "int", false}},
+			"read the k owners with the most marbles", get_top_owners},
+		{"draw_marble", []ArgSpec{{"color", "string", true}},
+			"pick a raffle winner from the unexpired marbles, seeded by the tx id", draw_marble},
+		{"tag_marbles_by_query", []ArgSpec{{"color", "string", false}, {"tag", "string", false}, {"page size", "int", false}},
+			"admin - tag up to a page of the marbles of a color", tag_marbles_by_query},
+		{"compare_owner_inventories", []ArgSpec{{"owner id", "string", false}, {"other owner id", "string", false}},
+			"read the colors and sizes each of two owners has that the other lacks, and what they share", compare_owner_inventories},
+		{"increment_marble_counter", []ArgSpec{{"marble id", "string", false}, {"counter", "string", false}, {"delta", "int", false}, {"authing company", "string", false}},
+			"add to a marble's views or score counter", increment_marble_counter},
+		{"set_insured_value", []ArgSpec{{"marble id", "string", false}, {"insured value", "int", false}},
+			"admin - set a marble's insured value", set_insured_value},
+		{"get_total_insured_value", []ArgSpec{{"owner id", "string", true}},
+			"read the insured value of an owner's marbles, or of every owner's", get_total_insured_value},
+		{"get_marbles_by_company", []ArgSpec{},
+			"read every unexpired marble grouped by its owner's company",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return get_marbles_by_company(stub) }},
+		{"get_color_count", []ArgSpec{{"color", "string", false}},
+			"read how many marbles have a color, from its running count", get_color_count},
+		{"rebuild_color_counts", []ArgSpec{},
+			"admin - recount every color from the color index",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return rebuild_color_counts(stub) }},
+		{"get_hot_keys", []ArgSpec{{"n", "int", false}},
+			"read the n marble keys this peer has seen written most, in memory and per peer", get_hot_keys},
+		{"create_offer", []ArgSpec{{"marble id", "string", false}, {"wanted color", "string", false}, {"wanted size", "int", false}, {"authing company", "string", false}},
+			"offer a marble in trade for any marble of a color and/or size", create_offer},
+		{"cancel_offer", []ArgSpec{{"offer id", "string", false}, {"authing company", "string", false}},
+			"withdraw an open trade offer", cancel_offer},
+		{"match_offers", []ArgSpec{},
+			"swap the marbles of every pair of open offers that want each other's marble",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return match_offers(stub) }},
+		{"send_message", []ArgSpec{{"from owner id", "string", false}, {"to owner id", "string", false}, {"marble id", "string", false}, {"text", "string", false}, {"authing company", "string", false}},
+			"send another owner a message about a marble", send_message},
+		{"get_messages", []ArgSpec{{"owner id", "string", false}},
+			"read an owner's inbox, oldest first", get_messages},
+		{"get_recommended_marbles", []ArgSpec{{"owner id", "string", false}, {"limit", "int", true}},
+			"recommend one marble in each color the owner doesn't have yet", get_recommended_marbles},
+		{"add_condition_report", []ArgSpec{{"marble id", "string", false}, {"findings", "string", false}, {"grade", "int", false}},
+			"append an inspector's condition report to a marble, the caller's cert must have the inspector attribute", add_condition_report},
+		{"get_condition_reports", []ArgSpec{{"marble id", "string", false}},
+			"read a marble's condition reports, oldest first", get_condition_reports},
+		{"queryMarblesByTagAndColor", []ArgSpec{{"tag", "string", false}, {"color", "string", false}, {"fields", "string", true}},
+			"read marbles that have both the tag and the color", queryMarblesByTagAndColor},
+		{"getHistoryForMarblePaged", []ArgSpec{{"id", "string", false}, {"max entries", "int", false}, {"skip", "int", true}},
+			"read a page of a marble's history as NDJSON, with a last line saying where to continue", getHistoryForMarblePaged},
+		{"get_state_snapshot_hash", []ArgSpec{{"algorithm", "string", true}},
+			"hash every marble and owner in key order into one digest", get_state_snapshot_hash},
+		{"record_transfer_attempt", []ArgSpec{{"marble id", "string", false}, {"error", "string", false}, {"authing company", "string", false}},
+			"log a failed transfer on a marble and when to retry, flags it for review after too many", record_transfer_attempt},
+		{"clear_transfer_attempts", []ArgSpec{{"marble id", "string", false}, {"authing company", "string", false}},
+			"clear a marble's failed transfer log once a retry worked", clear_transfer_attempts},
+		{"find_stuck_marbles", []ArgSpec{{"threshold seconds", "int", false}, {"bookmark", "string", false}, {"page size", "int", false}},
+			"list marbles left pending (gift, pool, collateral, transfer retry or queue) longer than the threshold, by kind", find_stuck_marbles},
+		{"simulate_transfer", []ArgSpec{{"marble id", "string", false}, {"new owner id", "string", false}, {"authing company", "string", false}},
+			"check whether set_owner would allow a transfer and list every rule it breaks, without writing", simulate_transfer},
+		{"get_marbles_by_percentile", []ArgSpec{{"from percent", "int", false}, {"to percent", "int", false}},
+			"read the marbles whose size falls in a percentile range, e.g. 90 to 100 for the biggest 10%", get_marbles_by_percentile},
+		{"init_owner_with_marble", []ArgSpec{{"owner id", "string", false}, {"username", "string", false}, {"company", "string", false}, {"marble id", "string", false}, {"color", "string", false}, {"size", "int", false}, {"expires at", "timestamp", true}},
+			"create an owner and their first marble together, neither is written if either is invalid", init_owner_with_marble},
+		{"find_never_transferred", []ArgSpec{{"bookmark", "string", false}, {"page size", "int", false}},
+			"list marbles that never changed owner, a page at a time", find_never_transferred},
+		{"queryMarblesByTransferCountRange", []ArgSpec{{"min", "int", false}, {"max", "int", false}},
+			"read marbles that changed owner between min and max times, inclusive", queryMarblesByTransferCountRange},
+		{"backfill_transfer_counts", []ArgSpec{{"bookmark", "string", false}, {"page size", "int", false}},
+			"admin only - set transferCount from history on a page of marbles that don't have one", backfill_transfer_counts},
+		{"get_audit_trail", []ArgSpec{{"marble id", "string", false}},
+			"read a marble's history as plain sentences, oldest first", get_audit_trail},
+		{"quarantine_marble", []ArgSpec{{"marble id", "string", false}, {"reason", "string", false}},
+			"admin only - hide a marble from queries and block its transfers until released", quarantine_marble},
+		{"release_quarantine", []ArgSpec{{"marble id", "string", false}},
+			"admin only - release a quarantined marble", release_quarantine},
+		{"get_distinct_values", []ArgSpec{{"field", "string", false}},
+			"list the distinct values of color, secondaryColor, tag, ownerId, company or size", get_distinct_values},
+		{"describe_api", []ArgSpec{},
+			"read this list, function names with their arguments",
+			func(stub shim.ChaincodeStubInterface, args []string) pb.Response { return describe_api(stub) }},
+	}
+}
 
 // ============================================================================================================================
 // Invoke - Our entry point for Invocations
@@ -112,33 +468,45 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println(" ")
 	fmt.Println("starting invoke, for - " + function)
+	defer forget_tx(stub.GetTxID())
+
+	// init gets the raw stub, Init() stores a config that may name a new namespace and seeds inside that one itself
+	if function == "init" {
+		return wrap_response(reinit(stub, args))
+	}
+
+	// keep this invoke inside the configured namespace, if there is one
+	config, err := load_config(stub)
+	if err != nil {
+		return respondErr(err)
+	}
+	if len(config.Namespace) > 0 {
+		stub = new_namespace_stub(stub, config.Namespace)
+	}
+
+	// and inside the configured limits, see limits.go
+	if config.Limits.any() {
+		stub = &limit_stub{ChaincodeStubInterface: stub, limits: config.Limits}
+	}
+
+	// name events with the configured prefix, see events.go
+	if len(config.EventPrefix) > 0 {
+		stub = &event_stub{ChaincodeStubInterface: stub, prefix: config.EventPrefix}
+	}
+
+	// count marble writes for get_hot_keys(), see hot_keys.go
+	stub = &hot_key_stub{ChaincodeStubInterface: stub}
 
-	// Handle different functions
-	if function == "init" {                    //initialize the chaincode state, used as reset
-		return t.Init(stub)
-	} else if function == "read" {             //generic read ledger
-		return read(stub, args)
-	} else if function == "write" {            //generic writes to ledger
-		return write(stub, args)
-	} else if function == "delete_marble" {    //deletes a marble from state
-		return delete_marble(stub, args)
-	} else if function == "init_marble" {      //create a new marble
-		return init_marble(stub, args)
-	} else if function == "set_owner" {        //change owner of a marble
-		return set_owner(stub, args)
-	} else if function == "init_owner"{        //create a new marble owner
-		return init_owner(stub, args)
-	} else if function == "read_everything"{   //read everything, (owners + marbles + companies)
-		return read_everything(stub)
-	} else if function == "getHistory"{        //read history of a marble (audit)
-		return getHistory(stub, args)
-	} else if function == "getMarblesByRange"{ //read a bunch of marbles by start and stop id
-		return getMarblesByRange(stub, args)
+	// Handle different functions, the result goes back in the standard response envelope
+	for _, f := range api {
+		if f.Function == function {
+			return check_response_size(wrap_response(f.handler(stub, args)), config.Limits)
+		}
 	}
 
 	// error out
 	fmt.Println("Received unknown invoke function name - " + function)
-	return shim.Error("Received unknown invoke function name - '" + function + "'")
+	return respondErr(errors.New("Received unknown invoke function name - '" + function + "'"))
 }
 
 
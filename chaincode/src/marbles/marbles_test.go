@@ -0,0 +1,109 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// api - every dispatched function has a spec, and describe_api() reports them
+// ============================================================================================================================
+func TestApiSpecs(t *testing.T) {
+	types := map[string]bool{"string": true, "int": true, "bool": true, "json": true, "timestamp": true}
+	seen := map[string]bool{}
+	for _, f := range api {
+		if len(f.Function) == 0 || f.handler == nil || len(f.Description) == 0 {
+			t.Fatalf("expected %q to have a name, a handler and a description", f.Function)
+		}
+		if seen[f.Function] {
+			t.Fatalf("expected %q to be dispatched once", f.Function)
+		}
+		seen[f.Function] = true
+		optional := false
+		for _, arg := range f.Args {
+			if !types[arg.Type] {
+				t.Fatalf("expected %s's %q to have a known type, got %q", f.Function, arg.Name, arg.Type)
+			}
+			if optional && !arg.Optional {
+				t.Fatalf("expected %s's optional args to come last", f.Function)
+			}
+			optional = arg.Optional
+		}
+	}
+
+	stub := new_test_stub(t, "")
+	var described []struct {
+		Function string    `json:"function"`
+		Args     []ArgSpec `json:"args"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("describe_api")), &described)
+	if len(described) != len(api) {
+		t.Fatalf("expected %d functions described, got %d", len(api), len(described))
+	}
+	want := []ArgSpec{{"marble id", "string", false}, {"new owner id", "string", false}, {"authing company", "string", false}, {"memo", "string", true}}
+	for _, f := range described {
+		if f.Function != "set_owner" {
+			continue
+		}
+		if len(f.Args) != len(want) {
+			t.Fatalf("expected set_owner to take %d args, got %+v", len(want), f.Args)
+		}
+		for i := range want {
+			if f.Args[i] != want[i] {
+				t.Fatalf("expected set_owner's arg %d to be %+v, got %+v", i, want[i], f.Args[i])
+			}
+		}
+		must_fail(t, stub.invoke("no_such_function"), "Received unknown invoke function name")
+		return
+	}
+	t.Fatal("expected set_owner to be described")
+}
+
+// ============================================================================================================================
+// Init() - demo data only with the seed flag, and only once
+// ============================================================================================================================
+func TestInitSeedDemo(t *testing.T) {
+	stub := new_test_stub(t, "")
+	if found, _ := get_state_as(stub, demo_owners[0][0], &Owner{}); found {
+		t.Fatal("expected no demo data without the seed flag")
+	}
+
+	stub = new_test_stub(t, `{"seedDemo": true}`)
+	for _, args := range demo_owners {
+		if owner := stub.get_owner(t, args[0]); owner.Username != args[1] {
+			t.Fatalf("expected demo owner %v, got %+v", args, owner)
+		}
+	}
+	for _, args := range demo_marbles {
+		if marble := stub.get_marble(t, args[0]); marble.Color != args[1] || marble.Owner.Id != args[3] {
+			t.Fatalf("expected demo marble %v, got %+v", args, marble)
+		}
+	}
+
+	// an upgrade runs Init() again, the demo data is left alone
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "United Marbles"))
+	must_ok(t, stub.run(func() pb.Response { return new(SimpleChaincode).Init(stub) }, []string{"init", "314", `{"seedDemo": true}`}))
+	if marble := stub.get_marble(t, "m0000000000001"); marble.Owner.Id != "o0000000000002" {
+		t.Fatalf("expected the demo marble to stay where it was moved, got %+v", marble)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Namespace Stub - lets several logical marble collections share one chaincode
+//
+// Invoke() wraps the real stub in one of these when a namespace is configured. Every key going in gets "<ns>~" in front
+// and every key coming back out of an iterator has it removed, so the rest of the chaincode never knows it is there.
+// Keys from other namespaces are simply out of range.
+// ============================================================================================================================
+type namespace_stub struct {
+	shim.ChaincodeStubInterface
+	prefix string
+}
+
+// chaincode wide keys that stay shared no matter the namespace, the UI reads these to find the chaincode
+var global_keys = map[string]bool{"selftest": true, "marbles_ui": true, config_key: true}
+
+func new_namespace_stub(stub shim.ChaincodeStubInterface, namespace string) *namespace_stub {
+	return &namespace_stub{ChaincodeStubInterface: stub, prefix: namespace + "~"}
+}
+
+func (s *namespace_stub) key(key string) string {
+	if global_keys[key] {
+		return key
+	}
+	return s.prefix + key
+}
+
+func (s *namespace_stub) GetState(key string) ([]byte, error) {
+	return s.ChaincodeStubInterface.GetState(s.key(key))
+}
+
+func (s *namespace_stub) PutState(key string, value []byte) error {
+	return s.ChaincodeStubInterface.PutState(s.key(key), value)
+}
+
+func (s *namespace_stub) DelState(key string) error {
+	return s.ChaincodeStubInterface.DelState(s.key(key))
+}
+
+func (s *namespace_stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return s.ChaincodeStubInterface.GetHistoryForKey(s.key(key))
+}
+
+func (s *namespace_stub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	iter, err := s.ChaincodeStubInterface.GetStateByRange(s.key(startKey), s.key(endKey))
+	if err != nil {
+		return nil, err
+	}
+	return &namespace_iterator{inner: iter, prefix: s.prefix}, nil
+}
+
+// composite keys are stored like any other key (with the prefix), so a partial composite key query becomes a range query
+func (s *namespace_stub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	partialKey, err := s.ChaincodeStubInterface.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := s.ChaincodeStubInterface.GetStateByRange(s.key(partialKey), s.key(partialKey) + string(max_unicode_rune))
+	if err != nil {
+		return nil, err
+	}
+	return &namespace_iterator{inner: iter, prefix: s.prefix}, nil
+}
+
+// rich queries know nothing about our prefix, so results from other namespaces are skipped
+func (s *namespace_stub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	iter, err := s.ChaincodeStubInterface.GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+	return &namespace_iterator{inner: iter, prefix: s.prefix}, nil
+}
+
+const max_unicode_rune = '\U0010FFFF'
+
+// ============================================================================================================================
+// Namespace Iterator - strips the prefix from keys and skips anything outside the namespace
+// ============================================================================================================================
+type namespace_iterator struct {
+	inner   shim.StateQueryIteratorInterface
+	prefix  string
+	ready   bool                 //true when key/value/err hold the next result
+	key     string
+	value   []byte
+	err     error
+}
+
+func (it *namespace_iterator) HasNext() bool {
+	for !it.ready && it.inner.HasNext() {
+		key, value, err := it.inner.Next()
+		if err != nil {
+			it.key, it.value, it.err, it.ready = "", nil, err, true
+		} else if strings.HasPrefix(key, it.prefix) {
+			it.key, it.value, it.err, it.ready = strings.TrimPrefix(key, it.prefix), value, nil, true
+		}
+	}
+	return it.ready
+}
+
+func (it *namespace_iterator) Next() (string, []byte, error) {
+	if !it.HasNext() {
+		return "", nil, errors.New("No more results in namespace " + strings.TrimSuffix(it.prefix, "~"))
+	}
+	it.ready = false
+	return it.key, it.value, it.err
+}
+
+func (it *namespace_iterator) Close() error {
+	return it.inner.Close()
+}
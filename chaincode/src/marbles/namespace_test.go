@@ -0,0 +1,67 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// ============================================================================================================================
+// namespace_stub - what is written under one namespace can't be seen from another
+// ============================================================================================================================
+func TestNamespaces(t *testing.T) {
+	stub := new_test_stub(t, `{"namespace": "a", "admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	must_ok(t, stub.invoke("init_owner", "o0000000000001", "amy", "Alpha"))                //through Invoke(), that's where the namespace is
+	must_ok(t, stub.invoke("init_marble", "m0000000000001", "red", "10", "o0000000000001", "Alpha"))
+	if value, _ := stub.GetState("a~m0000000000001"); value == nil {
+		t.Fatal("expected the marble to be stored under the namespace")
+	}
+	if value, _ := stub.GetState("m0000000000001"); value != nil {
+		t.Fatal("expected nothing stored outside the namespace")
+	}
+
+	// switch to another namespace
+	must_ok(t, stub.invoke("init", "314", `{"namespace": "b", "admins": ["AdminMSP"]}`))
+	must_fail(t, stub.invoke("read", "m0000000000001", "id"), "Marble does not exist")
+	var marbles []interface{}
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9")), &marbles)
+	if len(marbles) != 0 {
+		t.Fatalf("expected no marbles in namespace b, got %+v", marbles)
+	}
+	var inventory map[string]int
+	must_fail(t, stub.invoke("get_owner_color_inventory", "o0000000000001"), "Owner does not exist")
+
+	// the same ids are free to use here
+	must_ok(t, stub.invoke("init_owner", "o0000000000001", "bob", "Beta"))
+	must_ok(t, stub.invoke("init_marble", "m0000000000001", "blue", "20", "o0000000000001", "Beta"))
+	must_decode(t, must_ok(t, stub.invoke("get_owner_color_inventory", "o0000000000001")), &inventory)
+	if len(inventory) != 1 || inventory["blue"] != 1 {
+		t.Fatalf("expected namespace b's blue marble, got %+v", inventory)
+	}
+
+	// and back, a's records are untouched
+	must_ok(t, stub.invoke("init", "314", `{"namespace": "a", "admins": ["AdminMSP"]}`))
+	inventory = nil
+	must_decode(t, must_ok(t, stub.invoke("get_owner_color_inventory", "o0000000000001")), &inventory)
+	if len(inventory) != 1 || inventory["red"] != 1 {
+		t.Fatalf("expected namespace a's red marble, got %+v", inventory)
+	}
+}
@@ -21,22 +21,46 @@ package main
 
 import (
 	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+const max_tx_count = 1000                                         //most history entries get_marble_tx_count will walk
+const max_top_owners = 100                                        //most owners get_top_owners will return
+const max_recommendations = 50                                    //most marbles get_recommended_marbles will return
+const max_percentile_marbles = 10000                              //most marbles get_marbles_by_percentile will rank
+const max_distinct_scan = 10000                                   //most marbles get_distinct_values will scan for unindexed fields
+
+// hash algorithms get_state_snapshot_hash can use, add more here
+var snapshot_hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 // ============================================================================================================================
 // Read - read a generic variable from ledger
 //
 // Shows Off GetState() - reading a key/value from the ledger
 //
+// An expired marble reads like the range queries treat it, as an error unless expired marbles are asked for.
+//
 // Inputs - Array of strings
-//  0
-//  key
-//  "abc"
+//  0  ,      1                                      ,          2
+//  key, fields (optional, the key must be a marble), include expired (optional, default false)
+//  "abc", "id,owner"                                , "true"
 // 
 // Returns - string
 // ============================================================================================================================
@@ -45,23 +69,59 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting read")
 
-	if len(args) != 1 {
+	if len(args) < 1 || len(args) > 3 {
 		return shim.Error("Incorrect number of arguments. Expecting key of the var to query")
 	}
 
 	// input sanitation
-	err = sanitize_arguments(args)
+	err = sanitize_arguments(args[:1])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	key = args[0]
+	includeExpired, err := include_expired_flag(args, 2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// just some fields of a marble
+	if len(args) >= 2 && len(args[1]) > 0 {
+		fields, err := parse_fields(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := get_marble(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if marble.ObjectType != "marble" {                    //owners and sets have ids too
+			return shim.Error("Only marbles can be read with fields - " + key + " is not a marble")
+		}
+		if !includeExpired && is_expired(marble, txTime) {
+			return shim.Error("Marble " + marble.Id + " has expired")
+		}
+		projectedAsBytes, _ := json.Marshal(project_marble(marble, fields))
+		fmt.Println("- end read")
+		return shim.Success(projectedAsBytes)
+	}
+
 	valAsbytes, err := stub.GetState(key)           //get the var from ledger
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
 		return shim.Error(jsonResp)
 	}
 
+	// hide it if it's an expired marble
+	var marble Marble
+	if !includeExpired && json.Unmarshal(valAsbytes, &marble) == nil && marble.ObjectType == "marble" && is_expired(marble, txTime) {
+		return shim.Error("Marble " + marble.Id + " has expired")
+	}
+
 	fmt.Println("- end read")
 	return shim.Success(valAsbytes)                  //send it onward
 }
@@ -69,7 +129,10 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 // Get everything we need (owners + marbles + companies)
 //
-// Inputs - none
+// Inputs - Array of strings
+//         0
+//  include expired (optional, default false)
+//       "true"
 //
 // Returns:
 // {
@@ -90,13 +153,22 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 //	}]
 // }
 // ============================================================================================================================
-func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
+func read_everything(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type Everything struct {
 		Owners   []Owner   `json:"owners"`
 		Marbles  []Marble  `json:"marbles"`
 	}
 	var everything Everything
 
+	includeExpired, err := include_expired_flag(args, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ---- Get All Marbles ---- //
 	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
 	if err != nil {
@@ -113,6 +185,9 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		fmt.Println("on marble id - ", queryKeyAsStr)
 		var marble Marble
 		json.Unmarshal(queryValAsBytes, &marble)                  //un stringify it aka JSON.parse()
+		if marble.Quarantine != nil || (!includeExpired && is_expired(marble, txTime)) {  //always hide quarantined, expired unless asked for
+			continue
+		}
 		everything.Marbles = append(everything.Marbles, marble)   //add this marble to the list
 	}
 	fmt.Println("marble array - ", everything.Marbles)
@@ -199,23 +274,129 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	return shim.Success(historyAsBytes)
 }
 
+// ============================================================================================================================
+// Get history of asset, a page at a time - NDJSON so a long history never has to be held as one big array
+//
+// GetHistoryForKey() can't be bookmarked, so a continuation re-scans from the start and skips the entries already sent.
+// Skipping still costs, so skip + max entries can't go past max_tx_count.
+//
+// Inputs - Array of strings
+//           0          ,      1     ,          2
+//           id         , max entries, skip (optional, default 0)
+//  "m01490985296352SjAyM", "50"      , "100"
+//
+// Returns - one line per entry, then a line saying if there is more and what to skip next time:
+//  {"txId":"abc...","value":{"docType":"marble",...}}
+//  {"txId":"def...","value":null}
+//  {"more":true,"skip":150}
+// ============================================================================================================================
+func getHistoryForMarblePaged(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type HistoryEntry struct {
+		TxId  string          `json:"txId"`
+		Value json.RawMessage `json:"value"`                           //null once the marble was deleted
+	}
+	type Continuation struct {
+		More bool `json:"more"`
+		Skip int  `json:"skip"`                                        //pass this back as skip for the next page
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marbleId := args[0]
+	maxEntries, err := strconv.Atoi(args[1])
+	if err != nil || maxEntries <= 0 || maxEntries > max_page_size {
+		return shim.Error("Max entries must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+	skip := 0
+	if len(args) == 3 {
+		skip, err = strconv.Atoi(args[2])
+		if err != nil || skip < 0 {
+			return shim.Error("Skip must be a number >= 0")
+		}
+	}
+	if skip+maxEntries > max_tx_count {
+		return shim.Error("Skip plus max entries must be <= " + strconv.Itoa(max_tx_count))
+	}
+	fmt.Printf("- start getHistoryForMarblePaged: %s\n", marbleId)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	continuation := Continuation{Skip: skip}
+	for position := 0; resultsIterator.HasNext(); position++ {
+		if position == skip+maxEntries {                            //page is full, there is at least one more
+			continuation.More = true
+			break
+		}
+		txID, historicValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if position < skip {                                        //sent on an earlier page
+			continue
+		}
+
+		entry := HistoryEntry{TxId: txID, Value: json.RawMessage("null")}
+		if historicValue != nil {
+			entry.Value = json.RawMessage(historicValue)            //already JSON, write as-is
+		}
+		entryAsBytes, _ := json.Marshal(entry)
+		buffer.Write(entryAsBytes)
+		buffer.WriteString("\n")
+		continuation.Skip++
+	}
+
+	continuationAsBytes, _ := json.Marshal(continuation)
+	buffer.Write(continuationAsBytes)
+	buffer.WriteString("\n")
+	return ndjson_response(buffer.Bytes())
+}
+
 // ============================================================================================================================
 // Get history of asset - performs a range query based on the start and end keys provided.
 //
 // Shows Off GetStateByRange() - reading a multiple key/values from the ledger
 //
 // Inputs - Array of strings
-//       0     ,    1
-//   startKey  ,  endKey
-//  "marbles1" , "marbles5"
+//       0     ,    1    ,         2                                  ,     3
+//   startKey  ,  endKey , include expired (optional, default false)  , format (optional, "json" or "ndjson")
+//  "marbles1" , "marbles5", "true"                                   , "ndjson"
 // ============================================================================================================================
 func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
 	}
 
 	startKey := args[0]
 	endKey := args[1]
+	includeExpired, err := include_expired_flag(args, 2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	format := ""
+	if len(args) == 4 {
+		format = args[3]
+	}
+	writer, err := new_result_writer(format)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
@@ -223,34 +404,2678 @@ func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
 	for resultsIterator.HasNext() {
 		queryResultKey, queryResultValue, err := resultsIterator.Next()
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		var marble Marble
+		json.Unmarshal(queryResultValue, &marble)                 //un stringify it aka JSON.parse()
+		if marble.Quarantine != nil || (!includeExpired && is_expired(marble, txTime)) {  //always hide quarantined, expired unless asked for
+			continue
+		}
+		writer.write(queryResultKey, queryResultValue)
+	}
+
+	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", string(writer.bytes()))
+
+	return writer.response()
+}
+
+
+// ============================================================================================================================
+// Get Comments - read a marble's comment thread, oldest first
+//
+// Shows off GetStateByPartialCompositeKey() - composite keys come back in key order, and the seq part keeps it chronological
+//
+// Inputs - Array of strings
+//  0
+//  id
+//  "m01490985296352SjAyM"
+// ============================================================================================================================
+func get_comments(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var comments []Comment
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("comment~marble~seq", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var comment Comment
+		json.Unmarshal(queryValAsBytes, &comment)                //un stringify it aka JSON.parse()
+		comments = append(comments, comment)                     //add this comment to the list
+	}
+
+	//change to array of bytes
+	commentsAsBytes, _ := json.Marshal(comments)                 //convert to array of bytes
+	return shim.Success(commentsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Color Stats - count, average size and min/max size of marbles, per color
+//
+// Streams every marble once and only keeps one small accumulator per color, so memory does not grow with the ledger
+//
+// Inputs - none
+//
+// Returns:
+// {
+//	"blue": {
+//		"count": 2,
+//		"avgSize": 25,
+//		"minSize": 16,
+//		"maxSize": 35
+//	}
+// }
+// ============================================================================================================================
+func get_color_stats(stub shim.ChaincodeStubInterface) pb.Response {
+	type ColorStats struct {
+		Count    int      `json:"count"`
+		AvgSize  float64  `json:"avgSize"`
+		MinSize  int      `json:"minSize"`
+		MaxSize  int      `json:"maxSize"`
+		total    int
+	}
+	stats := map[string]*ColorStats{}                              //start empty so an empty ledger returns {}
+	fmt.Println("starting get_color_stats")
+
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+
+		stat, ok := stats[marble.Color]
+		if !ok {                                                   //first marble of this color
+			stat = &ColorStats{MinSize: marble.Size, MaxSize: marble.Size}
+			stats[marble.Color] = stat
+		}
+		stat.Count++
+		stat.total += marble.Size
+		if marble.Size < stat.MinSize {
+			stat.MinSize = marble.Size
+		}
+		if marble.Size > stat.MaxSize {
+			stat.MaxSize = marble.Size
+		}
+	}
+
+	for _, stat := range stats {
+		stat.AvgSize = float64(stat.total) / float64(stat.Count)
+	}
+
+	//change to array of bytes
+	statsAsBytes, _ := json.Marshal(stats)                         //convert to array of bytes
+	fmt.Println("- end get_color_stats")
+	return shim.Success(statsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Caller Org - who is invoking us, so the UI can show "acting as Org1"
+//
+// Shows off GetCreator() - the creator is the serialized identity (MSP id + cert) that signed the proposal
+//
+// Inputs - none
+//
+// Returns:
+// {
+//	"mspId": "Org1MSP",
+//	"commonName": "user1"
+// }
+// ============================================================================================================================
+func get_caller_org(stub shim.ChaincodeStubInterface) pb.Response {
+	type CallerOrg struct {
+		MspId      string `json:"mspId"`
+		CommonName string `json:"commonName"`
+	}
+	fmt.Println("starting get_caller_org")
+
+	mspId, cert, err := get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	callerAsBytes, _ := json.Marshal(CallerOrg{MspId: mspId, CommonName: cert.Subject.CommonName})
+	fmt.Println("- end get_caller_org")
+	return shim.Success(callerAsBytes)
+}
+
+// ============================================================================================================================
+// Get Owner Color Inventory - how many marbles of each color an owner holds
+//
+// Shows off the "owner~id" index - only this owner's marbles are visited, not the whole ledger
+//
+// Inputs - Array of strings
+//         0
+//      owner id
+//  "o99999999999"
+//
+// Returns:
+// {
+//	"blue": 2,
+//	"red": 1
+// }
+// ============================================================================================================================
+func get_owner_color_inventory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	inventory := map[string]int{}                                  //start empty so an owner with no marbles returns {}
+	fmt.Println("starting get_owner_color_inventory")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner_id := args[0]
+	_, err = get_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("owner~id", []string{owner_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)       //parts are [owner id, marble id]
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {
+			continue
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResultKey)
-		buffer.WriteString("\"")
+		inventory[marble.Color]++
+	}
+
+	//change to array of bytes
+	inventoryAsBytes, _ := json.Marshal(inventory)                 //convert to array of bytes
+	fmt.Println("- end get_owner_color_inventory")
+	return shim.Success(inventoryAsBytes)
+}
+
+// ============================================================================================================================
+// Describe API - machine readable list of every function we dispatch, for generating client stubs
+//
+// Inputs - none
+//
+// Returns:
+// [{
+//	"function": "set_owner",
+//	"args": [{"name": "marble id", "type": "string"}, ...],
+//	"description": "change owner of a marble"
+// }]
+// ============================================================================================================================
+func describe_api(stub shim.ChaincodeStubInterface) pb.Response {
+	apiAsBytes, _ := json.Marshal(api)                             //convert to array of bytes
+	return shim.Success(apiAsBytes)
+}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResultValue))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+// ============================================================================================================================
+// Get Marble Tx Count - how many transactions have modified a marble, a cheap measure of how much it gets traded
+//
+// History iteration is expensive so we stop counting at max_tx_count and say so with "capped"
+//
+// Inputs - Array of strings
+//  0
+//  id
+//  "m01490985296352SjAyM"
+//
+// Returns:
+// {
+//	"count": 3,
+//	"capped": false
+// }
+// ============================================================================================================================
+func get_marble_tx_count(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type TxCount struct {
+		Count   int   `json:"count"`
+		Capped  bool  `json:"capped"`
 	}
-	buffer.WriteString("]")
+	var txCount TxCount
 
-	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", buffer.String())
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
 
-	return shim.Success(buffer.Bytes())
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetHistoryForKey(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		if txCount.Count == max_tx_count {                         //stop walking, there is at least one more
+			txCount.Capped = true
+			break
+		}
+		_, _, err := resultsIterator.Next()                        //the delete shows up as a nil value, it still counts
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		txCount.Count++
+	}
+
+	//change to array of bytes
+	txCountAsBytes, _ := json.Marshal(txCount)                     //convert to array of bytes
+	return shim.Success(txCountAsBytes)
+}
+
+// ============================================================================================================================
+// Read Marbles By Filter - every marble matching a color, owner and/or size range
+//
+// Works on LevelDB, no rich queries needed. The scan starts from the most selective index the filter allows:
+//  1. ownerId set - walk "owner~id" for that owner, an owner holds far fewer marbles than share a color
+//  2. color set   - walk "color~id" for that color
+//  3. neither     - walk every marble
+// whatever the index didn't cover is then checked in memory. Expired marbles are left out.
+//
+// Inputs - Array of strings
+//                                    0                                                  ,          1
+//                               filter JSON, all fields optional                        , fields (optional)
+//  "{\"color\": \"blue\", \"ownerId\": \"o99999999999\", \"minSize\": 10, \"maxSize\": 40}", "id,owner"
+//
+// Returns - array of marbles, or of just the fields asked for
+// ============================================================================================================================
+func read_marbles_by_filter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Filter struct {
+		Color    string `json:"color"`
+		OwnerId  string `json:"ownerId"`
+		MinSize  *int   `json:"minSize"`
+		MaxSize  *int   `json:"maxSize"`
+	}
+	var filter Filter
+	marbles := []Marble{}
+	fmt.Println("starting read_marbles_by_filter")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		return shim.Error("Filter must be a JSON object - " + err.Error())
+	}
+	var fields []string
+	if len(args) == 2 {
+		fields, err = parse_fields(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	filter.Color = normalize_color(filter.Color)                 //match how colors are stored
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// pick where to start
+	var resultsIterator shim.StateQueryIteratorInterface
+	fromIndex := true
+	if len(filter.OwnerId) > 0 {
+		resultsIterator, err = stub.GetStateByPartialCompositeKey("owner~id", []string{filter.OwnerId})
+	} else if len(filter.Color) > 0 {
+		resultsIterator, err = stub.GetStateByPartialCompositeKey("color~id", []string{filter.Color})
+	} else {
+		resultsIterator, err = stub.GetStateByRange("m0", "m9999999999999999999")
+		fromIndex = false
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryKeyAsStr, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		if fromIndex {                                              //index entries only hold the id, go get the marble
+			_, keyParts, err := stub.SplitCompositeKey(queryKeyAsStr)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			marble, err = get_marble(stub, keyParts[1])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		} else {
+			json.Unmarshal(queryValAsBytes, &marble)                //un stringify it aka JSON.parse()
+		}
+
+		// check the rest of the filter
+		if len(filter.OwnerId) > 0 && marble.Owner.Id != filter.OwnerId {
+			continue
+		}
+		if len(filter.Color) > 0 && marble.Color != filter.Color {
+			continue
+		}
+		if filter.MinSize != nil && marble.Size < *filter.MinSize {
+			continue
+		}
+		if filter.MaxSize != nil && marble.Size > *filter.MaxSize {
+			continue
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	fmt.Println("- end read_marbles_by_filter")
+	return shim.Success(marbles_response(marbles, fields))
+}
+
+// ============================================================================================================================
+// Read Marble Expanded - a marble with its full owner record inlined, saves the UI a second lookup
+//
+// If the owner id points at nothing the owner comes back null and "warning" says why
+//
+// Inputs - Array of strings
+//  0
+//  id
+//  "m01490985296352SjAyM"
+//
+// Returns:
+// {
+//	"id": "m01490985296352SjAyM",
+//	"color": "white",
+//	"size": 35,
+//	"owner": {
+//		"docType": "marble_owner",
+//		"id": "o99999999",
+//		"username": "alice",
+//		"company": "United Marbles"
+//	}
+// }
+// ============================================================================================================================
+func read_marble_expanded(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ExpandedMarble struct {
+		Marble
+		Owner    *Owner  `json:"owner"`                          //shadows Marble.Owner in the JSON
+		Warning  string  `json:"warning,omitempty"`
+	}
+	var expanded ExpandedMarble
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	expanded.Marble, err = get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_hidden(expanded.Marble, txTime) {                       //treat like any other query, quarantined and expired marbles stay out of sight
+		return shim.Error("Marble " + args[0] + " is quarantined or expired")
+	}
+
+	owner, err := get_owner(stub, expanded.Marble.Owner.Id)
+	if err != nil {                                                //dangling owner id, still return the marble
+		expanded.Warning = "Owner " + expanded.Marble.Owner.Id + " could not be found - " + err.Error()
+	} else {
+		expanded.Owner = &owner
+	}
+
+	//change to array of bytes
+	expandedAsBytes, _ := json.Marshal(expanded)                   //convert to array of bytes
+	return shim.Success(expandedAsBytes)
+}
+
+// ============================================================================================================================
+// Get Marbles Changed Between - marbles whose lastModified falls inside a time window, for reconciliation
+//
+// Shows off GetQueryResult() - on CouchDB a range selector on lastModified does the work. LevelDB can't run rich queries,
+// so when the query is refused we fall back to scanning every marble. lastModified is written with a fixed width format
+// (see time_format) which is what makes the string compare in CouchDB correct.
+// Marbles written before lastModified existed won't show up.
+//
+// Inputs - Array of strings
+//             0          ,           1
+//     start (RFC3339)    ,     end (RFC3339)
+//  "2017-04-01T00:00:00Z", "2017-04-02T00:00:00Z"
+//
+// Returns - array of marbles
+// ============================================================================================================================
+func getMarblesChangedBetween(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	marbles := []Marble{}
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	start, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return shim.Error("1st argument must be an RFC3339 timestamp")
+	}
+	end, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be an RFC3339 timestamp")
+	}
+	if end.Before(start) {
+		return shim.Error("Start must not be after end")
+	}
+	fmt.Printf("- start getMarblesChangedBetween: %s - %s\n", args[0], args[1])
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// try CouchDB first
+	queryString := fmt.Sprintf(`{"selector":{"docType":"marble","lastModified":{"$gte":"%s","$lte":"%s"}}}`,
+		start.UTC().Format(time_format), end.UTC().Format(time_format))
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {                                                //LevelDB, scan and filter instead
+		fmt.Println("rich query not available, scanning - " + err.Error())
+		resultsIterator, err = stub.GetStateByRange("m0", "m9999999999999999999")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		lastModified, err := time.Parse(time.RFC3339, marble.LastModified)
+		if err != nil {                                            //no lastModified, can't place it
+			continue
+		}
+		if lastModified.Before(start) || lastModified.After(end) {
+			continue
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	//change to array of bytes
+	marblesAsBytes, _ := json.Marshal(marbles)                     //convert to array of bytes
+	return shim.Success(marblesAsBytes)
+}
+
+// ============================================================================================================================
+// Get Set - read a set and every marble in it
+//
+// Inputs - Array of strings
+//  0
+//  set id
+//  "s999999999"
+//
+// Returns:
+// {
+//	"set": {"id": "s999999999", "name": "blue moon", ...},
+//	"marbles": [{"id": "m999999999", "color": "blue", ...}],
+//	"sets": ["s888888888"]
+// }
+// ============================================================================================================================
+func get_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type SetContents struct {
+		Set      MarbleSet `json:"set"`
+		Marbles  []Marble  `json:"marbles"`
+		Sets     []string  `json:"sets"`                          //ids of the sets nested directly in this one
+	}
+	var contents SetContents
+	contents.Marbles = []Marble{}
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	contents.Set, err = get_marble_set(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("set~setid~marble", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)       //parts are [set id, marble id]
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		contents.Marbles = append(contents.Marbles, marble)
+	}
+
+	contents.Sets, err = index_ids(stub, "subset~parent~child", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//change to array of bytes
+	contentsAsBytes, _ := json.Marshal(contents)                   //convert to array of bytes
+	return shim.Success(contentsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Set Marbles For Owner - the marbles of a set that one owner holds, "my pieces of this collection"
+//
+// Intersects the set's membership with the owner's owner~id entries, only the marbles in both are read.
+//
+// Inputs - Array of Strings
+//       0     ,       1
+//    set id   ,    owner id
+// "s999999999", "o99999999999"
+// ============================================================================================================================
+func get_set_marbles_for_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	marbles := []Marble{}                                          //start empty so no matches returns []
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = get_marble_set(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = get_owner(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owned, err := index_ids(stub, "owner~id", []string{args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	isOwned := map[string]bool{}
+	for _, id := range owned {
+		isOwned[id] = true
+	}
+
+	members, err := index_ids(stub, "set~setid~marble", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range members {
+		if !isOwned[id] {
+			continue
+		}
+		marble, err := get_marble(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	//change to array of bytes
+	marblesAsBytes, _ := json.Marshal(marbles)                     //convert to array of bytes
+	return shim.Success(marblesAsBytes)
+}
+
+// ============================================================================================================================
+// Check Index Consistency - compare a marble index with the marbles it points at, and optionally fix it
+//
+// Two kinds of divergence are reported:
+//  missing  - a marble with no index entry, found by walking the marbles
+//  orphaned - an index entry for a marble that is gone or no longer matches it, found by walking the index
+// Both walks are paged. The bookmark says where to carry on, "marbles:<last key>" or "index:<entries done>",
+// and comes back empty when both walks are done. Repairing is a write and needs an admin. The color counts are kept from
+// color~id, so a page that repairs color~id recounts them too, see recount_colors().
+//
+// Inputs - Array of strings
+//       0     ,          1         ,     2     ,     3
+//  index name ,  "check"/"repair"  , bookmark  , page size
+//  "owner~id" ,      "repair"      ,    ""     ,   "100"
+//
+// Returns:
+// {
+//	"index": "owner~id",
+//	"missing": ["m999999999"],
+//	"orphaned": ["owner~id o99999999 m888888888"],
+//	"repaired": 2,
+//	"bookmark": "index:0"
+// }
+// ============================================================================================================================
+func check_index_consistency(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ConsistencyReport struct {
+		Index     string   `json:"index"`
+		Missing   []string `json:"missing"`
+		Orphaned  []string `json:"orphaned"`
+		Repaired  int      `json:"repaired"`
+		Bookmark  string   `json:"bookmark"`
+	}
+	report := ConsistencyReport{Missing: []string{}, Orphaned: []string{}}
+	colorChanges := map[string]int{}                               //color~id entries this page added or removed, by color
+	fmt.Println("starting check_index_consistency")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	report.Index = args[0]
+	expectedAttributes, ok := marble_indexes[report.Index]
+	if !ok {
+		return shim.Error("Unknown index - " + report.Index)
+	}
+	if args[1] != "check" && args[1] != "repair" {
+		return shim.Error("2nd argument must be 'check' or 'repair'")
+	}
+	repair := args[1] == "repair"
+	if repair {
+		err := require_admin(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	bookmark := args[2]
+	pageSize, err := strconv.Atoi(args[3])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	if len(bookmark) == 0 || strings.HasPrefix(bookmark, "marbles:") {
+		// ---- walk the marbles looking for missing entries ---- //
+		lastKey := strings.TrimPrefix(bookmark, "marbles:")
+		startKey := "m0"
+		if len(lastKey) > 0 {
+			startKey = lastKey
+		}
+		resultsIterator, err := stub.GetStateByRange(startKey, "m9999999999999999999")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		scanned := 0
+		report.Bookmark = "index:0"                                //unless the page fills up, move on to the index next
+		for resultsIterator.HasNext() {
+			queryKeyAsStr, queryValAsBytes, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if queryKeyAsStr == lastKey {                          //the bookmark was the last one done
+				continue
+			}
+			if scanned == pageSize {
+				report.Bookmark = "marbles:" + lastKey
+				break
+			}
+			scanned++
+			lastKey = queryKeyAsStr
+
+			var marble Marble
+			json.Unmarshal(queryValAsBytes, &marble)               //un stringify it aka JSON.parse()
+			if expectedAttributes(marble) == nil {                 //this marble shouldn't be in this index
+				continue
+			}
+			indexKey, err := stub.CreateCompositeKey(report.Index, expectedAttributes(marble))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			entry, err := stub.GetState(indexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if entry != nil {
+				continue
+			}
+			report.Missing = append(report.Missing, marble.Id)
+			if repair {
+				err = put_index(stub, report.Index, expectedAttributes(marble))
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				colorChanges[expectedAttributes(marble)[0]]++
+				report.Repaired++
+			}
+		}
+	} else if strings.HasPrefix(bookmark, "index:") {
+		// ---- walk the index looking for orphaned entries ---- //
+		done, err := strconv.Atoi(strings.TrimPrefix(bookmark, "index:"))
+		if err != nil || done < 0 {
+			return shim.Error("Bad bookmark - " + bookmark)
+		}
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(report.Index, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		skipped := 0
+		scanned := 0
+		report.Bookmark = ""                                       //unless the page fills up, we're done
+		for resultsIterator.HasNext() {
+			indexKey, _, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if skipped < done {                                    //composite key queries can't start mid way, skip what's done
+				skipped++
+				continue
+			}
+			if scanned == pageSize {
+				report.Bookmark = "index:" + strconv.Itoa(done + scanned - report.Repaired)  //repaired entries will be gone
+				break
+			}
+			scanned++
+
+			_, keyParts, err := stub.SplitCompositeKey(indexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			marble, err := get_marble(stub, keyParts[len(keyParts) - 1])  //marble id is always the last part
+			if err == nil && expectedAttributes(marble) != nil && strings.Join(keyParts, "\x00") == strings.Join(expectedAttributes(marble), "\x00") {
+				continue                                           //entry matches its marble
+			}
+			report.Orphaned = append(report.Orphaned, report.Index + " " + strings.Join(keyParts, " "))
+			if repair {
+				err = stub.DelState(indexKey)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				colorChanges[keyParts[0]]--
+				report.Repaired++
+			}
+		}
+	} else {
+		return shim.Error("Bad bookmark - " + bookmark)
+	}
+
+	// the color counts follow color~id
+	if report.Index == "color~id" && report.Repaired > 0 {
+		_, err = recount_colors(stub, colorChanges)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	//change to array of bytes
+	reportAsBytes, _ := json.Marshal(report)                       //convert to array of bytes
+	fmt.Println("- end check_index_consistency")
+	return shim.Success(reportAsBytes)
+}
+
+// ============================================================================================================================
+// Find Incomplete Marbles - list marbles missing any of the given fields, for targeting backfills after a migration
+//
+// Field names are the JSON names ("expiresAt", "lastModified"), use a dot for nested ones ("owner.company"). A field
+// counts as missing if it is absent, null or an empty string. Marbles are checked as stored, not as the Marble struct
+// reads them, so a zero value that made it to the ledger is not reported.
+//
+// Inputs - Array of Strings
+//       0       ,      1        ,  ...
+//  field name   , field name    ,  ...
+// "lastModified", "owner.company"
+//
+// Returns:
+// [{
+//	"id": "m999999999",
+//	"missing": ["owner.company"]
+// }]
+// ============================================================================================================================
+func find_incomplete_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type IncompleteMarble struct {
+		Id      string   `json:"id"`
+		Missing []string `json:"missing"`
+	}
+	results := []IncompleteMarble{}                                //start empty so nothing missing returns []
+	fmt.Println("starting find_incomplete_marbles")
+
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or more field names")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var doc map[string]interface{}
+		err = json.Unmarshal(queryValAsBytes, &doc)                //un stringify it aka JSON.parse()
+		if err != nil {
+			return shim.Error("Marble " + key + " is not valid JSON - " + err.Error())
+		}
+
+		var missing []string
+		for _, field := range args {
+			if !has_field(doc, field) {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			results = append(results, IncompleteMarble{Id: key, Missing: missing})
+		}
+	}
+
+	//change to array of bytes
+	resultsAsBytes, _ := json.Marshal(results)                     //convert to array of bytes
+	fmt.Println("- end find_incomplete_marbles")
+	return shim.Success(resultsAsBytes)
+}
+
+// ============================================================================================================================
+// Has Field - true if the dotted field path is present in the doc and is not null or ""
+// ============================================================================================================================
+func has_field(doc map[string]interface{}, path string) bool {
+	parts := strings.Split(path, ".")
+	var value interface{} = doc
+	for _, part := range parts {
+		obj, ok := value.(map[string]interface{})
+		if !ok {                                                   //can't walk into a non object
+			return false
+		}
+		value, ok = obj[part]
+		if !ok || value == nil {
+			return false
+		}
+	}
+	if str, ok := value.(string); ok && str == "" {
+		return false
+	}
+	return true
+}
+
+// ============================================================================================================================
+// Get Ledger Stats - one health summary of the ledger for dashboards and monitoring
+//
+// This walks every marble, owner and marble index entry, which gets expensive on a big ledger. Pass a scan cap to stop
+// each walk after that many records; any stat from a walk that hit the cap is a lower bound and "capped" is true.
+// Orphaned marbles are marbles whose owner record does not exist.
+//
+// Inputs - Array of Strings
+//       0
+//  scan cap (optional, 0 or missing means no cap)
+//   "1000"
+//
+// Returns:
+// {
+//	"marbles": 120,
+//	"owners": 10,
+//	"orphanedMarbles": 1,
+//	"disabledOwners": 2,
+//	"indexEntries": {"color~id": 120, "owner~id": 119},
+//	"capped": false
+// }
+// ============================================================================================================================
+func get_ledger_stats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type LedgerStats struct {
+		Marbles         int            `json:"marbles"`
+		Owners          int            `json:"owners"`
+		OrphanedMarbles int            `json:"orphanedMarbles"`
+		DisabledOwners  int            `json:"disabledOwners"`
+		IndexEntries    map[string]int `json:"indexEntries"`
+		Capped          bool           `json:"capped"`
+	}
+	stats := LedgerStats{IndexEntries: map[string]int{}}
+	scanCap := 0
+	fmt.Println("starting get_ledger_stats")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 1 {
+		var err error
+		scanCap, err = strconv.Atoi(args[0])
+		if err != nil || scanCap < 0 {
+			return shim.Error("Scan cap must be a number, 0 or more")
+		}
+	}
+	hitCap := func(count int) bool {                               //true if this walk has to stop here
+		if scanCap > 0 && count >= scanCap {
+			stats.Capped = true
+			return true
+		}
+		return false
+	}
+
+	// ---- Owners ---- //
+	owners := map[string]bool{}
+	ownersIterator, err := stub.GetStateByRange("o0", "o9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer ownersIterator.Close()
+
+	for ownersIterator.HasNext() && !hitCap(stats.Owners) {
+		_, queryValAsBytes, err := ownersIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var owner Owner
+		json.Unmarshal(queryValAsBytes, &owner)                    //un stringify it aka JSON.parse()
+		owners[owner.Id] = true
+		stats.Owners++
+		if !owner.is_enabled() {
+			stats.DisabledOwners++
+		}
+	}
+	ownersComplete := !stats.Capped                                //if the owner walk stopped early, look owners up
+	lookups := new_owner_cache(stub)
+
+	// ---- Marbles ---- //
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() && !hitCap(stats.Marbles) {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		stats.Marbles++
+		if owners[marble.Owner.Id] {
+			continue
+		}
+		if ownersComplete {
+			stats.OrphanedMarbles++
+		} else if _, err := lookups.get(marble.Owner.Id); err != nil {
+			stats.OrphanedMarbles++
+		}
+	}
+
+	// ---- Indexes ---- //
+	for index := range marble_indexes {
+		indexIterator, err := stub.GetStateByPartialCompositeKey(index, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		count := 0
+		for indexIterator.HasNext() && !hitCap(count) {
+			_, _, err := indexIterator.Next()
+			if err != nil {
+				indexIterator.Close()
+				return shim.Error(err.Error())
+			}
+			count++
+		}
+		indexIterator.Close()
+		stats.IndexEntries[index] = count
+	}
+
+	//change to array of bytes
+	statsAsBytes, _ := json.Marshal(stats)                         //convert to array of bytes
+	fmt.Println("- end get_ledger_stats")
+	return shim.Success(statsAsBytes)
+}
+
+// ============================================================================================================================
+// Query Marbles By Secondary Color - read the unexpired marbles with a secondary color, using the secondary~id index
+//
+// Inputs - Array of Strings
+//        0       ,      1
+//  secondary color, fields (optional)
+//    "white"     , "id,owner"
+// ============================================================================================================================
+func queryMarblesBySecondaryColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	marbles := []Marble{}                                          //start empty so no matches returns []
+	fmt.Println("starting queryMarblesBySecondaryColor")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args[:1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	color := normalize_color(args[0])                              //match how colors are stored
+	var fields []string
+	if len(args) == 2 {
+		fields, err = parse_fields(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("secondary~id", []string{color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	fmt.Println("- end queryMarblesBySecondaryColor")
+	return shim.Success(marbles_response(marbles, fields))
+}
+
+// ============================================================================================================================
+// Get Top Owners - the K owners with the most marbles, for leaderboards
+//
+// One pass over the owner~id index, which is sorted by owner so each owner's entries come together. Only the best K
+// counts so far are kept, in a min heap. Ties go to the lower owner id.
+//
+// Inputs - Array of Strings
+//   0
+//   K
+//  "10"
+//
+// Returns:
+// [{
+//	"ownerId": "o99999999999",
+//	"count": 12
+// }]
+// ============================================================================================================================
+type OwnerCount struct {
+	OwnerId string `json:"ownerId"`
+	Count   int    `json:"count"`
+}
+
+func get_top_owners(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_top_owners")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	k, err := strconv.Atoi(args[0])
+	if err != nil || k <= 0 || k > max_top_owners {
+		return shim.Error("K must be a number from 1 to " + strconv.Itoa(max_top_owners))
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("owner~id", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	top := &owner_count_heap{}
+	offer := func(candidate OwnerCount) {                          //keep candidate if it beats the worst of the top K
+		if top.Len() < k {
+			heap.Push(top, candidate)
+		} else if top.less(top.counts[0], candidate) {
+			top.counts[0] = candidate
+			heap.Fix(top, 0)
+		}
+	}
+
+	current := OwnerCount{}
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if keyParts[0] != current.OwnerId {                        //on to the next owner
+			if current.Count > 0 {
+				offer(current)
+			}
+			current = OwnerCount{OwnerId: keyParts[0]}
+		}
+		current.Count++
+	}
+	if current.Count > 0 {
+		offer(current)
+	}
+
+	// empty the heap worst first, filling from the back
+	owners := make([]OwnerCount, top.Len())
+	for i := len(owners) - 1; i >= 0; i-- {
+		owners[i] = heap.Pop(top).(OwnerCount)
+	}
+
+	//change to array of bytes
+	ownersAsBytes, _ := json.Marshal(owners)                       //convert to array of bytes
+	fmt.Println("- end get_top_owners")
+	return shim.Success(ownersAsBytes)
+}
+
+// ============================================================================================================================
+// Owner Count Heap - min heap of owner counts for get_top_owners(), the root is the worst of the best
+// ============================================================================================================================
+type owner_count_heap struct {
+	counts []OwnerCount
+}
+
+// true if a ranks below b, fewer marbles or the same number and a higher owner id
+func (h *owner_count_heap) less(a, b OwnerCount) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.OwnerId > b.OwnerId
+}
+
+func (h *owner_count_heap) Len() int           { return len(h.counts) }
+func (h *owner_count_heap) Less(i, j int) bool { return h.less(h.counts[i], h.counts[j]) }
+func (h *owner_count_heap) Swap(i, j int)      { h.counts[i], h.counts[j] = h.counts[j], h.counts[i] }
+func (h *owner_count_heap) Push(x interface{}) { h.counts = append(h.counts, x.(OwnerCount)) }
+func (h *owner_count_heap) Pop() interface{} {
+	last := h.counts[len(h.counts) - 1]
+	h.counts = h.counts[:len(h.counts) - 1]
+	return last
+}
+
+// ============================================================================================================================
+// Draw Marble - pick a raffle winner from the unexpired marbles, optionally just one color
+//
+// Every endorser has to pick the same marble, so there is no math/rand here, seeded or otherwise. The seed is the first
+// 8 bytes of sha256(tx id) read as a big endian uint64, and the winner is eligible[seed % count] with the eligible
+// marbles in key order. Anyone can redo the draw from the tx id. Whoever submits the tx picks the tx id, so a draw that
+// matters should be submitted by someone with no stake in it.
+//
+// Inputs - Array of Strings
+//      0
+//    color (optional)
+//    "blue"
+// ============================================================================================================================
+func draw_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var eligible []string
+	fmt.Println("starting draw_marble")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	color := ""
+	if len(args) == 1 {
+		color = normalize_color(args[0])                           //match how colors are stored
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// gather the eligible marble ids, in key order
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if is_hidden(marble, txTime) || (len(color) > 0 && marble.Color != color) {
+			continue
+		}
+		eligible = append(eligible, marble.Id)
+	}
+	if len(eligible) == 0 {
+		return shim.Error("No marbles are eligible for the draw")
+	}
+
+	// pick one from the tx id
+	hash := sha256.Sum256([]byte(stub.GetTxID()))
+	seed := binary.BigEndian.Uint64(hash[:8])
+	winner, err := get_marble(stub, eligible[seed % uint64(len(eligible))])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//change to array of bytes
+	winnerAsBytes, _ := json.Marshal(winner)                       //convert to array of bytes
+	fmt.Println("- end draw_marble")
+	return shim.Success(winnerAsBytes)
+}
+
+// ============================================================================================================================
+// Compare Owner Inventories - which colors and sizes each of two owners has that the other doesn't, and which they share
+//
+// Inputs - Array of Strings
+//         0     ,        1
+//   owner id    ,    owner id
+// "o99999999999", "o88888888888"
+//
+// Returns:
+// {
+//	"first":  {"ownerId": "o99999999999", "colors": ["blue"], "sizes": [16]},
+//	"second": {"ownerId": "o88888888888", "colors": ["red"], "sizes": []},
+//	"shared": {"colors": ["white"], "sizes": [35]}
+// }
+// ============================================================================================================================
+func compare_owner_inventories(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Attributes struct {
+		OwnerId string   `json:"ownerId,omitempty"`
+		Colors  []string `json:"colors"`
+		Sizes   []int    `json:"sizes"`
+	}
+	type Comparison struct {
+		First  Attributes `json:"first"`                             //what only the first owner has
+		Second Attributes `json:"second"`                            //what only the second owner has
+		Shared Attributes `json:"shared"`                            //what they both have
+	}
+	fmt.Println("starting compare_owner_inventories")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var colors [2]map[string]bool
+	var sizes [2]map[int]bool
+	for i, owner_id := range args {
+		_, err = get_owner(stub, owner_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		colors[i], sizes[i], err = get_owner_attributes(stub, owner_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	comparison := Comparison{
+		First:  Attributes{OwnerId: args[0], Colors: []string{}, Sizes: []int{}},
+		Second: Attributes{OwnerId: args[1], Colors: []string{}, Sizes: []int{}},
+		Shared: Attributes{Colors: []string{}, Sizes: []int{}},
+	}
+	for color := range colors[0] {
+		if colors[1][color] {
+			comparison.Shared.Colors = append(comparison.Shared.Colors, color)
+		} else {
+			comparison.First.Colors = append(comparison.First.Colors, color)
+		}
+	}
+	for color := range colors[1] {
+		if !colors[0][color] {
+			comparison.Second.Colors = append(comparison.Second.Colors, color)
+		}
+	}
+	for size := range sizes[0] {
+		if sizes[1][size] {
+			comparison.Shared.Sizes = append(comparison.Shared.Sizes, size)
+		} else {
+			comparison.First.Sizes = append(comparison.First.Sizes, size)
+		}
+	}
+	for size := range sizes[1] {
+		if !sizes[0][size] {
+			comparison.Second.Sizes = append(comparison.Second.Sizes, size)
+		}
+	}
+
+	// map order is random, endorsers have to agree
+	for _, attributes := range []*Attributes{&comparison.First, &comparison.Second, &comparison.Shared} {
+		sort.Strings(attributes.Colors)
+		sort.Ints(attributes.Sizes)
+	}
+
+	//change to array of bytes
+	comparisonAsBytes, _ := json.Marshal(comparison)               //convert to array of bytes
+	fmt.Println("- end compare_owner_inventories")
+	return shim.Success(comparisonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Owner Attributes - the colors and sizes of an owner's marbles, via the owner~id index, hidden marbles left out
+// ============================================================================================================================
+func get_owner_attributes(stub shim.ChaincodeStubInterface, owner_id string) (map[string]bool, map[int]bool, error) {
+	colors := map[string]bool{}
+	sizes := map[int]bool{}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("owner~id", []string{owner_id})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		colors[marble.Color] = true
+		sizes[marble.Size] = true
+	}
+	return colors, sizes, nil
+}
+
+// ============================================================================================================================
+// Get Total Insured Value - sum the insured values of an owner's marbles, or of every owner's
+//
+// Marbles that were never insured count as 0.
+//
+// Inputs - Array of Strings
+//         0
+//   owner id (optional)
+// "o99999999999"
+//
+// Returns:
+// {
+//	"o99999999999": 1500
+// }
+// ============================================================================================================================
+func get_total_insured_value(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	totals := map[string]int64{}                                   //start empty so an empty ledger returns {}
+	fmt.Println("starting get_total_insured_value")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args) == 1 {
+		// ---- one owner, use their index ---- //
+		owner_id := args[0]
+		_, err = get_owner(stub, owner_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		totals[owner_id] = 0
+		resultsIterator, err := stub.GetStateByPartialCompositeKey("owner~id", []string{owner_id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			indexKey, _, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			_, keyParts, err := stub.SplitCompositeKey(indexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			marble, err := get_marble(stub, keyParts[1])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if is_hidden(marble, txTime) {
+				continue
+			}
+			totals[owner_id] += marble.InsuredValue
+		}
+	} else {
+		// ---- everyone, walk every marble ---- //
+		resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			_, queryValAsBytes, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+
+			var marble Marble
+			json.Unmarshal(queryValAsBytes, &marble)               //un stringify it aka JSON.parse()
+			if is_hidden(marble, txTime) {
+				continue
+			}
+			totals[marble.Owner.Id] += marble.InsuredValue
+		}
+	}
+
+	//change to array of bytes
+	totalsAsBytes, _ := json.Marshal(totals)                       //convert to array of bytes
+	fmt.Println("- end get_total_insured_value")
+	return shim.Success(totalsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Marbles By Company - every unexpired marble, grouped by the company of its owner
+//
+// Owner companies come from the company~owner index, written by init_owner(), so there is one index walk instead of an
+// owner lookup per marble. Owners from before the index are looked up once each. Marbles whose owner is gone or has no
+// company are grouped under "unknown".
+//
+// Returns:
+// {
+//	"United Marbles": [{"id": "m999999999", ...}],
+//	"unknown": [{"id": "m888888888", ...}]
+// }
+// ============================================================================================================================
+func get_marbles_by_company(stub shim.ChaincodeStubInterface) pb.Response {
+	groups := map[string][]Marble{}                                //start empty so an empty ledger returns {}
+	fmt.Println("starting get_marbles_by_company")
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ---- owner id -> company ---- //
+	companies := map[string]string{}
+	indexIterator, err := stub.GetStateByPartialCompositeKey("company~owner", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer indexIterator.Close()
+
+	for indexIterator.HasNext() {
+		indexKey, _, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		companies[keyParts[1]] = keyParts[0]
+	}
+
+	// ---- group the marbles ---- //
+	owners := new_owner_cache(stub)                                //for owners from before the index
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if is_hidden(marble, txTime) {
+			continue
+		}
+
+		company, known := companies[marble.Owner.Id]
+		if !known {                                                //not indexed, look it up
+			owner, err := owners.get(marble.Owner.Id)
+			if err == nil {
+				company = owner.Company
+			}
+		}
+		if len(company) == 0 {
+			company = "unknown"
+		}
+		groups[company] = append(groups[company], marble)
+	}
+
+	//change to array of bytes
+	groupsAsBytes, _ := json.Marshal(groups)                       //convert to array of bytes
+	fmt.Println("- end get_marbles_by_company")
+	return shim.Success(groupsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Messages - read an owner's inbox, oldest first
+//
+// Inputs - Array of Strings
+//       0
+//    owner id
+// "o99999999999"
+// ============================================================================================================================
+func get_messages(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	messages := []Message{}                                        //start empty so an empty inbox returns []
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("msg~toowner~seq", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var message Message
+		json.Unmarshal(queryValAsBytes, &message)                  //un stringify it aka JSON.parse()
+		messages = append(messages, message)                       //add this message to the list
+	}
+
+	//change to array of bytes
+	messagesAsBytes, _ := json.Marshal(messages)                   //convert to array of bytes
+	return shim.Success(messagesAsBytes)
+}
+
+// ============================================================================================================================
+// Get Recommended Marbles - marbles in the colors an owner doesn't have yet
+//
+// One pass over the color~id index, which is sorted by color. The first marble of each color the owner lacks is
+// recommended, so every gap in their collection gets one suggestion. The owner can't own these, they don't have the color.
+//
+// Inputs - Array of Strings
+//         0     ,       1
+//   owner id    , limit (optional)
+// "o99999999999", "10"
+//
+// Returns:
+// [{
+//	"docType": "marble",
+//	"id": "m999999999",
+//	"color": "red",
+//	...
+// }]
+// ============================================================================================================================
+func get_recommended_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	recommended := []Marble{}                                      //start empty so no gaps returns []
+	fmt.Println("starting get_recommended_marbles")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner_id := args[0]
+	limit := max_recommendations
+	if len(args) == 2 {
+		limit, err = strconv.Atoi(args[1])
+		if err != nil || limit <= 0 || limit > max_recommendations {
+			return shim.Error("Limit must be a number from 1 to " + strconv.Itoa(max_recommendations))
+		}
+	}
+
+	_, err = get_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owned_colors, _, err := get_owner_attributes(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("color~id", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() && len(recommended) < limit {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		color := keyParts[0]
+		if owned_colors[color] {                                   //they have it, or we already picked one
+			continue
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {                             //keep looking in this color
+			continue
+		}
+		recommended = append(recommended, marble)
+		owned_colors[color] = true                                 //one per color
+	}
+
+	//change to array of bytes
+	recommendedAsBytes, _ := json.Marshal(recommended)             //convert to array of bytes
+	fmt.Println("- end get_recommended_marbles")
+	return shim.Success(recommendedAsBytes)
+}
+
+// ============================================================================================================================
+// Get Condition Reports - read a marble's condition reports, oldest first
+//
+// Inputs - Array of Strings
+//       0
+//   marble id
+// "m999999999"
+// ============================================================================================================================
+func get_condition_reports(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	reports := []ConditionReport{}                                 //start empty so no reports returns []
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("report~marble~seq", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var report ConditionReport
+		json.Unmarshal(queryValAsBytes, &report)                   //un stringify it aka JSON.parse()
+		reports = append(reports, report)                          //add this report to the list
+	}
+
+	//change to array of bytes
+	reportsAsBytes, _ := json.Marshal(reports)                     //convert to array of bytes
+	return shim.Success(reportsAsBytes)
+}
+
+// ============================================================================================================================
+// Query Marbles By Tag And Color - marbles that have both the tag and the color, for faceted search
+//
+// Intersects the tag~id and color~id indexes so it works on LevelDB without rich queries. Only index keys are read for the
+// intersection, the smaller side drives it and only the marbles in both are fetched.
+//
+// Inputs - Array of Strings
+//     0   ,   1  ,            2
+//    tag  , color, fields (optional)
+//  "promo", "red", "id,size"
+//
+// Returns:
+// [{
+//	"docType": "marble",
+//	"id": "m999999999",
+//	"color": "red",
+//	"tags": ["promo"],
+//	...
+// }]
+// ============================================================================================================================
+func queryMarblesByTagAndColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	marbles := []Marble{}                                          //start empty so no matches returns []
+	fmt.Println("starting queryMarblesByTagAndColor")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tag := normalize_tag(args[0])                                  //match how tags and colors are stored
+	color := normalize_color(args[1])
+	if len(tag) == 0 || len(color) == 0 {
+		return shim.Error("Tag and color must both be non-empty")
+	}
+	var fields []string
+	if len(args) == 3 {
+		fields, err = parse_fields(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	tagged, err := index_ids(stub, "tag~id", []string{tag})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	colored, err := index_ids(stub, "color~id", []string{color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// walk the smaller side, look ids up in the bigger one
+	driver, other := tagged, colored
+	if len(colored) < len(tagged) {
+		driver, other = colored, tagged
+	}
+	inOther := map[string]bool{}
+	for _, id := range other {
+		inOther[id] = true
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range driver {                                    //index order, so endorsers agree
+		if !inOther[id] {
+			continue
+		}
+		marble, err := get_marble(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	fmt.Println("- end queryMarblesByTagAndColor")
+	return shim.Success(marbles_response(marbles, fields))
+}
+
+// ============================================================================================================================
+// Get State Snapshot Hash - one digest over every marble and owner, to compare peers or backups
+//
+// Marbles then owners are read in key order and each key and value goes into the hash with an 8 byte big endian length in
+// front, so the same state always gives the same digest and no two states can run together into the same bytes.
+//
+// Inputs - Array of Strings
+//            0
+//   algorithm (optional, default "sha256", see snapshot_hashes)
+//       "sha512"
+//
+// Returns:
+// {
+//	"algorithm": "sha256",
+//	"digest": "9f86d081884c7d65...",
+//	"marbles": 120,
+//	"owners": 12
+// }
+// ============================================================================================================================
+func get_state_snapshot_hash(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Snapshot struct {
+		Algorithm string `json:"algorithm"`
+		Digest    string `json:"digest"`                              //hex
+		Marbles   int    `json:"marbles"`
+		Owners    int    `json:"owners"`
+	}
+	snapshot := Snapshot{Algorithm: "sha256"}
+	fmt.Println("starting get_state_snapshot_hash")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 1 && len(args[0]) > 0 {
+		snapshot.Algorithm = strings.ToLower(args[0])
+	}
+	new_hash, found := snapshot_hashes[snapshot.Algorithm]
+	if !found {
+		return shim.Error("Unknown hash algorithm - " + snapshot.Algorithm)
+	}
+	digest := new_hash()
+
+	write_length := func(length int) {
+		var prefix [8]byte
+		binary.BigEndian.PutUint64(prefix[:], uint64(length))
+		digest.Write(prefix[:])
+	}
+	hash_range := func(startKey string, endKey string) (int, error) {
+		resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+		if err != nil {
+			return 0, err
+		}
+		defer resultsIterator.Close()
+
+		count := 0
+		for resultsIterator.HasNext() {
+			key, value, err := resultsIterator.Next()
+			if err != nil {
+				return 0, err
+			}
+			write_length(len(key))
+			digest.Write([]byte(key))
+			write_length(len(value))
+			digest.Write(value)
+			count++
+		}
+		return count, nil
+	}
+
+	var err error
+	snapshot.Marbles, err = hash_range("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshot.Owners, err = hash_range("o0", "o9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshot.Digest = hex.EncodeToString(digest.Sum(nil))
+
+	//change to array of bytes
+	snapshotAsBytes, _ := json.Marshal(snapshot)                   //convert to array of bytes
+	fmt.Println("- end get_state_snapshot_hash")
+	return shim.Success(snapshotAsBytes)
+}
+
+// ============================================================================================================================
+// Find Stuck Marbles - marbles left in a pending state for longer than a threshold, for operational cleanup
+//
+// A marble is stuck if it hasn't changed (lastModified) for at least the threshold while it is:
+//  "gift"            - waiting for a gift to be claimed
+//  "pool"            - waiting in a pool for a caller with the attribute
+//  "collateral"      - locked as collateral for a loan
+//  "transfer_retry"  - logging failed transfers, see record_transfer_attempt()
+//  "queued_transfer" - holding requests in its transfer queue
+// A marble in several states is listed under each. Marbles from before lastModified count as stuck for any threshold.
+// Marbles are scanned a page at a time, pass the returned bookmark back until it comes back empty.
+//
+// Inputs - Array of Strings
+//          0         ,      1     ,    2
+//  threshold seconds ,  bookmark  , page size
+//       "86400"      ,     ""     ,   "100"
+//
+// Returns:
+// {
+//	"stuck": {"gift": ["m999999999"], "collateral": ["m888888888"]},
+//	"bookmark": "m888888888"
+// }
+// ============================================================================================================================
+func find_stuck_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type StuckReport struct {
+		Stuck    map[string][]string `json:"stuck"`                   //category -> marble ids
+		Bookmark string              `json:"bookmark"`                //last marble scanned, empty once the scan is done
+	}
+	report := StuckReport{Stuck: map[string][]string{}}
+	fmt.Println("starting find_stuck_marbles")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments([]string{args[0], args[2]})          //the first page's bookmark is empty
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil || threshold < 0 {
+		return shim.Error("Threshold must be a number of seconds >= 0")
+	}
+	lastKey := args[1]
+	pageSize, err := strconv.Atoi(args[2])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cutoff := txTime.Add(-time.Duration(threshold) * time.Second)
+
+	startKey := "m0"
+	if len(lastKey) > 0 {
+		startKey = lastKey
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	scanned := 0
+	for resultsIterator.HasNext() {
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if key == lastKey {                                        //the bookmark was the last one done
+			continue
+		}
+		if scanned == pageSize {                                   //page is full, leave the rest for next time
+			report.Bookmark = lastKey
+			break
+		}
+		scanned++
+		lastKey = key
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if len(marble.LastModified) > 0 {
+			lastModified, err := time.Parse(time.RFC3339, marble.LastModified)
+			if err != nil {
+				return shim.Error("Marble " + marble.Id + " has a bad lastModified - " + marble.LastModified)
+			}
+			if lastModified.After(cutoff) {                        //changed recently, not stuck yet
+				continue
+			}
+		}
+
+		if marble.Gift != nil {
+			report.Stuck["gift"] = append(report.Stuck["gift"], marble.Id)
+		}
+		if marble.Pool != nil {
+			report.Stuck["pool"] = append(report.Stuck["pool"], marble.Id)
+		}
+		if marble.Collateral != nil {
+			report.Stuck["collateral"] = append(report.Stuck["collateral"], marble.Id)
+		}
+		if marble.TransferAttempts != nil {
+			report.Stuck["transfer_retry"] = append(report.Stuck["transfer_retry"], marble.Id)
+		}
+		queued, err := count_index(stub, "txnqueue~marble~seq", []string{marble.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if queued > 0 {
+			report.Stuck["queued_transfer"] = append(report.Stuck["queued_transfer"], marble.Id)
+		}
+	}
+
+	//change to array of bytes
+	reportAsBytes, _ := json.Marshal(report)                       //convert to array of bytes
+	fmt.Println("- end find_stuck_marbles")
+	return shim.Success(reportAsBytes)
+}
+
+// ============================================================================================================================
+// Get Marbles By Percentile - marbles whose size falls in a percentile range, e.g. 90 to 100 for the biggest 10%
+//
+// Two passes over the marbles, the first collects their sizes to find the size thresholds, the second returns the
+// marbles between them. Marbles the same size rank together, so a range cutting through a tie returns the whole tie.
+// Only the first max_percentile_marbles marbles (in key order) are ranked, "capped" says if there were more.
+//
+// Inputs - Array of Strings
+//       0       ,       1
+//  from percent ,  to percent
+//      "90"     ,     "100"
+//
+// Returns:
+// {
+//	"minSize": 40,
+//	"maxSize": 50,
+//	"capped": false,
+//	"marbles": [{"docType": "marble", "id": "m999999999", "size": 50, ...}]
+// }
+// ============================================================================================================================
+func get_marbles_by_percentile(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type PercentileResult struct {
+		MinSize int      `json:"minSize"`
+		MaxSize int      `json:"maxSize"`
+		Capped  bool     `json:"capped"`                              //more marbles exist than were ranked
+		Marbles []Marble `json:"marbles"`
+	}
+	result := PercentileResult{Marbles: []Marble{}}
+	fmt.Println("starting get_marbles_by_percentile")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	from, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("From percent must be a number")
+	}
+	to, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("To percent must be a number")
+	}
+	if from < 0 || to > 100 || from >= to {
+		return shim.Error("Percentiles must satisfy 0 <= from < to <= 100")
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ---- first pass, find the size thresholds ---- //
+	var sizes []int
+	lastKey := ""
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for resultsIterator.HasNext() {
+		if len(sizes) == max_percentile_marbles {                 //stop ranking, there is at least one more
+			result.Capped = true
+			break
+		}
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return shim.Error(err.Error())
+		}
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if is_hidden(marble, txTime) {                             //hidden marbles don't get ranked
+			continue
+		}
+		sizes = append(sizes, marble.Size)
+		lastKey = key
+	}
+	resultsIterator.Close()
+
+	if len(sizes) == 0 {                                           //nothing to rank
+		resultsAsBytes, _ := json.Marshal(result)
+		return shim.Success(resultsAsBytes)
+	}
+	sort.Ints(sizes)
+	low := from * len(sizes) / 100                                 //first index in the range
+	high := (to * len(sizes) + 99) / 100 - 1                       //last index in the range, rounded up
+	if high < low {                                                //too few marbles to split this finely
+		high = low
+	}
+	result.MinSize = sizes[low]
+	result.MaxSize = sizes[high]
+
+	// ---- second pass, collect the marbles between them ---- //
+	resultsIterator, err = stub.GetStateByRange("m0", lastKey + "\x00")   //just past the last marble ranked
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		if marble.Size >= result.MinSize && marble.Size <= result.MaxSize {
+			result.Marbles = append(result.Marbles, marble)
+		}
+	}
+
+	//change to array of bytes
+	resultsAsBytes, _ := json.Marshal(result)                      //convert to array of bytes
+	fmt.Println("- end get_marbles_by_percentile")
+	return shim.Success(resultsAsBytes)
+}
+
+// ============================================================================================================================
+// Find Never Transferred - marbles still with the owner they were created for, for "original owner" analytics
+//
+// A marble counts as never transferred if its transferCount is 0. Marbles from before transferCount fall back to checking
+// that every version in their history has the same owner. History scans are costly, so marbles are checked a page at a
+// time, pass the returned bookmark back until it comes back empty.
+//
+// Inputs - Array of Strings
+//       0     ,     1
+//    bookmark , page size
+//       ""    ,   "50"
+//
+// Returns:
+// {
+//	"marbles": ["m999999999"],
+//	"bookmark": "m888888888"
+// }
+// ============================================================================================================================
+func find_never_transferred(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type NeverTransferred struct {
+		Marbles  []string `json:"marbles"`
+		Bookmark string   `json:"bookmark"`                           //last marble checked, empty once the scan is done
+	}
+	result := NeverTransferred{Marbles: []string{}}
+	fmt.Println("starting find_never_transferred")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	lastKey := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	startKey := "m0"
+	if len(lastKey) > 0 {
+		startKey = lastKey
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	checked := 0
+	for resultsIterator.HasNext() {
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if key == lastKey {                                        //the bookmark was the last one done
+			continue
+		}
+		if checked == pageSize {                                   //page is full, leave the rest for next time
+			result.Bookmark = lastKey
+			break
+		}
+		checked++
+		lastKey = key
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if is_hidden(marble, txTime) {                             //still counts toward the page, skip the history scan
+			continue
+		}
+		transfers := 0
+		if marble.TransferCount != nil {                           //the counter is cheap, use it when it's there
+			transfers = *marble.TransferCount
+		} else {
+			transfers, err = count_transfers(stub, key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if transfers == 0 {
+			result.Marbles = append(result.Marbles, key)
+		}
+	}
+
+	//change to array of bytes
+	resultAsBytes, _ := json.Marshal(result)                       //convert to array of bytes
+	fmt.Println("- end find_never_transferred")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Count Transfers - how many times a marble's history shows it changing owner
+// ============================================================================================================================
+func count_transfers(stub shim.ChaincodeStubInterface, marble_id string) (int, error) {
+	resultsIterator, err := stub.GetHistoryForKey(marble_id)
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	last_owner := ""
+	for resultsIterator.HasNext() {
+		_, historicValue, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		if historicValue == nil {                                  //a delete, no owner to compare
+			continue
+		}
+		var marble Marble
+		json.Unmarshal(historicValue, &marble)                     //un stringify it aka JSON.parse()
+		if len(last_owner) > 0 && marble.Owner.Id != last_owner {
+			count++
+		}
+		last_owner = marble.Owner.Id
+	}
+	return count, nil
+}
+
+// ============================================================================================================================
+// Query Marbles By Transfer Count Range - marbles that changed owner between min and max times, inclusive
+//
+// Marbles without a transferCount yet are left out, see backfill_transfer_counts().
+//
+// Inputs - Array of Strings
+//    0  ,  1
+//   min , max
+//   "1" , "5"
+//
+// Returns - array of marbles
+// ============================================================================================================================
+func queryMarblesByTransferCountRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	marbles := []Marble{}                                          //start empty so no matches returns []
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	min, err := strconv.Atoi(args[0])
+	if err != nil || min < 0 {
+		return shim.Error("Min must be a number >= 0")
+	}
+	max, err := strconv.Atoi(args[1])
+	if err != nil || max < min {
+		return shim.Error("Max must be a number >= min")
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                   //un stringify it aka JSON.parse()
+		if marble.TransferCount == nil {                           //not backfilled yet, can't place it
+			continue
+		}
+		if *marble.TransferCount < min || *marble.TransferCount > max {
+			continue
+		}
+		if is_hidden(marble, txTime) {
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+
+	//change to array of bytes
+	marblesAsBytes, _ := json.Marshal(marbles)                     //convert to array of bytes
+	return shim.Success(marblesAsBytes)
+}
+
+// ============================================================================================================================
+// Get Audit Trail - a marble's history as plain sentences, oldest first
+//
+// Each version in the marble's history is compared to the one before it and every change gets a line, e.g.
+// "Transferred from alice to bob" or "Color changed from red to blue". Owners are named by their current username,
+// owners that no longer exist are named by their id. Times are the lastModified of each version, versions from before
+// lastModified have none. Like get_marble_tx_count() only the first max_tx_count versions are read.
+//
+// Inputs - Array of Strings
+//       0
+//   marble id
+// "m999999999"
+//
+// Returns:
+// [{
+//	"txId": "abc...",
+//	"at": "2017-06-01T12:00:00.000Z",
+//	"text": "Created for alice"
+// }]
+// ============================================================================================================================
+func get_audit_trail(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type AuditLine struct {
+		TxId string `json:"txId"`
+		At   string `json:"at,omitempty"`
+		Text string `json:"text"`
+	}
+	trail := []AuditLine{}                                         //start empty so no history returns []
+	fmt.Println("starting get_audit_trail")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owners := new_owner_cache(stub)                                //each owner is named many times
+	name := func(owner_id string) string {
+		owner, err := owners.get(owner_id)
+		if err != nil {
+			return "owner " + owner_id + " (no longer registered)"
+		}
+		return owner.Username
+	}
+
+	resultsIterator, err := stub.GetHistoryForKey(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var previous *Marble
+	for versions := 0; resultsIterator.HasNext() && versions < max_tx_count; versions++ {
+		txID, historicValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if historicValue == nil {                                  //deleted
+			trail = append(trail, AuditLine{TxId: txID, Text: "Deleted"})
+			previous = nil
+			continue
+		}
+
+		var marble Marble
+		json.Unmarshal(historicValue, &marble)                     //un stringify it aka JSON.parse()
+		var lines []string
+		if previous == nil {
+			lines = append(lines, "Created for " + name(marble.Owner.Id) + ", " + marble.Color + ", size " + strconv.Itoa(marble.Size))
+		} else {
+			lines = describe_marble_changes(*previous, marble, name)
+			if len(lines) == 0 {
+				lines = append(lines, "Updated")                  //a write that changed nothing we describe
+			}
+		}
+		for _, line := range lines {
+			trail = append(trail, AuditLine{TxId: txID, At: marble.LastModified, Text: line})
+		}
+		previous = &marble
+	}
+
+	//change to array of bytes
+	trailAsBytes, _ := json.Marshal(trail)                         //convert to array of bytes
+	fmt.Println("- end get_audit_trail")
+	return shim.Success(trailAsBytes)
+}
+
+// ============================================================================================================================
+// Describe Marble Changes - one sentence per difference between two versions of a marble, for get_audit_trail()
+// ============================================================================================================================
+func describe_marble_changes(before Marble, after Marble, name func(owner_id string) string) []string {
+	var lines []string
+	if before.Owner.Id != after.Owner.Id {
+		lines = append(lines, "Transferred from " + name(before.Owner.Id) + " to " + name(after.Owner.Id))
+	}
+	if before.Color != after.Color {
+		lines = append(lines, "Color changed from " + before.Color + " to " + after.Color)
+	}
+	if before.SecondaryColor != after.SecondaryColor {
+		if len(after.SecondaryColor) == 0 {
+			lines = append(lines, "Secondary color " + before.SecondaryColor + " removed")
+		} else {
+			lines = append(lines, "Secondary color set to " + after.SecondaryColor)
+		}
+	}
+	if before.Size != after.Size {
+		lines = append(lines, "Size changed from " + strconv.Itoa(before.Size) + " to " + strconv.Itoa(after.Size))
+	}
+	if before.quantity() != after.quantity() {
+		lines = append(lines, "Quantity changed from " + strconv.Itoa(before.quantity()) + " to " + strconv.Itoa(after.quantity()))
+	}
+	for _, tag := range after.Tags {
+		if !before.has_tag(tag) {
+			lines = append(lines, "Tagged " + tag)
+		}
+	}
+	if before.Gift == nil && after.Gift != nil {
+		lines = append(lines, "Offered as a gift")
+	}
+	if before.Collateral == nil && after.Collateral != nil {
+		lines = append(lines, "Locked as collateral for loan " + after.Collateral.LoanId)
+	}
+	if before.Collateral != nil && after.Collateral == nil && before.Owner.Id == after.Owner.Id {
+		lines = append(lines, "Released from collateral for loan " + before.Collateral.LoanId)
+	}
+	if before.InsuredValue != after.InsuredValue {
+		lines = append(lines, "Insured value changed from " + strconv.FormatInt(before.InsuredValue, 10) + " to " + strconv.FormatInt(after.InsuredValue, 10))
+	}
+	return lines
+}
+
+// ============================================================================================================================
+// Get Distinct Values - every value a field has across the ledger, sorted, for filter dropdowns
+//
+// Only fields with a small set of values can be asked for. Most have an index and its keys are read, marble values are
+// never loaded. Size has no index, so marbles are scanned, and only the first max_distinct_scan of them, "capped" says
+// if there were more.
+//  color, secondaryColor, tag, ownerId - from their marble index
+//  company                              - from the company~owner index
+//  size                                 - scanned, sorted by number, expired and quarantined marbles left out
+//
+// Inputs - Array of Strings
+//     0
+//   field
+//  "color"
+//
+// Returns:
+// {
+//	"field": "color",
+//	"values": ["blue", "red"],
+//	"capped": false
+// }
+// ============================================================================================================================
+var distinct_indexes = map[string]string{
+	"color":          "color~id",
+	"secondaryColor": "secondary~id",
+	"tag":            "tag~id",
+	"ownerId":        "owner~id",
+	"company":        "company~owner",
+}
+
+func get_distinct_values(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type DistinctValues struct {
+		Field  string   `json:"field"`
+		Values []string `json:"values"`
+		Capped bool     `json:"capped"`                              //only for scanned fields, more marbles exist than were scanned
+	}
+	fmt.Println("starting get_distinct_values")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	result := DistinctValues{Field: args[0], Values: []string{}}
+
+	if index, indexed := distinct_indexes[result.Field]; indexed {
+		// ---- walk the index, its keys come sorted so repeats are next to each other ---- //
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			indexKey, _, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			_, keyParts, err := stub.SplitCompositeKey(indexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			last := len(result.Values) - 1
+			if last < 0 || result.Values[last] != keyParts[0] {
+				result.Values = append(result.Values, keyParts[0])
+			}
+		}
+	} else if result.Field == "size" {
+		// ---- no index, scan ---- //
+		txTime, err := get_tx_time(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		sizes := map[int]bool{}
+		resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for scanned := 0; resultsIterator.HasNext(); scanned++ {
+			if scanned == max_distinct_scan {                      //stop scanning, there is at least one more
+				result.Capped = true
+				break
+			}
+			_, queryValAsBytes, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			var marble Marble
+			json.Unmarshal(queryValAsBytes, &marble)               //un stringify it aka JSON.parse()
+			if is_hidden(marble, txTime) {                         //expired or quarantined marbles don't show up
+				continue
+			}
+			sizes[marble.Size] = true
+		}
+
+		var sorted []int
+		for size := range sizes {
+			sorted = append(sorted, size)
+		}
+		sort.Ints(sorted)                                          //map order is random, endorsers have to agree
+		for _, size := range sorted {
+			result.Values = append(result.Values, strconv.Itoa(size))
+		}
+	} else {
+		return shim.Error("Field '" + result.Field + "' can't be listed, use one of color, secondaryColor, tag, ownerId, company or size")
+	}
+
+	//change to array of bytes
+	resultAsBytes, _ := json.Marshal(result)                       //convert to array of bytes
+	fmt.Println("- end get_distinct_values")
+	return shim.Success(resultAsBytes)
 }
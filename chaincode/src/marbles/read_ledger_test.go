@@ -0,0 +1,1520 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// read(), getMarblesByRange() and delete_expired_marbles() - expiring marbles
+// ============================================================================================================================
+func TestExpiredMarbles(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	expiresAt := test_start.Add(time.Hour).Format(time_format)
+	must_ok(t, stub.call(init_marble, "m0000000000001", "red", "10", "o0000000000001", "Alpha", expiresAt))
+	must_ok(t, stub.call(init_marble, "m0000000000002", "red", "10", "o0000000000001", "Alpha", expiresAt))
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000001", "Alpha")
+
+	// before it expires
+	must_ok(t, stub.invoke("read", "m0000000000001"))
+	type Result struct {
+		Key    string `json:"Key"`
+		Record Marble `json:"Record"`
+	}
+	var marbles []Result
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9")), &marbles)
+	if len(marbles) != 3 {
+		t.Fatalf("expected 3 marbles before they expire, got %d", len(marbles))
+	}
+
+	// after it expires, only if asked for
+	stub.now = test_start.Add(2 * time.Hour)
+	must_fail(t, stub.invoke("read", "m0000000000001"), "expired")
+	must_fail(t, stub.invoke("read", "m0000000000001", "id,color"), "expired")
+	must_ok(t, stub.invoke("read", "m0000000000001", "", "true"))
+	must_ok(t, stub.invoke("read", "m0000000000001", "id,color", "true"))
+	must_ok(t, stub.invoke("read", "m0000000000003"))
+	marbles = nil
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9")), &marbles)
+	if len(marbles) != 1 || marbles[0].Key != "m0000000000003" {
+		t.Fatalf("expected only the unexpired marble, got %+v", marbles)
+	}
+	marbles = nil
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9", "true")), &marbles)
+	if len(marbles) != 3 {
+		t.Fatalf("expected every marble when asked for expired ones, got %d", len(marbles))
+	}
+
+	// purged a batch at a time
+	must_ok(t, stub.invoke("delete_expired_marbles", "1"))
+	must_ok(t, stub.invoke("delete_expired_marbles", "1"))
+	for _, id := range []string{"m0000000000001", "m0000000000002"} {
+		value, _ := stub.GetState(id)
+		if value != nil {
+			t.Fatalf("expected %s to be purged", id)
+		}
+	}
+	stub.get_marble(t, "m0000000000003")
+}
+
+// ============================================================================================================================
+// get_distinct_values() - indexed and scanned fields
+// ============================================================================================================================
+func TestGetDistinctValues(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 5, "o0000000000001", "Alpha")
+	expiresAt := test_start.Add(time.Hour).Format(time_format)
+	must_ok(t, stub.call(init_marble, "m0000000000004", "red", "35", "o0000000000001", "Alpha", expiresAt))
+
+	var result struct {
+		Field  string   `json:"field"`
+		Values []string `json:"values"`
+		Capped bool     `json:"capped"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("get_distinct_values", "color")), &result)
+	if strings.Join(result.Values, ",") != "blue,red" {
+		t.Fatalf("expected blue and red once each, got %v", result.Values)
+	}
+
+	// sizes sort by number, and an expired marble's size doesn't show up
+	stub.now = test_start.Add(2 * time.Hour)
+	must_decode(t, must_ok(t, stub.invoke("get_distinct_values", "size")), &result)
+	if strings.Join(result.Values, ",") != "5,10,20" || result.Capped {
+		t.Fatalf("expected sizes 5,10,20, got %v", result.Values)
+	}
+
+	must_fail(t, stub.invoke("get_distinct_values", "name"), "can't be listed")
+}
+
+// ============================================================================================================================
+// get_color_stats() - counts and sizes over a known mix
+// ============================================================================================================================
+func TestGetColorStats(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+
+	type ColorStats struct {
+		Count   int     `json:"count"`
+		AvgSize float64 `json:"avgSize"`
+		MinSize int     `json:"minSize"`
+		MaxSize int     `json:"maxSize"`
+	}
+	var stats map[string]ColorStats
+	must_decode(t, must_ok(t, stub.invoke("get_color_stats")), &stats)
+	if len(stats) != 0 {
+		t.Fatalf("expected no stats for an empty ledger, got %+v", stats)
+	}
+
+	stub.marble(t, "m0000000000001", "blue", 16, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 35, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000005", "red", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000006", "white", 7, "o0000000000001", "Alpha")
+
+	must_decode(t, must_ok(t, stub.invoke("get_color_stats")), &stats)
+	want := map[string]ColorStats{
+		"blue":  {Count: 2, AvgSize: 25.5, MinSize: 16, MaxSize: 35},
+		"red":   {Count: 3, AvgSize: 40.0 / 3, MinSize: 10, MaxSize: 20},
+		"white": {Count: 1, AvgSize: 7, MinSize: 7, MaxSize: 7},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("expected %d colors, got %+v", len(want), stats)
+	}
+	for color, stat := range want {
+		if stats[color] != stat {
+			t.Fatalf("expected %s to be %+v, got %+v", color, stat, stats[color])
+		}
+	}
+}
+
+// ============================================================================================================================
+// get_caller_org() - the MSP id and name from the creator identity
+// ============================================================================================================================
+func TestGetCallerOrg(t *testing.T) {
+	stub := new_test_stub(t, "")
+	must_fail(t, stub.invoke("get_caller_org"), "No caller identity")
+
+	stub.as(t, "Org1MSP", "user1", nil)
+	var caller struct {
+		MspId      string `json:"mspId"`
+		CommonName string `json:"commonName"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("get_caller_org")), &caller)
+	if caller.MspId != "Org1MSP" || caller.CommonName != "user1" {
+		t.Fatalf("expected Org1MSP/user1, got %+v", caller)
+	}
+
+	stub.creator = []byte("not an identity")
+	must_fail(t, stub.invoke("get_caller_org"), "Failed to decode caller identity")
+}
+
+// ============================================================================================================================
+// get_owner_color_inventory() - an owner with several colors, and one with none
+// ============================================================================================================================
+func TestGetOwnerColorInventory(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+
+	var inventory map[string]int
+	must_decode(t, must_ok(t, stub.invoke("get_owner_color_inventory", "o0000000000001")), &inventory)
+	if len(inventory) != 2 || inventory["blue"] != 2 || inventory["red"] != 1 {
+		t.Fatalf("expected 2 blue and 1 red, got %+v", inventory)
+	}
+
+	// a transfer moves the marble between inventories
+	must_ok(t, stub.invoke("set_owner", "m0000000000003", "o0000000000002", "Alpha"))
+	inventory = nil
+	must_decode(t, must_ok(t, stub.invoke("get_owner_color_inventory", "o0000000000002")), &inventory)
+	if len(inventory) != 1 || inventory["red"] != 1 {
+		t.Fatalf("expected bob to have 1 red, got %+v", inventory)
+	}
+
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	data := must_ok(t, stub.invoke("get_owner_color_inventory", "o0000000000003"))
+	if string(data) != "{}" {
+		t.Fatalf("expected an empty inventory, got %s", string(data))
+	}
+	must_fail(t, stub.invoke("get_owner_color_inventory", "o0000000000009"), "Owner does not exist")
+}
+
+// ============================================================================================================================
+// get_marble_tx_count() - every write counts, up to the cap
+// ============================================================================================================================
+func TestGetMarbleTxCount(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000001", "blue", "Alpha"))
+
+	type TxCount struct {
+		Count  int  `json:"count"`
+		Capped bool `json:"capped"`
+	}
+	var count TxCount
+	must_decode(t, must_ok(t, stub.invoke("get_marble_tx_count", "m0000000000001")), &count)
+	if count.Count != 3 || count.Capped {
+		t.Fatalf("expected 3 txs, got %+v", count)
+	}
+
+	// a long history stops at the cap
+	for i := 0; i < max_tx_count; i++ {
+		stub.history["m0000000000001"] = append(stub.history["m0000000000001"], test_history{txId: "old" + strconv.Itoa(i), value: []byte("{}")})
+	}
+	must_decode(t, must_ok(t, stub.invoke("get_marble_tx_count", "m0000000000001")), &count)
+	if count.Count != max_tx_count || !count.Capped {
+		t.Fatalf("expected the count to stop at %d, got %+v", max_tx_count, count)
+	}
+}
+
+// ============================================================================================================================
+// read_marbles_by_filter() - every combination of color, owner and size
+// ============================================================================================================================
+func TestReadMarblesByFilter(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 30, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "red", 20, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000005", "blue", 40, "o0000000000002", "Alpha")
+
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`{}`, "1,2,3,4,5"},
+		{`{"color": "red"}`, "1,2,4"},
+		{`{"ownerId": "o0000000000002"}`, "4,5"},
+		{`{"minSize": 20, "maxSize": 30}`, "2,3,4"},
+		{`{"color": "red", "ownerId": "o0000000000001"}`, "1,2"},
+		{`{"color": "blue", "minSize": 30}`, "5"},
+		{`{"ownerId": "o0000000000001", "maxSize": 20}`, "1,3"},
+		{`{"color": "red", "ownerId": "o0000000000001", "minSize": 20, "maxSize": 40}`, "2"},
+		{`{"color": "green"}`, ""},
+	}
+	for _, test := range tests {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("read_marbles_by_filter", test.filter)), &marbles)
+		var got []string
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != test.want {
+			t.Fatalf("expected %s to find %q, got %q", test.filter, test.want, strings.Join(got, ","))
+		}
+	}
+
+	// with a projection
+	var projected []map[string]interface{}
+	must_decode(t, must_ok(t, stub.invoke("read_marbles_by_filter", `{"ownerId": "o0000000000002"}`, "id,size")), &projected)
+	if len(projected) != 2 || len(projected[0]) != 2 || projected[0]["size"] == nil {
+		t.Fatalf("expected just id and size, got %+v", projected)
+	}
+	must_fail(t, stub.invoke("read_marbles_by_filter", `{"minSize": "big"}`), "Filter must be a JSON object")
+}
+
+// ============================================================================================================================
+// getMarblesByRange() - NDJSON parses a line at a time into the same records as JSON
+// ============================================================================================================================
+func TestGetMarblesByRangeNDJSON(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "green", 30, "o0000000000001", "Alpha")
+
+	type Result struct {
+		Key    string `json:"Key"`
+		Record Marble `json:"Record"`
+	}
+	var asJSON []Result
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9", "", "json")), &asJSON)
+
+	res := stub.invoke("getMarblesByRange", "m0", "m9", "", "ndjson")
+	if res.Status >= 400 {
+		t.Fatalf("expected success, got %s", res.Message)
+	}
+	lines := strings.Split(string(res.Payload), "\n")
+	if len(lines) != len(asJSON) + 1 || lines[len(lines) - 1] != "" {
+		t.Fatalf("expected %d newline terminated lines, got %q", len(asJSON), string(res.Payload))
+	}
+	for i, line := range lines[:len(lines) - 1] {
+		var result Result
+		must_decode(t, []byte(line), &result)
+		if result.Key != asJSON[i].Key || result.Record.Color != asJSON[i].Record.Color || result.Record.Size != asJSON[i].Record.Size {
+			t.Fatalf("expected line %d to be %+v, got %+v", i, asJSON[i], result)
+		}
+	}
+
+	must_fail(t, stub.invoke("getMarblesByRange", "m0", "m9", "", "xml"), "Format must be 'json' or 'ndjson'")
+}
+
+// ============================================================================================================================
+// read_marble_expanded() - the owner inlined, and a warning when the owner id points at nothing
+// ============================================================================================================================
+func TestReadMarbleExpanded(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000002", "Beta")
+
+	type Expanded struct {
+		Id      string `json:"id"`
+		Color   string `json:"color"`
+		Owner   *Owner `json:"owner"`
+		Warning string `json:"warning"`
+	}
+	var expanded Expanded
+	must_decode(t, must_ok(t, stub.invoke("read_marble_expanded", "m0000000000001")), &expanded)
+	if expanded.Color != "red" || expanded.Owner == nil || expanded.Owner.Username != "amy" || expanded.Owner.ObjectType != "marble_owner" || len(expanded.Warning) > 0 {
+		t.Fatalf("expected red with amy inlined, got %+v", expanded)
+	}
+
+	// orphan bob's marble
+	stub.run(func() pb.Response {
+		stub.DelState("o0000000000002")
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	expanded = Expanded{}
+	must_decode(t, must_ok(t, stub.invoke("read_marble_expanded", "m0000000000002")), &expanded)
+	if expanded.Id != "m0000000000002" || expanded.Owner != nil || !strings.Contains(expanded.Warning, "o0000000000002") {
+		t.Fatalf("expected the marble with a null owner and a warning, got %+v", expanded)
+	}
+
+	must_fail(t, stub.invoke("read_marble_expanded", "m0000000000009"), "does not exist")
+}
+
+// ============================================================================================================================
+// getMarblesChangedBetween() - window edges are inclusive
+// ============================================================================================================================
+func TestGetMarblesChangedBetween(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	for i := 1; i <= 4; i++ {
+		stub.now = test_start.Add(time.Duration(i) * time.Hour)
+		stub.marble(t, "m000000000000" + strconv.Itoa(i), "red", 10, "o0000000000001", "Alpha")
+	}
+	stub.now = test_start.Add(5 * time.Hour)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))  //moves 1 to hour 5
+
+	changed := func(start time.Duration, end time.Duration) string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("getMarblesChangedBetween", test_start.Add(start).Format(time.RFC3339), test_start.Add(end).Format(time.RFC3339))), &marbles)
+		var got []string
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+	tests := []struct {
+		start time.Duration
+		end   time.Duration
+		want  string
+	}{
+		{0, 10 * time.Hour, "1,2,3,4"},
+		{2 * time.Hour, 3 * time.Hour, "2,3"},
+		{90 * time.Minute, 150 * time.Minute, "2"},
+		{5 * time.Hour, 5 * time.Hour, "1"},
+		{6 * time.Hour, 10 * time.Hour, ""},
+	}
+	for _, test := range tests {
+		if got := changed(test.start, test.end); got != test.want {
+			t.Fatalf("expected %s to %s to find %q, got %q", test.start, test.end, test.want, got)
+		}
+	}
+
+	must_fail(t, stub.invoke("getMarblesChangedBetween", "yesterday", "today"), "RFC3339")
+	must_fail(t, stub.invoke("getMarblesChangedBetween", test_start.Add(time.Hour).Format(time.RFC3339), test_start.Format(time.RFC3339)), "Start must not be after end")
+}
+
+// ============================================================================================================================
+// create_set(), add_marble_to_set(), remove_marble_from_set() and get_set() - a set's contents as marbles come and go
+// ============================================================================================================================
+func TestSets(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000002", "Beta")
+	stub.marble(t, "m0000000000003", "green", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("create_set", "s0000000000001", "favorites", "o0000000000001", "Alpha", "the good ones"))
+	must_fail(t, stub.invoke("create_set", "s0000000000001", "again", "o0000000000001", "Alpha", ""), "already in use")
+	must_fail(t, stub.invoke("create_set", "s0000000000002", "bobs", "o0000000000002", "Alpha", ""), "cannot authorize")
+
+	contents := func() string {
+		var result struct {
+			Set     MarbleSet `json:"set"`
+			Marbles []Marble  `json:"marbles"`
+		}
+		must_decode(t, must_ok(t, stub.invoke("get_set", "s0000000000001")), &result)
+		if result.Set.Name != "favorites" || result.Set.Owner.Id != "o0000000000001" {
+			t.Fatalf("expected amy's favorites, got %+v", result.Set)
+		}
+		var got []string
+		for _, marble := range result.Marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+	if got := contents(); got != "" {
+		t.Fatalf("expected a new set to be empty, got %q", got)
+	}
+
+	// marbles of any owner can go in, the set's company authorizes
+	must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000001", "Alpha"))
+	must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000003", "Alpha"))
+	must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000003", "Alpha"))   //twice is once
+	must_fail(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000009", "Alpha"), "does not exist")
+	must_fail(t, stub.invoke("add_marble_to_set", "s0000000000001", "m0000000000001", "Beta"), "cannot authorize")
+	if got := contents(); got != "1,2,3" {
+		t.Fatalf("expected 1,2,3 in the set, got %q", got)
+	}
+
+	must_ok(t, stub.invoke("remove_marble_from_set", "s0000000000001", "m0000000000002", "Alpha"))
+	if got := contents(); got != "1,3" {
+		t.Fatalf("expected 1,3 after removing 2, got %q", got)
+	}
+
+	// deleting a marble takes it out of its sets
+	must_ok(t, stub.invoke("delete_marble", "m0000000000003", "Alpha"))
+	if got := contents(); got != "1" {
+		t.Fatalf("expected 1 after deleting 3, got %q", got)
+	}
+	must_fail(t, stub.invoke("get_set", "s0000000000009"), "")
+}
+
+// ============================================================================================================================
+// check_index_consistency() - a missing entry, an entry for a gone marble and a stale entry, found then repaired
+// ============================================================================================================================
+func TestCheckIndexConsistency(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "blue", 10, "o0000000000002", "Alpha")
+
+	stub.run(func() pb.Response {
+		delete_index(stub, "owner~id", []string{"o0000000000001", "m0000000000001"})   //missing
+		put_index(stub, "owner~id", []string{"o0000000000001", "m0000000000009"})      //marble is gone
+		put_index(stub, "owner~id", []string{"o0000000000002", "m0000000000002"})      //stale, amy owns it
+		delete_index(stub, "color~id", []string{"blue", "m0000000000003"})             //missing
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	type Report struct {
+		Missing  []string `json:"missing"`
+		Orphaned []string `json:"orphaned"`
+		Repaired int      `json:"repaired"`
+		Bookmark string   `json:"bookmark"`
+	}
+	check := func(index string, mode string) Report {      //every page, a page size of 2 makes it take a few
+		total := Report{}
+		for pages := 0; pages == 0 || len(total.Bookmark) > 0; pages++ {
+			if pages > 10 {
+				t.Fatalf("expected the bookmark to run out, still at %q", total.Bookmark)
+			}
+			var report Report
+			must_decode(t, must_ok(t, stub.invoke("check_index_consistency", index, mode, total.Bookmark, "2")), &report)
+			total.Missing = append(total.Missing, report.Missing...)
+			total.Orphaned = append(total.Orphaned, report.Orphaned...)
+			total.Repaired += report.Repaired
+			total.Bookmark = report.Bookmark
+		}
+		return total
+	}
+
+	report := check("owner~id", "check")
+	if strings.Join(report.Missing, ",") != "m0000000000001" || report.Repaired != 0 {
+		t.Fatalf("expected m0000000000001 to be missing from owner~id, got %+v", report)
+	}
+	if strings.Join(report.Orphaned, ",") != "owner~id o0000000000001 m0000000000009,owner~id o0000000000002 m0000000000002" {
+		t.Fatalf("expected the gone and the stale entries to be orphaned, got %+v", report.Orphaned)
+	}
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("check_index_consistency", "owner~id", "repair", "", "2"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+	if report = check("owner~id", "repair"); report.Repaired != 3 {
+		t.Fatalf("expected 3 repairs, got %+v", report)
+	}
+	if report = check("owner~id", "check"); len(report.Missing) + len(report.Orphaned) != 0 {
+		t.Fatalf("expected owner~id to be clean after the repair, got %+v", report)
+	}
+	owned, _ := index_ids(stub, "owner~id", []string{"o0000000000001"})
+	if strings.Join(owned, ",") != "m0000000000001,m0000000000002,m0000000000003" {
+		t.Fatalf("expected amy's entries to be back, got %v", owned)
+	}
+
+	// repairing color~id fixes the counts too
+	if report = check("color~id", "repair"); strings.Join(report.Missing, ",") != "m0000000000003" || report.Repaired != 1 {
+		t.Fatalf("expected m0000000000003 to be put back in color~id, got %+v", report)
+	}
+	var count struct {
+		Count int `json:"count"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("get_color_count", "blue")), &count)
+	if count.Count != 2 {
+		t.Fatalf("expected 2 blue after the repair, got %d", count.Count)
+	}
+
+	must_fail(t, stub.invoke("check_index_consistency", "size~id", "check", "", "2"), "Unknown index")
+	must_fail(t, stub.invoke("check_index_consistency", "owner~id", "check", "somewhere", "2"), "Bad bookmark")
+}
+
+// ============================================================================================================================
+// Limits - queries past the configured record, history and response size limits fail instead of running on
+// ============================================================================================================================
+func TestLimits(t *testing.T) {
+	stub := new_test_stub(t, `{"limits": {"maxRecords": 3, "maxHistory": 2, "maxResponseBytes": 2000}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+
+	// at the limit is fine
+	var marbles []interface{}
+	must_decode(t, must_ok(t, stub.invoke("getMarblesByRange", "m0", "m9")), &marbles)
+	if len(marbles) != 3 {
+		t.Fatalf("expected 3 marbles at the limit, got %d", len(marbles))
+	}
+
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000001", "Alpha")
+	must_fail(t, stub.invoke("getMarblesByRange", "m0", "m9"), "Limit exceeded - more than 3 records")
+	must_ok(t, stub.invoke("getMarblesByRange", "m0000000000002", "m0000000000004"))
+
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("getHistory", "m0000000000001"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	must_fail(t, stub.invoke("getHistory", "m0000000000001"), "more than 2 history entries")
+
+	must_fail(t, stub.invoke("read_marbles_by_filter", `{"color": "red"}`), "Limit exceeded")
+	must_fail(t, stub.invoke("read_everything"), "Limit exceeded")
+
+	var limits Limits
+	must_decode(t, must_ok(t, stub.invoke("get_limits")), &limits)
+	if limits.MaxRecords != 3 || limits.MaxHistory != 2 || limits.MaxResponseBytes != 2000 {
+		t.Fatalf("expected the limits from Init, got %+v", limits)
+	}
+
+	// the response size counts the whole envelope
+	stub = new_test_stub(t, `{"limits": {"maxResponseBytes": 400}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("read", "m0000000000001"))
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	must_fail(t, stub.invoke("getMarblesByRange", "m0", "m9"), "more than 400 response bytes")
+}
+
+// ============================================================================================================================
+// find_incomplete_marbles() - marbles as older code left them, each missing something different
+// ============================================================================================================================
+func TestFindIncompleteMarbles(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.run(func() pb.Response {
+		stub.PutState("m0000000000002", []byte(`{"docType": "marble", "id": "m0000000000002", "color": "red", "owner": {"id": "o0000000000001", "username": "amy"}}`))
+		stub.PutState("m0000000000003", []byte(`{"docType": "marble", "id": "m0000000000003", "color": "", "owner": {"id": "o0000000000001", "company": "Alpha"}}`))
+		stub.PutState("m0000000000004", []byte(`{"docType": "marble", "id": "m0000000000004", "color": null, "owner": "o0000000000001"}`))
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	find := func(fields ...string) string {
+		var results []struct {
+			Id      string   `json:"id"`
+			Missing []string `json:"missing"`
+		}
+		must_decode(t, must_ok(t, stub.invoke(append([]string{"find_incomplete_marbles"}, fields...)...)), &results)
+		var got []string
+		for _, result := range results {
+			got = append(got, strings.TrimLeft(result.Id, "m0") + ":" + strings.Join(result.Missing, "+"))
+		}
+		return strings.Join(got, " ")
+	}
+	tests := []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"color"}, "3:color 4:color"},
+		{[]string{"owner.company"}, "2:owner.company 4:owner.company"},
+		{[]string{"color", "owner.company", "size"}, "2:owner.company+size 3:color+size 4:color+owner.company+size"},
+		{[]string{"id", "owner.id"}, "4:owner.id"},
+		{[]string{"lastModified"}, "2:lastModified 3:lastModified 4:lastModified"},
+	}
+	for _, test := range tests {
+		if got := find(test.fields...); got != test.want {
+			t.Fatalf("expected %v to find %q, got %q", test.fields, test.want, got)
+		}
+	}
+	must_fail(t, stub.invoke("find_incomplete_marbles"), "Expecting 1 or more")
+}
+
+// ============================================================================================================================
+// get_ledger_stats() - each stat over a known ledger, then with a scan cap
+// ============================================================================================================================
+func TestGetLedgerStats(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.owner(t, "o0000000000004", "dan", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000003", "Alpha")
+	stub.marble(t, "m0000000000004", "blue", 10, "o0000000000004", "Alpha")
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000001", "white", "Alpha"))
+	must_ok(t, stub.invoke("update_owner", "o0000000000002", "Alpha", "false", "none", "false"))
+	stub.run(func() pb.Response {
+		stub.DelState("o0000000000004")                             //orphans dan's marble
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	type LedgerStats struct {
+		Marbles         int            `json:"marbles"`
+		Owners          int            `json:"owners"`
+		OrphanedMarbles int            `json:"orphanedMarbles"`
+		DisabledOwners  int            `json:"disabledOwners"`
+		IndexEntries    map[string]int `json:"indexEntries"`
+		Capped          bool           `json:"capped"`
+	}
+	var stats LedgerStats
+	must_decode(t, must_ok(t, stub.invoke("get_ledger_stats")), &stats)
+	if stats.Marbles != 4 || stats.Owners != 3 || stats.OrphanedMarbles != 1 || stats.DisabledOwners != 1 || stats.Capped {
+		t.Fatalf("expected 4 marbles, 3 owners, 1 orphaned, 1 disabled, got %+v", stats)
+	}
+	if stats.IndexEntries["owner~id"] != 4 || stats.IndexEntries["color~id"] != 4 || stats.IndexEntries["secondary~id"] != 1 {
+		t.Fatalf("expected 4, 4 and 1 index entries, got %v", stats.IndexEntries)
+	}
+
+	// a cap of 2 stops every walk at 2, orphans are still looked up
+	stats = LedgerStats{}
+	must_decode(t, must_ok(t, stub.invoke("get_ledger_stats", "2")), &stats)
+	if stats.Marbles != 2 || stats.Owners != 2 || stats.OrphanedMarbles != 0 || stats.IndexEntries["owner~id"] != 2 || stats.IndexEntries["secondary~id"] != 1 || !stats.Capped {
+		t.Fatalf("expected every walk capped at 2, got %+v", stats)
+	}
+	must_fail(t, stub.invoke("get_ledger_stats", "-1"), "Scan cap")
+}
+
+// ============================================================================================================================
+// set_secondary_color() and queryMarblesBySecondaryColor() - only marbles with a secondary color are indexed
+// ============================================================================================================================
+func TestSecondaryColor(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "green", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000001", " White", "Alpha"))
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000002", "white", "Alpha"))
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000003", "", "Alpha"))
+
+	query := func(color string) string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("queryMarblesBySecondaryColor", color)), &marbles)
+		var got []string
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+	if got := query("WHITE"); got != "1,2" {
+		t.Fatalf("expected 1,2 to be white, got %q", got)
+	}
+	if marble := stub.get_marble(t, "m0000000000001"); marble.SecondaryColor != "white" || marble.Color != "red" {
+		t.Fatalf("expected red with white, got %+v", marble)
+	}
+
+	// changing and clearing it moves the index entry
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000001", "black", "Alpha"))
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000002", "", "Alpha"))
+	if got := query("white"); got != "" {
+		t.Fatalf("expected nothing white left, got %q", got)
+	}
+	if got := query("black"); got != "1" {
+		t.Fatalf("expected 1 to be black, got %q", got)
+	}
+	must_fail(t, stub.invoke("queryMarblesBySecondaryColor", ""), "non-empty")
+	indexed, _ := index_ids(stub, "secondary~id", []string{})
+	if strings.Join(indexed, ",") != "m0000000000001" {
+		t.Fatalf("expected one secondary~id entry, got %v", indexed)
+	}
+	if marble := stub.get_marble(t, "m0000000000002"); len(marble.SecondaryColor) != 0 {
+		t.Fatalf("expected the secondary color to be cleared, got %q", marble.SecondaryColor)
+	}
+}
+
+// ============================================================================================================================
+// get_top_owners() - most marbles first, ties to the lower owner id
+// ============================================================================================================================
+func TestGetTopOwners(t *testing.T) {
+	stub := new_test_stub(t, "")
+	counts := []int{3, 1, 3, 2, 0}
+	marbles := 0
+	for i, count := range counts {
+		owner_id := "o000000000000" + strconv.Itoa(i + 1)
+		stub.owner(t, owner_id, "user" + strconv.Itoa(i + 1), "Alpha")
+		for j := 0; j < count; j++ {
+			marbles++
+			stub.marble(t, "m00000000000" + strconv.Itoa(10 + marbles), "red", 10, owner_id, "Alpha")
+		}
+	}
+
+	top := func(k string) string {
+		var owners []OwnerCount
+		must_decode(t, must_ok(t, stub.invoke("get_top_owners", k)), &owners)
+		var got []string
+		for _, owner := range owners {
+			got = append(got, strings.TrimLeft(owner.OwnerId, "o0") + ":" + strconv.Itoa(owner.Count))
+		}
+		return strings.Join(got, " ")
+	}
+	tests := []struct {
+		k    string
+		want string
+	}{
+		{"1", "1:3"},
+		{"2", "1:3 3:3"},
+		{"3", "1:3 3:3 4:2"},
+		{"10", "1:3 3:3 4:2 2:1"},
+	}
+	for _, test := range tests {
+		if got := top(test.k); got != test.want {
+			t.Fatalf("expected the top %s to be %q, got %q", test.k, test.want, got)
+		}
+	}
+	must_fail(t, stub.invoke("get_top_owners", "0"), "K must be a number")
+}
+
+// ============================================================================================================================
+// draw_marble() - the tx id decides the winner, the same tx id always draws the same marble
+// ============================================================================================================================
+func TestDrawMarble(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	var ids []string
+	for i := 1; i <= 7; i++ {
+		id := "m000000000000" + strconv.Itoa(i)
+		color := "red"
+		if i % 2 == 0 {
+			color = "blue"
+		}
+		stub.marble(t, id, color, 10, "o0000000000001", "Alpha")
+		ids = append(ids, id)
+	}
+
+	draw := func(txId string, args ...string) Marble {
+		stub.MockTransactionStart(txId)
+		defer stub.MockTransactionEnd(txId)
+		var winner Marble
+		must_decode(t, must_ok(t, draw_marble(stub, args)), &winner)
+		return winner
+	}
+	winners := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		txId := "raffle" + strconv.Itoa(i)
+		winner := draw(txId)
+		for j := 0; j < 3; j++ {
+			if again := draw(txId); again.Id != winner.Id {
+				t.Fatalf("expected %s to always draw %s, got %s", txId, winner.Id, again.Id)
+			}
+		}
+		hash := sha256.Sum256([]byte(txId))                       //anyone can redo the draw
+		if want := ids[binary.BigEndian.Uint64(hash[:8]) % uint64(len(ids))]; winner.Id != want {
+			t.Fatalf("expected %s to draw %s, got %s", txId, want, winner.Id)
+		}
+		winners[winner.Id] = true
+
+		if blue := draw(txId, "Blue"); blue.Color != "blue" {
+			t.Fatalf("expected a blue winner, got %+v", blue)
+		}
+	}
+	if len(winners) < 2 {
+		t.Fatalf("expected different tx ids to draw different marbles, got %v", winners)
+	}
+	must_fail(t, stub.invoke("draw_marble", "green"), "No marbles are eligible")
+}
+
+// ============================================================================================================================
+// compare_owner_inventories() - overlapping and disjoint owners
+// ============================================================================================================================
+func TestCompareOwnerInventories(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "white", 35, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "blue", 35, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000005", "green", 16, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000006", "purple", 50, "o0000000000003", "Alpha")
+
+	type Attributes struct {
+		Colors []string `json:"colors"`
+		Sizes  []int    `json:"sizes"`
+	}
+	compare := func(a string, b string) string {
+		var comparison struct {
+			First  Attributes `json:"first"`
+			Second Attributes `json:"second"`
+			Shared Attributes `json:"shared"`
+		}
+		must_decode(t, must_ok(t, stub.invoke("compare_owner_inventories", a, b)), &comparison)
+		got := []string{}
+		for _, part := range []Attributes{comparison.First, comparison.Second, comparison.Shared} {
+			sizes := []string{}
+			for _, size := range part.Sizes {
+				sizes = append(sizes, strconv.Itoa(size))
+			}
+			got = append(got, strings.Join(part.Colors, ",") + "/" + strings.Join(sizes, ","))
+		}
+		return strings.Join(got, " ")
+	}
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"o0000000000001", "o0000000000002", "red,white/10,20 green/16 blue/35"},
+		{"o0000000000002", "o0000000000001", "green/16 red,white/10,20 blue/35"},
+		{"o0000000000001", "o0000000000003", "blue,red,white/10,20,35 purple/50 /"},
+		{"o0000000000001", "o0000000000001", "/ / blue,red,white/10,20,35"},
+	}
+	for _, test := range tests {
+		if got := compare(test.a, test.b); got != test.want {
+			t.Fatalf("expected %s vs %s to be %q, got %q", test.a, test.b, test.want, got)
+		}
+	}
+	must_fail(t, stub.invoke("compare_owner_inventories", "o0000000000001", "o0000000000009"), "Owner does not exist")
+}
+
+// ============================================================================================================================
+// set_insured_value() and get_total_insured_value() - admins set values, the totals add up per owner
+// ============================================================================================================================
+func TestInsuredValue(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000002", "Alpha")
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("set_insured_value", "m0000000000001", "500"), "not an admin")
+	if marble := stub.get_marble(t, "m0000000000001"); marble.InsuredValue != 0 || marble.InsuredValueSet != nil {
+		t.Fatalf("expected a non-admin to change nothing, got %+v", marble)
+	}
+
+	stub.as(t, "AdminMSP", "alice", nil)
+	must_ok(t, stub.invoke("set_insured_value", "m0000000000001", "500"))
+	must_ok(t, stub.invoke("set_insured_value", "m0000000000002", "250"))
+	must_ok(t, stub.invoke("set_insured_value", "m0000000000004", "100"))
+	must_fail(t, stub.invoke("set_insured_value", "m0000000000004", "-1"), "0 or more")
+	if marble := stub.get_marble(t, "m0000000000001"); marble.InsuredValue != 500 || marble.InsuredValueSet == nil || marble.InsuredValueSet.By != "AdminMSP/alice" {
+		t.Fatalf("expected 500 set by AdminMSP/alice, got %+v", marble)
+	}
+
+	var totals map[string]int64
+	must_decode(t, must_ok(t, stub.invoke("get_total_insured_value", "o0000000000001")), &totals)
+	if len(totals) != 1 || totals["o0000000000001"] != 750 {
+		t.Fatalf("expected amy's 750, m0000000000003 counting as 0, got %v", totals)
+	}
+	totals = nil
+	must_decode(t, must_ok(t, stub.invoke("get_total_insured_value", "o0000000000003")), &totals)
+	if len(totals) != 1 || totals["o0000000000003"] != 0 {
+		t.Fatalf("expected cat's 0, got %v", totals)
+	}
+	totals = nil
+	must_decode(t, must_ok(t, stub.invoke("get_total_insured_value")), &totals)
+	if len(totals) != 2 || totals["o0000000000001"] != 750 || totals["o0000000000002"] != 100 {
+		t.Fatalf("expected 750 and 100, got %v", totals)
+	}
+}
+
+// ============================================================================================================================
+// get_marbles_by_company() - two companies, an owner from before the index, and owners with no company
+// ============================================================================================================================
+func TestGetMarblesByCompany(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000002", "Beta")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	stub.run(func() pb.Response {
+		stub.PutState("o0000000000003", []byte(`{"docType": "marble_owner", "id": "o0000000000003", "username": "cat", "company": "Beta"}`))
+		stub.PutState("o0000000000004", []byte(`{"docType": "marble_owner", "id": "o0000000000004", "username": "dan"}`))
+		stub.PutState("m0000000000004", []byte(`{"docType": "marble", "id": "m0000000000004", "color": "red", "owner": {"id": "o0000000000003"}}`))
+		stub.PutState("m0000000000005", []byte(`{"docType": "marble", "id": "m0000000000005", "color": "red", "owner": {"id": "o0000000000004"}}`))
+		stub.PutState("m0000000000006", []byte(`{"docType": "marble", "id": "m0000000000006", "color": "red", "owner": {"id": "o0000000000009"}}`))
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	var groups map[string][]Marble
+	must_decode(t, must_ok(t, stub.invoke("get_marbles_by_company")), &groups)
+	got := []string{}
+	for company, marbles := range groups {
+		ids := []string{}
+		for _, marble := range marbles {
+			ids = append(ids, strings.TrimLeft(marble.Id, "m0"))
+		}
+		got = append(got, company + ":" + strings.Join(ids, ","))
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != "Alpha:1,3 Beta:2,4 unknown:5,6" {
+		t.Fatalf("expected Alpha:1,3 Beta:2,4 unknown:5,6, got %q", strings.Join(got, " "))
+	}
+}
+
+// ============================================================================================================================
+// Recommended Marbles - one marble in each color the owner is missing, skipping hidden ones
+// ============================================================================================================================
+func TestGetRecommendedMarbles(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000002", "Alpha")
+	must_ok(t, stub.call(init_marble, "m0000000000003", "blue", "10", "o0000000000002", "Alpha", test_start.Add(time.Hour).Format(time_format)))
+	stub.marble(t, "m0000000000004", "blue", 10, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000005", "green", 10, "o0000000000002", "Alpha")
+	stub.now = test_start.Add(2 * time.Hour)                       //m0000000000003 has expired
+
+	ids := func(args ...string) []string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke(append([]string{"get_recommended_marbles"}, args...)...)), &marbles)
+		found := []string{}
+		for _, marble := range marbles {
+			found = append(found, marble.Id)
+		}
+		return found
+	}
+
+	if got := ids("o0000000000001"); strings.Join(got, ",") != "m0000000000004,m0000000000005" {
+		t.Fatalf("expected amy to get the unexpired blue and the green, got %v", got)
+	}
+	if got := ids("o0000000000001", "1"); strings.Join(got, ",") != "m0000000000004" {
+		t.Fatalf("expected the limit to stop at one, got %v", got)
+	}
+	if got := ids("o0000000000002"); len(got) != 0 {
+		t.Fatalf("expected bob to have every color already, got %v", got)
+	}
+	must_fail(t, stub.invoke("get_recommended_marbles", "o0000000000009"), "does not exist")
+	must_fail(t, stub.invoke("get_recommended_marbles", "o0000000000001", "0"), "Limit must be")
+}
+
+// ============================================================================================================================
+// Query Marbles By Tag And Color - only marbles with both, hidden ones left out
+// ============================================================================================================================
+func TestQueryMarblesByTagAndColor(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.call(init_marble, "m0000000000006", "red", "10", "o0000000000001", "Alpha", test_start.Add(time.Hour).Format(time_format)))
+	must_ok(t, stub.invoke("tag_marbles_by_query", "red", "promo", "10"))
+	must_ok(t, stub.invoke("tag_marbles_by_query", "blue", "promo", "10"))
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000005", "green", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("tag_marbles_by_query", "red", "sale", "10"))
+	stub.now = test_start.Add(2 * time.Hour)                       //m0000000000006 has expired
+
+	tests := []struct {
+		tag   string
+		color string
+		want  string
+	}{
+		{"promo", "red", "1,3"},
+		{" Promo", "RED", "1,3"},
+		{"promo", "blue", "2"},
+		{"sale", "red", "1,3,4"},
+		{"sale", "blue", ""},
+		{"promo", "green", ""},
+		{"clearance", "red", ""},
+	}
+	for _, test := range tests {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("queryMarblesByTagAndColor", test.tag, test.color)), &marbles)
+		got := []string{}
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Fatalf("expected %s and %s to find %q, got %q", test.tag, test.color, test.want, strings.Join(got, ","))
+		}
+	}
+
+	var projected []map[string]interface{}
+	must_decode(t, must_ok(t, stub.invoke("queryMarblesByTagAndColor", "promo", "blue", "id,color")), &projected)
+	if len(projected) != 1 || len(projected[0]) != 2 || projected[0]["id"] != "m0000000000002" {
+		t.Fatalf("expected just the id and color of m0000000000002, got %v", projected)
+	}
+	must_fail(t, stub.invoke("queryMarblesByTagAndColor", " ", "red"), "non-empty")
+}
+
+// ============================================================================================================================
+// getHistoryForMarblePaged() - a long history comes back a page at a time, every entry once and in order
+// ============================================================================================================================
+func TestGetHistoryForMarblePaged(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	for i := 0; i < 11; i++ {
+		owner_id := "o0000000000002"
+		if i % 2 == 1 {
+			owner_id = "o0000000000001"
+		}
+		must_ok(t, stub.invoke("set_owner", "m0000000000001", owner_id, "Alpha"))
+	}
+	must_ok(t, stub.invoke("delete_marble", "m0000000000001", "Alpha"))
+	history := stub.history["m0000000000001"]
+	if len(history) != 13 {
+		t.Fatalf("expected 13 history entries to page through, got %d", len(history))
+	}
+
+	type Line struct {
+		TxId  string          `json:"txId"`
+		Value json.RawMessage `json:"value"`
+		More  bool            `json:"more"`
+		Skip  int             `json:"skip"`
+	}
+	page := func(args ...string) ([]Line, Line) {
+		res := stub.invoke(append([]string{"getHistoryForMarblePaged"}, args...)...)
+		if res.Status >= 400 || res.Message != ndjson_message {
+			t.Fatalf("expected an ndjson page, got %d - %s", res.Status, res.Message)
+		}
+		lines := []Line{}
+		for _, text := range strings.Split(strings.TrimSuffix(string(res.Payload), "\n"), "\n") {
+			var line Line
+			must_decode(t, []byte(text), &line)
+			lines = append(lines, line)
+		}
+		return lines[:len(lines) - 1], lines[len(lines) - 1]
+	}
+
+	seen := []Line{}
+	skip := "0"
+	for pages := 1; ; pages++ {
+		entries, continuation := page("m0000000000001", "5", skip)
+		seen = append(seen, entries...)
+		if continuation.Skip != len(seen) {
+			t.Fatalf("expected to be told to skip %d next, got %d", len(seen), continuation.Skip)
+		}
+		if !continuation.More {
+			if pages != 3 || len(entries) != 3 {
+				t.Fatalf("expected the 3rd page to be the last with 3 entries, got page %d with %d", pages, len(entries))
+			}
+			break
+		}
+		if len(entries) != 5 {
+			t.Fatalf("expected a full page of 5 before the last, got %d", len(entries))
+		}
+		skip = strconv.Itoa(continuation.Skip)
+	}
+	for i, entry := range seen {
+		if entry.TxId != history[i].txId {
+			t.Fatalf("expected entry %d to be from %s, got %s", i, history[i].txId, entry.TxId)
+		}
+	}
+	var marble Marble
+	must_decode(t, seen[1].Value, &marble)
+	if marble.Owner.Id != "o0000000000002" || string(seen[12].Value) != "null" {
+		t.Fatalf("expected the marble as it was, and null once deleted, got %s and %s", string(seen[1].Value), string(seen[12].Value))
+	}
+
+	// a page that ends right at the end has nothing more
+	entries, continuation := page("m0000000000001", "5", "8")
+	if len(entries) != 5 || continuation.More || continuation.Skip != 13 {
+		t.Fatalf("expected the last 5 and no more, got %d and %+v", len(entries), continuation)
+	}
+	entries, continuation = page("m0000000000001", "5", "20")
+	if len(entries) != 0 || continuation.More || continuation.Skip != 20 {
+		t.Fatalf("expected nothing past the end, got %d and %+v", len(entries), continuation)
+	}
+
+	must_fail(t, stub.invoke("getHistoryForMarblePaged", "m0000000000001", "0"), "Max entries")
+	must_fail(t, stub.invoke("getHistoryForMarblePaged", "m0000000000001", "5", "-1"), "Skip must be")
+	must_fail(t, stub.invoke("getHistoryForMarblePaged", "m0000000000001", "5", strconv.Itoa(max_tx_count)), "Skip plus max entries")
+}
+
+// ============================================================================================================================
+// Get State Snapshot Hash - the same state gives the same digest, any change to a marble or owner changes it
+// ============================================================================================================================
+func TestGetStateSnapshotHash(t *testing.T) {
+	type Snapshot struct {
+		Algorithm string `json:"algorithm"`
+		Digest    string `json:"digest"`
+		Marbles   int    `json:"marbles"`
+		Owners    int    `json:"owners"`
+	}
+	snapshot := func(stub *test_stub, args ...string) Snapshot {
+		var result Snapshot
+		must_decode(t, must_ok(t, stub.invoke(append([]string{"get_state_snapshot_hash"}, args...)...)), &result)
+		return result
+	}
+	setup := func() *test_stub {
+		stub := new_test_stub(t, "")
+		stub.owner(t, "o0000000000001", "amy", "Alpha")
+		stub.owner(t, "o0000000000002", "bob", "Alpha")
+		stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+		stub.marble(t, "m0000000000002", "blue", 20, "o0000000000002", "Alpha")
+		return stub
+	}
+
+	first, second := setup(), setup()
+	a, b := snapshot(first), snapshot(second)
+	if a != b || a.Algorithm != "sha256" || len(a.Digest) != 64 || a.Marbles != 2 || a.Owners != 2 {
+		t.Fatalf("expected identical states to hash the same, got %+v and %+v", a, b)
+	}
+	if again := snapshot(first); again != a {
+		t.Fatalf("expected reading to leave the hash alone, got %+v then %+v", a, again)
+	}
+
+	// the digest is each key and value with its length in front, marbles then owners
+	digest := sha256.New()
+	for _, key := range []string{"m0000000000001", "m0000000000002", "o0000000000001", "o0000000000002"} {
+		var length [8]byte
+		value := first.State[key]
+		binary.BigEndian.PutUint64(length[:], uint64(len(key)))
+		digest.Write(length[:])
+		digest.Write([]byte(key))
+		binary.BigEndian.PutUint64(length[:], uint64(len(value)))
+		digest.Write(length[:])
+		digest.Write(value)
+	}
+	if want := hex.EncodeToString(digest.Sum(nil)); a.Digest != want {
+		t.Fatalf("expected digest %s, got %s", want, a.Digest)
+	}
+
+	// other keys don't count, one marble change does
+	first.set(t, "s0000000000001", "favorites", "o0000000000001", "Alpha")
+	if got := snapshot(first); got != a {
+		t.Fatalf("expected a set to leave the hash alone, got %+v", got)
+	}
+	must_ok(t, first.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	changed := snapshot(first)
+	if changed.Digest == a.Digest || changed.Marbles != 2 || changed.Owners != 2 {
+		t.Fatalf("expected a transfer to change the hash, got %+v", changed)
+	}
+	must_ok(t, second.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	if got := snapshot(second); got != changed {
+		t.Fatalf("expected the same transfer to hash the same, got %+v and %+v", changed, got)
+	}
+
+	if got := snapshot(first, "SHA512"); got.Algorithm != "sha512" || len(got.Digest) != 128 {
+		t.Fatalf("expected a sha512 digest, got %+v", got)
+	}
+	must_fail(t, first.invoke("get_state_snapshot_hash", "md5"), "Unknown hash algorithm")
+}
+
+// ============================================================================================================================
+// Get Set Marbles For Owner - a set split between two owners, each only gets their own part
+// ============================================================================================================================
+func TestGetSetMarblesForOwner(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000002", "Alpha")
+	stub.marble(t, "m0000000000005", "red", 10, "o0000000000001", "Alpha")    //amy's, not in the set
+	stub.set(t, "s0000000000001", "collection", "o0000000000001", "Alpha")
+	for i := 1; i <= 4; i++ {
+		must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m000000000000" + strconv.Itoa(i), "Alpha"))
+	}
+
+	ids := func(owner_id string) string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("get_set_marbles_for_owner", "s0000000000001", owner_id)), &marbles)
+		got := []string{}
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+	if got := ids("o0000000000001"); got != "1,3" {
+		t.Fatalf("expected amy's part to be 1,3, got %q", got)
+	}
+	if got := ids("o0000000000002"); got != "2,4" {
+		t.Fatalf("expected bob's part to be 2,4, got %q", got)
+	}
+	if got := ids("o0000000000003"); got != "" {
+		t.Fatalf("expected cat to have none of it, got %q", got)
+	}
+
+	// follows the marble to its new owner
+	must_ok(t, stub.invoke("set_owner", "m0000000000003", "o0000000000003", "Alpha"))
+	if got := ids("o0000000000001") + "|" + ids("o0000000000003"); got != "1|3" {
+		t.Fatalf("expected 3 to move from amy to cat, got %q", got)
+	}
+
+	must_fail(t, stub.invoke("get_set_marbles_for_owner", "s0000000000009", "o0000000000001"), "")
+	must_fail(t, stub.invoke("get_set_marbles_for_owner", "s0000000000001", "o0000000000009"), "does not exist")
+}
+
+// ============================================================================================================================
+// Find Stuck Marbles - each kind of pending state that has sat past the threshold is listed under its own category
+// ============================================================================================================================
+func TestFindStuckMarbles(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	for i := 1; i <= 8; i++ {
+		stub.marble(t, "m000000000000" + strconv.Itoa(i), "red", 10, "o0000000000001", "Alpha")
+	}
+
+	// seed the pending states straight onto the marbles, each in its own tx
+	write := func(f func(stub shim.ChaincodeStubInterface) error) {
+		must_ok(t, stub.call(func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+			err := f(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success(nil)
+		}))
+	}
+	seed := func(id string, change func(*Marble)) {
+		write(func(stub shim.ChaincodeStubInterface) error {
+			marble, err := get_marble(stub, id)
+			if err != nil {
+				return err
+			}
+			change(&marble)
+			return put_marble(stub, marble)
+		})
+	}
+	seed("m0000000000001", func(m *Marble) { m.Gift = &Gift{CodeHash: "abc"} })
+	seed("m0000000000002", func(m *Marble) { m.Pool = &Pool{Attribute: "department", Value: "sales"} })
+	seed("m0000000000003", func(m *Marble) { m.Collateral = &Collateral{LoanId: "loan1", LenderId: "o0000000000001"} })
+	seed("m0000000000004", func(m *Marble) { m.TransferAttempts = &TransferAttempts{Count: 2, LastError: "timeout"} })
+	write(func(stub shim.ChaincodeStubInterface) error {
+		return put_index(stub, "txnqueue~marble~seq", []string{"m0000000000005", "000000001"})
+	})
+	seed("m0000000000006", func(m *Marble) { m.Gift = &Gift{CodeHash: "def"}; m.Collateral = &Collateral{LoanId: "loan2"} })
+	write(func(stub shim.ChaincodeStubInterface) error {
+		return stub.PutState("m0000000000009", []byte(`{"docType": "marble", "id": "m0000000000009", "pool": {"attribute": "a", "value": "b"}}`))
+	})
+	stub.now = test_start.Add(47 * time.Hour)                      //m0000000000008 is pending, but only for an hour
+	seed("m0000000000008", func(m *Marble) { m.Pool = &Pool{Attribute: "department", Value: "sales"} })
+	stub.now = test_start.Add(48 * time.Hour)
+
+	type StuckReport struct {
+		Stuck    map[string][]string `json:"stuck"`
+		Bookmark string              `json:"bookmark"`
+	}
+	want := map[string]string{
+		"gift":            "1,6",
+		"pool":            "2,9",                                  //m0000000000009 is from before lastModified
+		"collateral":      "3,6",
+		"transfer_retry":  "4",
+		"queued_transfer": "5",
+	}
+	check := func(when string, stuck map[string][]string, want map[string]string) {
+		if len(stuck) != len(want) {
+			t.Fatalf("expected %d categories %s, got %v", len(want), when, stuck)
+		}
+		for category, ids := range stuck {
+			if got := strings.Replace(strings.Join(ids, ","), "m000000000000", "", -1); got != want[category] {
+				t.Fatalf("expected %s to be %q %s, got %q", category, want[category], when, got)
+			}
+		}
+	}
+
+	var report StuckReport
+	must_decode(t, must_ok(t, stub.invoke("find_stuck_marbles", "86400", "", "100")), &report)
+	if len(report.Bookmark) != 0 {
+		t.Fatalf("expected one page to cover it, got bookmark %q", report.Bookmark)
+	}
+	check("in one page", report.Stuck, want)
+
+	// page by page comes to the same
+	stuck := map[string][]string{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		report = StuckReport{}
+		must_decode(t, must_ok(t, stub.invoke("find_stuck_marbles", "86400", bookmark, "2")), &report)
+		for category, ids := range report.Stuck {
+			stuck[category] = append(stuck[category], ids...)
+		}
+		if bookmark = report.Bookmark; len(bookmark) == 0 {
+			break
+		}
+		if pages > 5 {
+			t.Fatalf("expected 9 marbles to take 5 pages of 2, still going at %q", bookmark)
+		}
+	}
+	check("paged", stuck, want)
+
+	// a short enough threshold catches the recent one too
+	report = StuckReport{}
+	must_decode(t, must_ok(t, stub.invoke("find_stuck_marbles", "3600", "", "100")), &report)
+	want["pool"] = "2,8,9"
+	check("with a 1 hour threshold", report.Stuck, want)
+
+	must_fail(t, stub.invoke("find_stuck_marbles", "-1", "", "100"), "Threshold must be")
+	must_fail(t, stub.invoke("find_stuck_marbles", "86400", "", "0"), "Page size must be")
+}
+
+// ============================================================================================================================
+// Get Marbles By Percentile - over sizes 1 to 20 the top decile is 19 and 20, ties and hidden marbles handled
+// ============================================================================================================================
+func TestGetMarblesByPercentile(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	for size := 20; size >= 1; size-- {                            //key order isn't size order
+		stub.marble(t, fmt.Sprintf("m%013d", 21 - size), "red", size, "o0000000000001", "Alpha")
+	}
+	must_ok(t, stub.call(init_marble, "m0000000000099", "red", "100", "o0000000000001", "Alpha", test_start.Add(time.Hour).Format(time_format)))
+	stub.now = test_start.Add(2 * time.Hour)                       //the biggest has expired, it isn't ranked
+
+	type PercentileResult struct {
+		MinSize int      `json:"minSize"`
+		MaxSize int      `json:"maxSize"`
+		Capped  bool     `json:"capped"`
+		Marbles []Marble `json:"marbles"`
+	}
+	percentile := func(from string, to string) (PercentileResult, string) {
+		var result PercentileResult
+		must_decode(t, must_ok(t, stub.invoke("get_marbles_by_percentile", from, to)), &result)
+		sizes := []int{}
+		for _, marble := range result.Marbles {
+			sizes = append(sizes, marble.Size)
+		}
+		sort.Ints(sizes)
+		return result, strings.Trim(fmt.Sprint(sizes), "[]")
+	}
+
+	tests := []struct {
+		from  string
+		to    string
+		min   int
+		max   int
+		sizes string
+	}{
+		{"90", "100", 19, 20, "19 20"},
+		{"0", "10", 1, 2, "1 2"},
+		{"45", "55", 10, 11, "10 11"},
+		{"0", "100", 1, 20, "1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20"},
+		{"99", "100", 20, 20, "20"},
+	}
+	for _, test := range tests {
+		result, sizes := percentile(test.from, test.to)
+		if result.MinSize != test.min || result.MaxSize != test.max || sizes != test.sizes || result.Capped {
+			t.Fatalf("expected %s-%s to be sizes %d to %d (%s), got %d to %d (%s)", test.from, test.to, test.min, test.max, test.sizes, result.MinSize, result.MaxSize, sizes)
+		}
+	}
+
+	// a tie at the threshold comes back whole
+	stub.marble(t, "m0000000000021", "red", 19, "o0000000000001", "Alpha")
+	if result, sizes := percentile("90", "100"); result.MinSize != 19 || sizes != "19 19 20" {
+		t.Fatalf("expected both 19s and the 20, got %d and %s", result.MinSize, sizes)
+	}
+
+	must_fail(t, stub.invoke("get_marbles_by_percentile", "90", "90"), "Percentiles must satisfy")
+	must_fail(t, stub.invoke("get_marbles_by_percentile", "-1", "10"), "Percentiles must satisfy")
+	must_fail(t, stub.invoke("get_marbles_by_percentile", "90", "101"), "Percentiles must satisfy")
+	must_fail(t, stub.invoke("get_marbles_by_percentile", "ninety", "100"), "must be a number")
+}
+
+// ============================================================================================================================
+// Find Never Transferred - marbles still with their first owner are listed, a marble that moved once is not
+// ============================================================================================================================
+func TestFindNeverTransferred(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))   //to its own owner isn't a transfer
+	must_ok(t, stub.invoke("set_owner", "m0000000000002", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000003", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000003", "o0000000000001", "Alpha"))   //back again still moved
+
+	// marbles from before transferCount, only their history can tell
+	legacy := func(id string, owner_id string) {
+		must_ok(t, stub.call(func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+			err := stub.PutState(id, []byte(`{"docType": "marble", "id": "` + id + `", "color": "red", "size": 10, "owner": {"id": "` + owner_id + `"}}`))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success(nil)
+		}))
+	}
+	legacy("m0000000000004", "o0000000000001")
+	legacy("m0000000000004", "o0000000000001")                      //rewritten, same owner
+	legacy("m0000000000005", "o0000000000001")
+	legacy("m0000000000005", "o0000000000002")
+
+	type NeverTransferred struct {
+		Marbles  []string `json:"marbles"`
+		Bookmark string   `json:"bookmark"`
+	}
+	var result NeverTransferred
+	must_decode(t, must_ok(t, stub.invoke("find_never_transferred", "", "10")), &result)
+	if strings.Join(result.Marbles, ",") != "m0000000000001,m0000000000004" || len(result.Bookmark) != 0 {
+		t.Fatalf("expected 1 and 4 in one page, got %+v", result)
+	}
+
+	found := []string{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		result = NeverTransferred{}
+		must_decode(t, must_ok(t, stub.invoke("find_never_transferred", bookmark, "2")), &result)
+		found = append(found, result.Marbles...)
+		if bookmark = result.Bookmark; len(bookmark) == 0 {
+			break
+		}
+		if pages > 3 {
+			t.Fatalf("expected 5 marbles to take 3 pages of 2, still going at %q", bookmark)
+		}
+	}
+	if strings.Join(found, ",") != "m0000000000001,m0000000000004" {
+		t.Fatalf("expected paging to find 1 and 4, got %v", found)
+	}
+	must_fail(t, stub.invoke("find_never_transferred", "", "0"), "Page size must be")
+}
+
+// ============================================================================================================================
+// Get Audit Trail - a marble created, recolored and transferred reads back as one sentence per change
+// ============================================================================================================================
+func TestGetAuditTrail(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.now = test_start.Add(time.Hour)
+	must_ok(t, stub.invoke("repaint_marbles_by_color", "red", "blue", "10"))
+	stub.now = test_start.Add(2 * time.Hour)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	stub.now = test_start.Add(3 * time.Hour)
+	must_ok(t, stub.invoke("tag_marbles_by_query", "blue", "promo", "10"))
+	must_ok(t, stub.invoke("delete_marble", "m0000000000001", "Alpha"))
+
+	type AuditLine struct {
+		TxId string `json:"txId"`
+		At   string `json:"at,omitempty"`
+		Text string `json:"text"`
+	}
+	var trail []AuditLine
+	must_decode(t, must_ok(t, stub.invoke("get_audit_trail", "m0000000000001")), &trail)
+	history := stub.history["m0000000000001"]
+	at := func(d time.Duration) string { return test_start.Add(d).Format(time_format) }
+	want := []AuditLine{
+		{history[0].txId, at(0), "Created for amy, red, size 10"},
+		{history[1].txId, at(time.Hour), "Color changed from red to blue"},
+		{history[2].txId, at(2 * time.Hour), "Transferred from amy to bob"},
+		{history[3].txId, at(3 * time.Hour), "Tagged promo"},
+		{history[4].txId, "", "Deleted"},
+	}
+	if len(trail) != len(want) {
+		t.Fatalf("expected %d lines, got %+v", len(want), trail)
+	}
+	for i := range want {
+		if trail[i] != want[i] {
+			t.Fatalf("expected line %d to be %+v, got %+v", i, want[i], trail[i])
+		}
+	}
+
+	must_decode(t, must_ok(t, stub.invoke("get_audit_trail", "m0000000000009")), &trail)
+	if len(trail) != 0 {
+		t.Fatalf("expected no trail for a marble that never was, got %+v", trail)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Demo Data - a few owners and marbles so a fresh demo network has something to show, written by Init() when the config
+// has "seedDemo": true. Each row is the args to init_owner() / init_marble().
+// ============================================================================================================================
+const demo_seed_key = "marbles_demo_seeded"
+
+var demo_owners = [][]string{
+	{"o0000000000001", "amy", "United Marbles"},
+	{"o0000000000002", "alice", "United Marbles"},
+	{"o0000000000003", "ava", "Marble Market"},
+}
+
+var demo_marbles = [][]string{
+	{"m0000000000001", "blue", "35", "o0000000000001", "United Marbles"},
+	{"m0000000000002", "red", "16", "o0000000000001", "United Marbles"},
+	{"m0000000000003", "green", "35", "o0000000000002", "United Marbles"},
+	{"m0000000000004", "purple", "16", "o0000000000003", "Marble Market"},
+	{"m0000000000005", "white", "35", "o0000000000003", "Marble Market"},
+}
+
+// ============================================================================================================================
+// Seed Demo Data - write the demo owners and marbles through the normal init functions, once
+//
+// A marker key records that it ran, so a chaincode upgrade that runs Init() again doesn't fail on the existing ids.
+// init_marble() reads back the owner init_owner() just wrote, which GetState() in the same tx won't return, so the
+// seeding runs on a seed_stub that will.
+// ============================================================================================================================
+func seed_demo_data(stub shim.ChaincodeStubInterface) error {
+	fmt.Println("starting seed_demo_data")
+	stub = &seed_stub{ChaincodeStubInterface: stub, writes: map[string][]byte{}}
+
+	marker, err := stub.GetState(demo_seed_key)
+	if err != nil {
+		return err
+	}
+	if marker != nil {
+		fmt.Println("- demo data already seeded")
+		return nil
+	}
+
+	for _, args := range demo_owners {
+		res := init_owner(stub, args)
+		if res.Status >= 400 {                        //shim.Error() uses 500
+			return errors.New("Failed to seed demo owner " + args[0] + " - " + res.Message)
+		}
+	}
+	for _, args := range demo_marbles {
+		res := init_marble(stub, args)
+		if res.Status >= 400 {                        //shim.Error() uses 500
+			return errors.New("Failed to seed demo marble " + args[0] + " - " + res.Message)
+		}
+	}
+
+	err = stub.PutState(demo_seed_key, []byte("true"))
+	if err != nil {
+		return err
+	}
+	fmt.Println("- end seed_demo_data")
+	return nil
+}
+
+// ============================================================================================================================
+// Seed Stub - GetState() returns what this stub already wrote, for seeding a lot of related records in one tx
+//
+// Only plain key reads see the writes, range and composite key queries still only see what is committed.
+// ============================================================================================================================
+type seed_stub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte                          //key -> value written, nil if deleted
+}
+
+func (s *seed_stub) GetState(key string) ([]byte, error) {
+	value, written := s.writes[key]
+	if written {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *seed_stub) PutState(key string, value []byte) error {
+	err := s.ChaincodeStubInterface.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *seed_stub) DelState(key string) error {
+	err := s.ChaincodeStubInterface.DelState(key)
+	if err != nil {
+		return err
+	}
+	s.writes[key] = nil
+	return nil
+}
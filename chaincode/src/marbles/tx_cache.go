@@ -0,0 +1,117 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Tx Cache - read your own writes, for the few keys a tx may update more than once
+//
+// GetState() in a tx returns the committed value, never what the same tx already wrote with PutState(). A tx that bumps
+// one counter or balance twice would keep only the last bump. Writes made with tx_put_state() are remembered by tx id, and
+// tx_get_state() returns them, until Invoke() returns and forget_tx() drops them.
+// ============================================================================================================================
+var tx_writes = map[string]map[string][]byte{}                      //tx id -> key -> value written in that tx, nil if deleted
+var tx_writes_lock sync.Mutex                                       //the shim runs txs concurrently
+
+func tx_get_state_as(stub shim.ChaincodeStubInterface, key string, out interface{}) (bool, error) {
+	tx_writes_lock.Lock()
+	valAsBytes, cached := tx_writes[stub.GetTxID()][key]
+	tx_writes_lock.Unlock()
+	if !cached {
+		return get_state_as(stub, key, out)
+	}
+	if valAsBytes == nil {                                          //this tx deleted it
+		return false, nil
+	}
+	err := json.Unmarshal(valAsBytes, out)
+	if err != nil {
+		return true, errors.New("Failed to decode state for " + key + " - " + err.Error())
+	}
+	return true, nil
+}
+
+func tx_put_state(stub shim.ChaincodeStubInterface, key string, value []byte) error {
+	err := stub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	remember_tx_write(stub.GetTxID(), key, value)
+	return nil
+}
+
+func tx_del_state(stub shim.ChaincodeStubInterface, key string) error {
+	err := stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	remember_tx_write(stub.GetTxID(), key, nil)
+	return nil
+}
+
+func remember_tx_write(txId string, key string, value []byte) {
+	tx_writes_lock.Lock()
+	defer tx_writes_lock.Unlock()
+	if tx_writes[txId] == nil {
+		tx_writes[txId] = map[string][]byte{}
+	}
+	tx_writes[txId][key] = value
+}
+
+// ============================================================================================================================
+// Tx Company Counts - how many marbles each company gained (or lost) earlier in a tx
+//
+// check_company_cap() counts the company's owner~id entries, and those don't show what the same tx already moved. A tx
+// that hands out several marbles adds its own running total on top, see add_tx_company_count().
+// ============================================================================================================================
+var tx_company_counts = map[string]map[string]int{}                 //tx id -> company -> marbles gained in that tx
+
+func tx_company_count(stub shim.ChaincodeStubInterface, company string) int {
+	tx_writes_lock.Lock()
+	defer tx_writes_lock.Unlock()
+	return tx_company_counts[stub.GetTxID()][company]
+}
+
+func add_tx_company_count(stub shim.ChaincodeStubInterface, company string, delta int) {
+	tx_writes_lock.Lock()
+	defer tx_writes_lock.Unlock()
+	txId := stub.GetTxID()
+	if tx_company_counts[txId] == nil {
+		tx_company_counts[txId] = map[string]int{}
+	}
+	tx_company_counts[txId][company] += delta
+}
+
+// ============================================================================================================================
+// Forget Tx - drop what a tx wrote from memory, Init() and Invoke() defer this
+// ============================================================================================================================
+func forget_tx(txId string) {
+	tx_writes_lock.Lock()
+	delete(tx_writes, txId)
+	delete(tx_company_counts, txId)
+	tx_writes_lock.Unlock()
+}
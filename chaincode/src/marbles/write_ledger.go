@@ -20,20 +20,54 @@ under the License.
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+const max_comment_length = 280                              //longest comment text allowed
+const max_comments_per_marble = 100                        //longest comment thread allowed
+const max_description_length = 280                         //longest set description allowed
+const max_message_length = 280                             //longest message text allowed
+const max_inbox_size = 100                                  //most messages an owner can receive
+const max_reports_per_marble = 100                          //most condition reports a marble can have
+const inspector_attribute = "marbles.inspector"             //cert attribute naming the inspector, see add_condition_report
+const max_transfer_attempts = 5                             //failed transfers before a marble needs review
+const transfer_retry_seconds = 30                           //wait after the first failure, doubled each time after
+const max_set_depth = 16                                    //deepest set nesting add_set_to_set will walk
+const max_memo_length = 140                                //longest transfer memo allowed
+const max_purge_batch = 100                                //most marbles delete_expired_marbles will remove in one tx
+const max_page_size = 200                                  //most marbles a paged admin function will touch in one tx
+
+var contact_methods = map[string]bool{"email": true, "none": true}  //allowed Owner.ContactMethod values
+
+// keys the chaincode keeps for itself, write() can't touch them or any composite key (indexes, counts, offers, ...)
+var reserved_keys = map[string]bool{config_key: true, demo_seed_key: true}
+
 // ============================================================================================================================
 // write() - genric write variable into ledger
 // 
 // Shows Off PutState() - writting a key/value into the ledger
 //
+// Reserved keys are refused, see reserved_keys. The config holds the admin list, anyone able to write it could make
+// themselves admin.
+//
 // Inputs - Array of strings
 //    0   ,    1
 //   key  ,  value
@@ -56,6 +90,9 @@ func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	key = args[0]                                   //rename for funsies
 	value = args[1]
+	if reserved_keys[key] || strings.ContainsRune(key, 0) {   //composite keys are split on \x00
+		return shim.Error("Key " + strconv.Quote(key) + " is reserved")
+	}
 	err = stub.PutState(key, []byte(value))         //write the variable into the ledger
 	if err != nil {
 		return shim.Error(err.Error())
@@ -70,16 +107,19 @@ func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // 
 // Shows Off DelState() - "removing"" a key/value from the ledger
 //
+// Pass the owner id you expect the marble to have and the delete only goes through if it still does, so a marble that
+// changed hands since you last looked isn't removed by mistake.
+//
 // Inputs - Array of strings
-//      0      ,         1
-//     id      ,  authed_by_company
-// "m999999999", "united marbles"
+//      0      ,         1          ,         2
+//     id      ,  authed_by_company , expected owner id (optional)
+// "m999999999", "united marbles"   , "o9999999999999"
 // ============================================================================================================================
 func delete_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	fmt.Println("starting delete_marble")
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
 	}
 
 	// input sanitation
@@ -103,48 +143,258 @@ func delete_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion for '" + marble.Owner.Company + "'.")
 	}
 
+	// check the owner is who the caller thinks it is
+	if len(args) == 3 && marble.Owner.Id != args[2] {
+		return shim.Error("Conflict - marble " + id + " is owned by '" + marble.Owner.Id + "', not '" + args[2] + "'. Not deleted.")
+	}
+
 	// remove the marble
-	err = stub.DelState(id)                                                 //remove the key from chaincode state
+	err = remove_marble(stub, marble)
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return shim.Error(err.Error())
 	}
 
 	fmt.Println("- end delete_marble")
 	return shim.Success(nil)
 }
 
+// ============================================================================================================================
+// delete_marble_admin() - admin only, remove a marble without any owner or company checks
+//
+// Inputs - Array of strings
+//      0
+//     id
+// "m999999999"
+// ============================================================================================================================
+func delete_marble_admin(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
+	fmt.Println("starting delete_marble_admin")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// get the marble
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// remove the marble
+	err = remove_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end delete_marble_admin")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Put Marble - write a marble back to the ledger, stamping lastModified with the tx time
+// ============================================================================================================================
+func put_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return err
+	}
+	marble.LastModified = txTime.Format(time_format)
+	marbleAsBytes, _ := json.Marshal(marble)                               //convert to array of bytes
+	return stub.PutState(marble.Id, marbleAsBytes)                         //store marble with id as key
+}
+
+// ============================================================================================================================
+// Remove Marble - delete a marble and everything hanging off of it (index entries, set memberships, queue, comments)
+// ============================================================================================================================
+func remove_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	err := check_not_collateral(marble)
+	if err != nil {
+		return err
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		return err
+	}
+
+	err = stub.DelState(marble.Id)                                         //remove the key from chaincode state
+	if err != nil {
+		return errors.New("Failed to delete state")
+	}
+
+	// remove the marble's index entries
+	err = delete_index(stub, "owner~id", []string{marble.Owner.Id, marble.Id})
+	if err != nil {
+		return err
+	}
+	err = delete_index(stub, "color~id", []string{marble.Color, marble.Id})
+	if err != nil {
+		return err
+	}
+	err = adjust_color_count(stub, marble.Color, -1)
+	if err != nil {
+		return err
+	}
+	if len(marble.SecondaryColor) > 0 {
+		err = delete_index(stub, "secondary~id", []string{marble.SecondaryColor, marble.Id})
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range marble.Tags {
+		err = delete_index(stub, "tag~id", []string{tag, marble.Id})
+		if err != nil {
+			return err
+		}
+	}
+
+	// take the marble out of any sets it is in
+	err = remove_from_all_sets(stub, marble.Id)
+	if err != nil {
+		return err
+	}
+
+	// clear its transfer queue
+	err = delete_transfer_queue(stub, marble.Id)
+	if err != nil {
+		return err
+	}
+
+	// remove the marble's comments
+	return delete_comments(stub, marble.Id)
+}
+
+// ============================================================================================================================
+// Delete Expired Marbles - purge up to a batch worth of expired marbles
+//
+// Expired marbles are compared against the tx timestamp so every endorser agrees. Their history stays on the ledger.
+//
+// Inputs - Array of Strings
+//      0
+//  batch size
+//    "50"
+//
+// Returns:
+// {
+//	"deleted": 50,
+//	"more": true
+// }
+// ============================================================================================================================
+func delete_expired_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type PurgeResult struct {
+		Deleted int  `json:"deleted"`
+		More    bool `json:"more"`                                         //true if expired marbles remain, call again
+	}
+	var result PurgeResult
+	fmt.Println("starting delete_expired_marbles")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	batchSize, err := strconv.Atoi(args[0])
+	if err != nil || batchSize <= 0 || batchSize > max_purge_batch {
+		return shim.Error("Batch size must be a number from 1 to " + strconv.Itoa(max_purge_batch))
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find a batch of expired marbles
+	var expired []Marble
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                           //un stringify it aka JSON.parse()
+		if !is_expired(marble, txTime) || marble.Collateral != nil {       //locked marbles stay until released
+			continue
+		}
+		if len(expired) == batchSize {                                     //batch is full, leave the rest for next time
+			result.More = true
+			break
+		}
+		expired = append(expired, marble)
+	}
+
+	// remove them
+	for _, marble := range expired {
+		err = remove_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Deleted++
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end delete_expired_marbles")
+	return shim.Success(resultAsBytes)
+}
+
 // ============================================================================================================================
 // Init Marble - create a new marble, store into chaincode state
 //
 // Shows off building a key's JSON value manually
 //
 // Inputs - Array of strings
-//      0      ,    1  ,  2  ,      3          ,       4
-//     id      ,  color, size,     owner id    ,  authing company
-// "m999999999", "blue", "35", "o9999999999999", "united marbles"
+//      0      ,    1  ,  2  ,      3          ,       4         ,          5
+//     id      ,  color, size,     owner id    ,  authing company, expires at (optional, RFC3339)
+// "m999999999", "blue", "35", "o9999999999999", "united marbles", "2017-12-31T23:59:59Z"
 // ============================================================================================================================
 func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	var err error
 	fmt.Println("starting init_marble")
 
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 or 6")
 	}
 
-	//input sanitation
-	err = sanitize_arguments(args)
+	//input sanitation - an RFC3339 expiry can run past 32 characters, time.Parse() checks it below instead
+	err = sanitize_arguments(args[:5])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = sanitize_utf8([]string{"Marble id", "Color", "Size", "Owner id", "Authing company", "Expires at"}, args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	id := args[0]
-	color := strings.ToLower(args[1])
+	color := normalize_color(args[1])
 	owner_id := args[3]
 	authed_by_company := args[4]
 	size, err := strconv.Atoi(args[2])
 	if err != nil {
 		return shim.Error("3rd argument must be a numeric string")
 	}
+	expires_at := ""
+	if len(args) == 6 {
+		_, err = time.Parse(time.RFC3339, args[5])
+		if err != nil {
+			return shim.Error("6th argument must be an RFC3339 timestamp")
+		}
+		expires_at = args[5]
+	}
 
 	//check if new owner exists
 	owner, err := get_owner(stub, owner_id)
@@ -158,6 +408,31 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize creation for '" + owner.Company + "'.")
 	}
 
+	//check if this color is allowed and hasn't sold out
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.check_color(color)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if limit, capped := config.ColorCaps[color]; capped {
+		count, err := count_index(stub, "color~id", []string{color})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if count >= limit {
+			return shim.Error("Color " + color + " sold out, all " + strconv.Itoa(limit) + " have been minted")
+		}
+	}
+
+	//check the owner's company has room for it
+	err = check_company_cap(stub, config, owner.Company, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	//check if marble id already exists
 	marble, err := get_marble(stub, id)
 	if err == nil {
@@ -166,6 +441,11 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 		return shim.Error("This marble already exists - " + id)  //all stop a marble by this id exists
 	}
 
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	//build the marble json string manually
 	str := `{
 		"docType":"marble", 
@@ -176,13 +456,35 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 			"id": "` + owner_id + `", 
 			"username": "` + owner.Username + `", 
 			"company": "` + owner.Company + `"
-		}
+		}`
+	if len(expires_at) > 0 {
+		str += `,
+		"expiresAt": "` + expires_at + `"`
+	}
+	str += `,
+		"transferCount": 0,
+		"lastModified": "` + txTime.Format(time_format) + `"
 	}`
 	err = stub.PutState(id, []byte(str))                         //store marble with id as key
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	//index the marble by its owner and its color
+	err = put_index(stub, "owner~id", []string{owner_id, id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	add_tx_company_count(stub, owner.Company, 1)
+	err = put_index(stub, "color~id", []string{color, id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = adjust_color_count(stub, color, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Println("- end init_marble")
 	return shim.Success(nil)
 }
@@ -210,12 +512,16 @@ func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	err = sanitize_utf8([]string{"Owner id", "Username", "Company"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	var owner Owner
 	owner.ObjectType = "marble_owner"
 	owner.Id =  args[0]
-	owner.Username = strings.ToLower(args[1])
-	owner.Company = args[2]
+	owner.Username = normalize_username(args[1])
+	owner.Company = normalize_company(args[2])
 	fmt.Println(owner)
 
 	//check if user already exists
@@ -226,80 +532,3708 @@ func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	//store user
-	ownerAsBytes, _ := json.Marshal(owner)                         //convert to array of bytes
-	err = stub.PutState(owner.Id, ownerAsBytes)                    //store owner by its Id
+	err = put_owner(stub, owner)
 	if err != nil {
 		fmt.Println("Could not store user")
 		return shim.Error(err.Error())
 	}
 
+	//index the owner by their company
+	err = put_index(stub, "company~owner", []string{owner.Company, owner.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Println("- end init_owner marble")
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
-// Set Owner on Marble
+// Put Owner - write an owner back to the ledger
+// ============================================================================================================================
+func put_owner(stub shim.ChaincodeStubInterface, owner Owner) error {
+	ownerAsBytes, _ := json.Marshal(owner)                         //convert to array of bytes
+	return stub.PutState(owner.Id, ownerAsBytes)                   //store owner by its Id
+}
+
+// ============================================================================================================================
+// Init Owner With Marble - create an owner and their first marble in one tx, for onboarding
 //
-// Shows off GetState() and PutState()
+// Everything is checked before anything is written, so a bad marble never leaves an owner behind. The owner can't be
+// read back in the same tx, so this doesn't go through init_owner() and init_marble(), it writes both itself.
 //
 // Inputs - Array of Strings
-//       0     ,        1      ,        2
-//  marble id  ,  to owner id  , company that auth the transfer
-// "m999999999", "o99999999999", united_mables" 
+//           0     ,     1   ,        2        ,      3     ,   4   ,  5  ,          6
+//      owner id   , username,     company     ,  marble id , color , size, expires at (optional, RFC3339)
+// "o9999999999999",   "bob" , "united marbles", "m999999999", "blue", "35", "2017-12-31T23:59:59Z"
 // ============================================================================================================================
-func set_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func init_owner_with_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting set_owner")
+	fmt.Println("starting init_owner_with_marble")
 
-	// this is quirky
-	// todo - get the "company that authed the transfer" from the certificate instead of an argument
-	// should be possible since we can now add attributes to the enrollment cert
-	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 or 7")
+	}
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	// ---- check everything first ---- //
+	err = sanitize_arguments(args[:6])                                     //the expiry gets time.Parse() instead, see init_marble()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = sanitize_utf8([]string{"Owner id", "Username", "Company", "Marble id", "Color", "Size", "Expires at"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	// input sanitation
-	err = sanitize_arguments(args)
+	var owner Owner
+	owner.ObjectType = "marble_owner"
+	owner.Id = args[0]
+	owner.Username = normalize_username(args[1])
+	owner.Company = normalize_company(args[2])
+
+	var marble Marble
+	marble.ObjectType = "marble"
+	marble.Id = args[3]
+	marble.Color = normalize_color(args[4])
+	marble.Size, err = strconv.Atoi(args[5])
+	if err != nil {
+		return shim.Error("6th argument must be a numeric string")
+	}
+	if len(args) == 7 {
+		_, err = time.Parse(time.RFC3339, args[6])
+		if err != nil {
+			return shim.Error("7th argument must be an RFC3339 timestamp")
+		}
+		marble.ExpiresAt = args[6]
+	}
+	marble.Owner = OwnerRelation{Id: owner.Id, Username: owner.Username, Company: owner.Company}
+	marble.TransferCount = new(int)
+
+	// neither id can be taken, and they can't be the same
+	if owner.Id == marble.Id {
+		return shim.Error("Owner id and marble id must be different")
+	}
+	for _, id := range []string{owner.Id, marble.Id} {
+		existing, err := stub.GetState(id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if existing != nil {
+			return shim.Error("This id is already in use - " + id)
+		}
+	}
+
+	// the color has to be allowed and have room, and so does the company
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.check_color(marble.Color)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if limit, capped := config.ColorCaps[marble.Color]; capped {
+		count, err := count_index(stub, "color~id", []string{marble.Color})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if count >= limit {
+			return shim.Error("Color " + marble.Color + " sold out, all " + strconv.Itoa(limit) + " have been minted")
+		}
+	}
+	err = check_company_cap(stub, config, owner.Company, 1)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	var marble_id = args[0]
-	var new_owner_id = args[1]
-	var authed_by_company = args[2]
-	fmt.Println(marble_id + "->" + new_owner_id + " - |" + authed_by_company)
+	// ---- then write both ---- //
+	err = put_owner(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = put_index(stub, "company~owner", []string{owner.Company, owner.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// check if user already exists
-	owner, err := get_owner(stub, new_owner_id)
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = put_index(stub, "owner~id", []string{owner.Id, marble.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	add_tx_company_count(stub, owner.Company, 1)
+	err = put_index(stub, "color~id", []string{marble.Color, marble.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = adjust_color_count(stub, marble.Color, 1)
 	if err != nil {
-		return shim.Error("This owner does not exist - " + new_owner_id)
+		return shim.Error(err.Error())
 	}
 
-	// get marble's current state
-	marbleAsBytes, err := stub.GetState(marble_id)
+	fmt.Println("- end init_owner_with_marble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Update Owner - change an owner's notification preferences, and optionally enable or disable them
+//
+// Inputs - Array of Strings
+//           0     ,        1        ,    2   ,       3        ,     4
+//      owner id   , authing company , notify , contact method , enabled (optional)
+// "o9999999999999", "united marbles", "true" , "email"        , "false"
+// ============================================================================================================================
+func update_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting update_owner")
+
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
 	if err != nil {
-		return shim.Error("Failed to get marble")
+		return shim.Error(err.Error())
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res)           //un stringify it aka JSON.parse()
 
-	// check authorizing company
-	if res.Owner.Company != authed_by_company{
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize transfers for '" + res.Owner.Company + "'.")
+	owner_id := args[0]
+	authed_by_company := args[1]
+	notify, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return shim.Error("3rd argument must be 'true' or 'false'")
+	}
+	contact_method := args[3]
+	if !contact_methods[contact_method] {
+		return shim.Error("Contact method must be 'email' or 'none'")
+	}
+	var enabled *bool                                             //nil leaves it as is
+	if len(args) == 5 {
+		value, err := strconv.ParseBool(args[4])
+		if err != nil {
+			return shim.Error("5th argument must be 'true' or 'false'")
+		}
+		enabled = &value
 	}
 
-	// transfer the marble
-	res.Owner.Id = new_owner_id                   //change the owner
-	res.Owner.Username = owner.Username
-	res.Owner.Company = owner.Company
-	jsonAsBytes, _ := json.Marshal(res)           //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes)     //rewrite the marble with id as key
+	owner, err := get_owner(stub, owner_id)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println("- end set owner")
+	//check authorizing company (see note in set_owner() about how this is quirky)
+	if owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize updates for '" + owner.Company + "'.")
+	}
+
+	owner.Notify = notify
+	owner.ContactMethod = contact_method
+	if enabled != nil {
+		owner.Enabled = enabled
+	}
+	err = put_owner(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end update_owner")
 	return shim.Success(nil)
 }
+
+// ============================================================================================================================
+// Set Owner on Marble
+//
+// Shows off GetState() and PutState()
+//
+// Inputs - Array of Strings
+//       0     ,        1      ,        2                      ,          3
+//  marble id  ,  to owner id  , company that auth the transfer, reason for the transfer (optional)
+// "m999999999", "o99999999999", united_mables"                , "traded for a steelie"
+// ============================================================================================================================
+func set_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_owner")
+
+	// this is quirky
+	// todo - get the "company that authed the transfer" from the certificate instead of an argument
+	// should be possible since we can now add attributes to the enrollment cert
+	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// input sanitation - the memo is free text and gets its own checks
+	err = sanitize_arguments(args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var marble_id = args[0]
+	var new_owner_id = args[1]
+	var authed_by_company = args[2]
+	var memo = ""
+	if len(args) == 4 {
+		memo, err = sanitize_memo(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	fmt.Println(marble_id + "->" + new_owner_id + " - |" + authed_by_company)
+
+	// check every transfer rule, stop on the first one broken
+	res, owner, problems := check_transfer(stub, marble_id, new_owner_id, authed_by_company)
+	if len(problems) > 0 {
+		return shim.Error(problems[0])
+	}
+
+	// transfer the marble
+	err = change_owner(stub, res, owner, memo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set owner")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Check Transfer - every rule set_owner() enforces, as a list of the ones broken so simulate_transfer() can show them all
+//
+// Checks that read something that isn't there are skipped, e.g. no marble means no company check. The marble and new
+// owner are returned as found, they are only usable if no problems came back.
+// ============================================================================================================================
+func check_transfer(stub shim.ChaincodeStubInterface, marble_id string, new_owner_id string, authed_by_company string) (Marble, Owner, []string) {
+	var problems []string
+
+	// check if user already exists and can take marbles
+	owner, err := require_enabled_owner(stub, new_owner_id)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return marble, owner, append(problems, err.Error())
+	}
+
+	// the current owner has to be able to give it up
+	_, err = require_enabled_owner(stub, marble.Owner.Id)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		problems = append(problems, "The company '" + authed_by_company + "' cannot authorize transfers for '" + marble.Owner.Company + "'.")
+	}
+
+	// the rest change_owner() would catch, checked here too so they show up in a simulation
+	err = check_transfer_cooldown(stub, marble)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	err = check_not_collateral(marble)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(owner.Company) > 0 && owner.Company != marble.Owner.Company {
+		config, err := load_config(stub)
+		if err == nil {
+			err = check_company_cap(stub, config, owner.Company, 1)
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return marble, owner, problems
+}
+
+// ============================================================================================================================
+// Simulate Transfer - run every set_owner() rule against the current state without writing anything
+//
+// Unlike estimate_write_set(), which lists the keys a transfer would touch, this says whether it would be allowed and if
+// not, every reason why.
+//
+// Inputs - Array of Strings
+//       0     ,        1      ,        2
+//  marble id  ,  to owner id  , authing company
+// "m999999999", "o99999999999", "united marbles"
+//
+// Returns:
+// {
+//	"ok": false,
+//	"problems": ["Marble m999999999 is locked as collateral for loan l1"]
+// }
+// ============================================================================================================================
+func simulate_transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Simulation struct {
+		Ok       bool     `json:"ok"`
+		Problems []string `json:"problems"`
+	}
+	fmt.Println("starting simulate_transfer")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, _, problems := check_transfer(stub, args[0], args[1], args[2])
+	simulation := Simulation{Ok: len(problems) == 0, Problems: problems}
+	if simulation.Problems == nil {
+		simulation.Problems = []string{}
+	}
+
+	simulationAsBytes, _ := json.Marshal(simulation)                       //convert to array of bytes
+	fmt.Println("- end simulate_transfer")
+	return shim.Success(simulationAsBytes)
+}
+
+// ============================================================================================================================
+// Check Transfer Cooldown - refuse a transfer until the configured cooldown has passed since the marble's last transfer
+//
+// Measured from lastTransfer, not lastModified, so tagging, insuring or quarantining a marble doesn't restart the clock.
+// A marble that was never transferred has no cooldown.
+// ============================================================================================================================
+func check_transfer_cooldown(stub shim.ChaincodeStubInterface, marble Marble) error {
+	config, err := load_config(stub)
+	if err != nil {
+		return err
+	}
+	if config.TransferCooldownSeconds == 0 || len(marble.LastTransfer) == 0 {  //off, or never transferred
+		return nil
+	}
+
+	lastTransfer, err := time.Parse(time.RFC3339, marble.LastTransfer)
+	if err != nil {
+		return errors.New("Marble " + marble.Id + " has a bad lastTransfer - " + marble.LastTransfer)
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return err
+	}
+	retryAfter := lastTransfer.Add(time.Duration(config.TransferCooldownSeconds) * time.Second)
+	if txTime.Before(retryAfter) {
+		return errors.New("Transfer cooldown active for marble " + marble.Id + ", retry after " + retryAfter.Format(time_format))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Company Cap - error if adding marbles to a company would put it over its configured cap
+//
+// The company's marbles are counted through the company~owner and owner~id indexes. Those only show what is already on the
+// ledger, so whatever earlier calls in the same tx moved is added from the tx cache, see tx_company_count().
+// ============================================================================================================================
+func check_company_cap(stub shim.ChaincodeStubInterface, config Config, company string, adding int) error {
+	limit, capped := config.CompanyCaps[company]
+	if !capped {
+		return nil
+	}
+
+	owner_ids, err := index_ids(stub, "company~owner", []string{company})
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, owner_id := range owner_ids {
+		owned, err := count_index(stub, "owner~id", []string{owner_id})
+		if err != nil {
+			return err
+		}
+		count += owned
+	}
+	count += tx_company_count(stub, company)
+	if count + adding > limit {
+		return errors.New("Company " + company + " at capacity, it holds " + strconv.Itoa(count) + " of its " + strconv.Itoa(limit) + " marbles")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Can Receive - error if the owner's company has no room for the marble, moving within a company always fits
+// ============================================================================================================================
+func check_can_receive(stub shim.ChaincodeStubInterface, marble Marble, owner Owner) error {
+	if owner.Company == marble.Owner.Company {
+		return nil
+	}
+	config, err := load_config(stub)
+	if err != nil {
+		return err
+	}
+	return check_company_cap(stub, config, owner.Company, 1)
+}
+
+// ============================================================================================================================
+// Change Owner - give a marble to a new owner, once it is past its cooldown and the new owner's company has room
+// ============================================================================================================================
+func change_owner(stub shim.ChaincodeStubInterface, marble Marble, owner Owner, memo string) error {
+	err := check_transfer_cooldown(stub, marble)                           //every way of moving a marble waits out the cooldown
+	if err != nil {
+		return err
+	}
+	err = check_can_receive(stub, marble, owner)
+	if err != nil {
+		return err
+	}
+	return move_marble(stub, marble, owner, memo)
+}
+
+// ============================================================================================================================
+// Move Marble - change_owner() without the cooldown or company cap, for callers that check those for a whole trade or
+// that have to go through regardless, like liquidate_collateral()
+//
+// Moves the marble's owner index entry, rewrites it and sends a "marble_transferred" event. Collateral and quarantined
+// marbles still can't move.
+// ============================================================================================================================
+func move_marble(stub shim.ChaincodeStubInterface, marble Marble, owner Owner, memo string) error {
+	type TransferEvent struct {
+		MarbleId    string   `json:"marbleId"`
+		FromOwnerId string   `json:"fromOwnerId"`
+		ToOwnerId   string   `json:"toOwnerId"`
+		Memo        string   `json:"memo"`
+		Notify      []string `json:"notify"`  //owner ids that asked to be notified
+	}
+	err := check_not_collateral(marble)
+	if err != nil {
+		return err
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		return err
+	}
+
+	event := TransferEvent{MarbleId: marble.Id, FromOwnerId: marble.Owner.Id, ToOwnerId: owner.Id, Memo: memo, Notify: []string{}}
+	previous, err := get_owner(stub, marble.Owner.Id)
+	if err == nil && previous.Notify {                                     //the old owner may be long gone, that's fine
+		event.Notify = append(event.Notify, previous.Id)
+	}
+	if owner.Notify && owner.Id != marble.Owner.Id {
+		event.Notify = append(event.Notify, owner.Id)
+	}
+
+	// move the owner index entry
+	err = delete_index(stub, "owner~id", []string{marble.Owner.Id, marble.Id})
+	if err != nil {
+		return err
+	}
+	err = put_index(stub, "owner~id", []string{owner.Id, marble.Id})
+	if err != nil {
+		return err
+	}
+	if owner.Company != marble.Owner.Company {                             //later checks in this tx need to see the move
+		add_tx_company_count(stub, owner.Company, 1)
+		add_tx_company_count(stub, marble.Owner.Company, -1)
+	}
+
+	// count it, giving a marble to its own owner isn't a transfer
+	if marble.TransferCount != nil && owner.Id != marble.Owner.Id {
+		count := *marble.TransferCount + 1
+		marble.TransferCount = &count
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return err
+	}
+
+	// transfer the marble
+	marble.Owner.Id = owner.Id                    //change the owner
+	marble.Owner.Username = owner.Username
+	marble.Owner.Company = owner.Company
+	marble.Gift = nil                             //a pending gift doesn't survive a change of owner
+	marble.Pool = nil                             //neither does a pool
+	marble.TransferAttempts = nil                 //it worked, nothing left to retry
+	marble.LastTransfer = txTime.Format(time_format) //starts the transfer cooldown
+	err = put_marble(stub, marble)                //rewrite the marble with id as key
+	if err != nil {
+		return err
+	}
+
+	// pay the transfer fee, if there is one
+	err = charge_transfer_fee(stub, owner.Id)
+	if err != nil {
+		return err
+	}
+
+	// tell listeners, the memo is recorded here and not on the marble itself
+	eventAsBytes, _ := json.Marshal(event)
+	return stub.SetEvent("marble_transferred", eventAsBytes)
+}
+
+// ============================================================================================================================
+// Charge Transfer Fee - move the configured transfer fee from the new owner's balance to the treasury's
+//
+// Balances are just a record, an owner may go negative. Fees to the treasury itself are skipped. One tx can transfer
+// several marbles to the same owner, so the owners go through the tx cache, see tx_cache.go.
+// ============================================================================================================================
+func charge_transfer_fee(stub shim.ChaincodeStubInterface, payer_id string) error {
+	config, err := load_config(stub)
+	if err != nil {
+		return err
+	}
+	if config.TransferFee == 0 || payer_id == config.Treasury {
+		return nil
+	}
+
+	var payer, treasury Owner
+	found, err := tx_get_state_as(stub, payer_id, &payer)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("Owner does not exist - " + payer_id)
+	}
+	found, err = tx_get_state_as(stub, config.Treasury, &treasury)
+	if err != nil {
+		return err
+	}
+	if !found || len(treasury.Username) == 0 {
+		return errors.New("Treasury owner does not exist - " + config.Treasury)
+	}
+	if treasury.Balance > math.MaxInt64 - config.TransferFee || payer.Balance < math.MinInt64 + config.TransferFee {
+		return errors.New("Transfer fee would overflow a balance")
+	}
+
+	payer.Balance -= config.TransferFee
+	treasury.Balance += config.TransferFee
+	payerAsBytes, _ := json.Marshal(payer)
+	err = tx_put_state(stub, payer.Id, payerAsBytes)
+	if err != nil {
+		return err
+	}
+	treasuryAsBytes, _ := json.Marshal(treasury)
+	return tx_put_state(stub, treasury.Id, treasuryAsBytes)
+}
+
+
+// ============================================================================================================================
+// Add Comment - append a note to a marble's comment thread
+//
+// Shows off CreateCompositeKey() - comments are stored under "comment~marble~seq" so they can be read back in order
+//
+// Inputs - Array of Strings
+//       0     ,        1       ,       2
+//  marble id  , author owner id, text
+// "m999999999", "o99999999999", "small chip near the swirl"
+// ============================================================================================================================
+func add_comment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting add_comment")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation - the text is allowed to be longer than an id
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[2]) == 0 {
+		return shim.Error("Comment text must be a non-empty string")
+	}
+	if len(args[2]) > max_comment_length {
+		return shim.Error("Comment text must be <= " + strconv.Itoa(max_comment_length) + " characters")
+	}
+
+	var comment Comment
+	comment.ObjectType = "marble_comment"
+	comment.MarbleId = args[0]
+	comment.AuthorId = args[1]
+	comment.Text = args[2]
+
+	// check that the marble and the author exist
+	_, err = get_marble(stub, comment.MarbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = get_owner(stub, comment.AuthorId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// next sequence number is the number of comments so far, comments are only ever removed with their marble
+	count, err := count_index(stub, "comment~marble~seq", []string{comment.MarbleId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if count >= max_comments_per_marble {
+		return shim.Error("Marble " + comment.MarbleId + " already has the max of " + strconv.Itoa(max_comments_per_marble) + " comments")
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	comment.Timestamp = txTime.Format(time.RFC3339)
+
+	// store comment
+	key, err := stub.CreateCompositeKey("comment~marble~seq", []string{comment.MarbleId, fmt.Sprintf("%06d", count)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	commentAsBytes, _ := json.Marshal(comment)                     //convert to array of bytes
+	err = stub.PutState(key, commentAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_comment")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Delete Comments - remove every comment on a marble, used when the marble is deleted
+// ============================================================================================================================
+func delete_comments(stub shim.ChaincodeStubInterface, marble_id string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("comment~marble~seq", []string{marble_id})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		key, _, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return errors.New("Failed to delete comment - " + key)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Create Gift - make a marble claimable by whoever presents the claim code
+//
+// Shows off GetTransient() - the claim code rides in the proposal's transient map so the plaintext never lands in a block.
+// The chaincode can't make the code up itself, anything it returns is written to the ledger with the tx.
+// Only the sha256 of the code is stored on the marble.
+//
+// Inputs - Array of Strings, plus transient map {"claim_code": <code bytes>}
+//       0     ,         1        ,          2
+//  marble id  , authing company  , expires at (optional, RFC3339)
+// "m999999999", "united marbles" , "2017-12-31T23:59:59Z"
+// ============================================================================================================================
+func create_gift(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting create_gift")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	// input sanitation - the expiry gets time.Parse() instead, see init_marble()
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	authed_by_company := args[1]
+	gift := Gift{}
+	if len(args) == 3 {
+		_, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be an RFC3339 timestamp")
+		}
+		gift.ExpiresAt = args[2]
+	}
+
+	code, err := get_claim_code(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	gift.CodeHash = hash_claim_code(code)
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize gifts for '" + marble.Owner.Company + "'.")
+	}
+
+	// a disabled owner can't give marbles away
+	_, err = require_enabled_owner(stub, marble.Owner.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store the gift on the marble
+	marble.Gift = &gift
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end create_gift")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Claim Gift - take ownership of a gifted marble by presenting its claim code, the code only works once
+//
+// Inputs - Array of Strings, plus transient map {"claim_code": <code bytes>}
+//       0     ,         1
+//  marble id  , claimer owner id
+// "m999999999", "o99999999999"
+// ============================================================================================================================
+func claim_gift(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting claim_gift")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	claimer_id := args[1]
+
+	code, err := get_claim_code(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Gift == nil {                        //never gifted, or already claimed
+		return shim.Error("Marble " + marble_id + " is not available to claim")
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_gift_expired(marble, txTime) {
+		return shim.Error("The gift of marble " + marble_id + " expired at " + marble.Gift.ExpiresAt)
+	}
+	if subtle.ConstantTimeCompare([]byte(hash_claim_code(code)), []byte(marble.Gift.CodeHash)) != 1 {
+		return shim.Error("Wrong claim code for marble " + marble_id)
+	}
+
+	// check the claimer exists and can take marbles
+	owner, err := require_enabled_owner(stub, claimer_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// transfer the marble, this also clears the gift so the code can't be used again
+	err = change_owner(stub, marble, owner, "claimed gift")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end claim_gift")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Get Claim Code - read the gift claim code out of the transient map
+// ============================================================================================================================
+func get_claim_code(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, errors.New("Failed to get transient map - " + err.Error())
+	}
+	code, ok := transient["claim_code"]
+	if !ok || len(code) == 0 {
+		return nil, errors.New("Expecting the claim code in the transient map under 'claim_code'")
+	}
+	return code, nil
+}
+
+// ============================================================================================================================
+// Hash Claim Code - the only form of a claim code we ever store
+// ============================================================================================================================
+func hash_claim_code(code []byte) string {
+	hash := sha256.Sum256(code)
+	return hex.EncodeToString(hash[:])
+}
+
+// ============================================================================================================================
+// Canonicalize Marbles - admin only, rewrite older marbles and owners that don't follow the current formatting rules
+//
+// Walks the marbles and then the owners a page at a time so a big ledger doesn't blow up one tx. Pass back the returned
+// bookmark to carry on, an empty bookmark means the end was reached. Only records that actually change are rewritten,
+// so running it again is a no-op. An owner whose company changes is moved in the company~owner index too.
+//
+// Inputs - Array of Strings
+//       0      ,     1
+//   bookmark   , page size
+//     ""       ,   "50"
+//
+// Returns:
+// {
+//	"scanned": 50,
+//	"normalized": 3,
+//	"normalizedOwners": 1,
+//	"bookmark": "m01490985296352SjAyM"
+// }
+// ============================================================================================================================
+func canonicalize_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type CanonicalizeResult struct {
+		Scanned          int    `json:"scanned"`
+		Normalized       int    `json:"normalized"`
+		NormalizedOwners int    `json:"normalizedOwners"`
+		Bookmark         string `json:"bookmark"`
+	}
+	var result CanonicalizeResult
+	fmt.Println("starting canonicalize_marbles")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	err := require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bookmark := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	startKey := "m0"
+	if len(bookmark) > 0 {
+		startKey = bookmark
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "o9999999999999999999")   //marbles, then owners
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var changed []Marble
+	var changedOwners []Owner
+	more := false
+	for resultsIterator.HasNext() {
+		queryKeyAsStr, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if queryKeyAsStr == bookmark {                                     //the bookmark was the last one done
+			continue
+		}
+		if result.Scanned == pageSize {                                    //page is full, there is more
+			more = true
+			break
+		}
+		result.Scanned++
+		result.Bookmark = queryKeyAsStr
+
+		var doc struct {
+			ObjectType string `json:"docType"`
+		}
+		json.Unmarshal(queryValAsBytes, &doc)                              //un stringify it aka JSON.parse()
+
+		// ---- owners ---- //
+		if doc.ObjectType == "marble_owner" {
+			var owner Owner
+			json.Unmarshal(queryValAsBytes, &owner)
+			normal := owner
+			normal.Username = normalize_username(owner.Username)
+			normal.Company = normalize_company(owner.Company)
+			if normal.Username == owner.Username && normal.Company == owner.Company {
+				continue                                                   //already canonical
+			}
+
+			// the company index is keyed on the company, move it if that changed
+			if normal.Company != owner.Company {
+				err = delete_index(stub, "company~owner", []string{owner.Company, owner.Id})
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				err = put_index(stub, "company~owner", []string{normal.Company, normal.Id})
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+			changedOwners = append(changedOwners, normal)
+			continue
+		}
+		if doc.ObjectType != "marble" {                                    //something else in the range, leave it
+			continue
+		}
+
+		// ---- marbles ---- //
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                           //un stringify it aka JSON.parse()
+		normal := marble
+		normal.Color = normalize_color(marble.Color)
+		normal.Owner.Username = normalize_username(marble.Owner.Username)
+		normal.Owner.Company = normalize_company(marble.Owner.Company)
+		if normal.Color == marble.Color && normal.Owner == marble.Owner {
+			continue                                                       //already canonical
+		}
+
+		// the color index is keyed on the color, move it if that changed
+		if normal.Color != marble.Color {
+			err = delete_index(stub, "color~id", []string{marble.Color, marble.Id})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = put_index(stub, "color~id", []string{normal.Color, normal.Id})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = adjust_color_count(stub, marble.Color, -1)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = adjust_color_count(stub, normal.Color, 1)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		changed = append(changed, normal)
+	}
+	if !more {                                                             //ran off the end
+		result.Bookmark = ""
+	}
+
+	for _, marble := range changed {
+		err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Normalized++
+	}
+	for _, owner := range changedOwners {
+		err = put_owner(stub, owner)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.NormalizedOwners++
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end canonicalize_marbles")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Create Set - start a new themed set of marbles
+//
+// Membership lives in composite keys, "set~setid~marble" to list a set and "marble~set" to find a marble's sets when it
+// gets deleted. A marble can be in any number of sets.
+//
+// Inputs - Array of Strings
+//       0     ,      1     ,        2       ,        3        ,         4
+//    set id   ,    name    ,     owner id   , authing company , description
+// "s999999999", "blue moon", "o99999999999" , "united marbles", "every shade of blue"
+// ============================================================================================================================
+func create_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting create_set")
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	// input sanitation - the description is free text and gets its own checks
+	err = sanitize_arguments(args[:4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[4]) > max_description_length {
+		return shim.Error("Description must be <= " + strconv.Itoa(max_description_length) + " characters")
+	}
+
+	var set MarbleSet
+	set.ObjectType = "marble_set"
+	set.Id = args[0]
+	set.Name = args[1]
+	owner_id := args[2]
+	authed_by_company := args[3]
+	set.Description = args[4]
+
+	owner, err := get_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize sets for '" + owner.Company + "'.")
+	}
+	set.Owner = OwnerRelation{Id: owner.Id, Username: owner.Username, Company: owner.Company}
+
+	// the id can't already be in use, by a set or anything else
+	existing, err := stub.GetState(set.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("This id is already in use - " + set.Id)
+	}
+
+	setAsBytes, _ := json.Marshal(set)                                     //convert to array of bytes
+	err = stub.PutState(set.Id, setAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end create_set")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Add Marble To Set
+//
+// Inputs - Array of Strings
+//       0     ,      1      ,         2
+//    set id   ,  marble id  , authing company
+// "s999999999", "m999999999", "united marbles"
+// ============================================================================================================================
+func add_marble_to_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting add_marble_to_set")
+
+	set, marble_id, err := get_set_for_change(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the marble has to exist
+	_, err = get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_index(stub, "set~setid~marble", []string{set.Id, marble_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = put_index(stub, "marble~set", []string{marble_id, set.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_marble_to_set")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Remove Marble From Set
+//
+// Inputs - Array of Strings
+//       0     ,      1      ,         2
+//    set id   ,  marble id  , authing company
+// "s999999999", "m999999999", "united marbles"
+// ============================================================================================================================
+func remove_marble_from_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting remove_marble_from_set")
+
+	set, marble_id, err := get_set_for_change(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = delete_index(stub, "set~setid~marble", []string{set.Id, marble_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delete_index(stub, "marble~set", []string{marble_id, set.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end remove_marble_from_set")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Get Set For Change - shared arg checking for add/remove, returns the set and marble id once the company is authorized
+// ============================================================================================================================
+func get_set_for_change(stub shim.ChaincodeStubInterface, args []string) (MarbleSet, string, error) {
+	if len(args) != 3 {
+		return MarbleSet{}, "", errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return MarbleSet{}, "", err
+	}
+
+	set, err := get_marble_set(stub, args[0])
+	if err != nil {
+		return set, "", err
+	}
+
+	// check authorizing company (see note in set_owner() about how this is quirky)
+	if set.Owner.Company != args[2] {
+		return set, "", errors.New("The company '" + args[2] + "' cannot authorize changes to sets of '" + set.Owner.Company + "'.")
+	}
+	return set, args[1], nil
+}
+
+// ============================================================================================================================
+// Remove From All Sets - drop a marble from every set it is in, used when the marble is deleted
+// ============================================================================================================================
+func remove_from_all_sets(stub shim.ChaincodeStubInterface, marble_id string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("marble~set", []string{marble_id})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)              //parts are [marble id, set id]
+		if err != nil {
+			return err
+		}
+		err = delete_index(stub, "set~setid~marble", []string{keyParts[1], marble_id})
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Add Set To Set - nest one set inside another, e.g. a "blues" set inside a "cool colors" set
+//
+// Nesting lives in "subset~parent~child". A set can't end up inside itself, so before writing, the sets already nested
+// under the child are walked looking for the parent. The walk stops at max_set_depth levels, deeper nesting is refused
+// rather than risk looping forever on a bad ledger.
+//
+// Inputs - Array of Strings
+//       0      ,      1      ,         2
+//  parent set id, child set id, authing company
+// "s999999999" , "s888888888", "united marbles"
+// ============================================================================================================================
+func add_set_to_set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting add_set_to_set")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	parent_id := args[0]
+	child_id := args[1]
+	authed_by_company := args[2]
+
+	// check authorizing company for both sets (see note in set_owner() about how this is quirky)
+	for _, set_id := range []string{parent_id, child_id} {
+		set, err := get_marble_set(stub, set_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if set.Owner.Company != authed_by_company {
+			return shim.Error("The company '" + authed_by_company + "' cannot authorize changes to sets of '" + set.Owner.Company + "'.")
+		}
+	}
+
+	// the parent can't already be somewhere under the child
+	if parent_id == child_id {
+		return shim.Error("Adding set " + child_id + " to itself would create a cycle")
+	}
+	level := []string{child_id}
+	seen := map[string]bool{child_id: true}
+	for depth := 0; len(level) > 0; depth++ {
+		if depth == max_set_depth {
+			return shim.Error("Set " + child_id + " is nested more than " + strconv.Itoa(max_set_depth) + " levels deep, can't check it for cycles")
+		}
+		var next []string
+		for _, set_id := range level {
+			subsets, err := index_ids(stub, "subset~parent~child", []string{set_id})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			for _, subset_id := range subsets {
+				if subset_id == parent_id {
+					return shim.Error("Adding set " + child_id + " to set " + parent_id + " would create a cycle")
+				}
+				if !seen[subset_id] {                                      //two paths to one set is fine, walk it once
+					seen[subset_id] = true
+					next = append(next, subset_id)
+				}
+			}
+		}
+		level = next
+	}
+
+	err = put_index(stub, "subset~parent~child", []string{parent_id, child_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = put_index(stub, "superset~child~parent", []string{child_id, parent_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_set_to_set")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Merge Sets - move every marble in the second set into the first, then delete the second set
+//
+// Marbles already in the first set just lose their second set membership. Big sets are moved a batch at a time, the second
+// set is only deleted by the call that empties it, so repeat the call until "more" is false.
+//
+// Inputs - Array of Strings
+//       0     ,      1     ,         2        ,     3
+//  into set id, from set id, authing company  , batch size
+// "s999999999", "s888888888", "united marbles", "100"
+//
+// Returns:
+// {
+//	"moved": 12,
+//	"more": false
+// }
+// ============================================================================================================================
+func merge_sets(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type MergeResult struct {
+		Moved int  `json:"moved"`
+		More  bool `json:"more"`                                            //the second set still has marbles, call again
+	}
+	var result MergeResult
+	fmt.Println("starting merge_sets")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	into_id := args[0]
+	from_id := args[1]
+	authed_by_company := args[2]
+	batchSize, err := strconv.Atoi(args[3])
+	if err != nil || batchSize <= 0 || batchSize > max_purge_batch {
+		return shim.Error("Batch size must be a number from 1 to " + strconv.Itoa(max_purge_batch))
+	}
+	if into_id == from_id {
+		return shim.Error("Cannot merge a set into itself")
+	}
+
+	// check authorizing company for both sets (see note in set_owner() about how this is quirky)
+	for _, set_id := range []string{into_id, from_id} {
+		set, err := get_marble_set(stub, set_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if set.Owner.Company != authed_by_company {
+			return shim.Error("The company '" + authed_by_company + "' cannot authorize changes to sets of '" + set.Owner.Company + "'.")
+		}
+	}
+
+	// nesting isn't merged, the second set has to be taken out of it first
+	for _, index := range []string{"subset~parent~child", "superset~child~parent"} {
+		nested, err := count_index(stub, index, []string{from_id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if nested > 0 {
+			return shim.Error("Set " + from_id + " contains or is inside other sets, it can't be merged")
+		}
+	}
+
+	// move a batch of memberships
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("set~setid~marble", []string{from_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		if result.Moved == batchSize {                                     //batch is full, leave the rest for next time
+			result.More = true
+			break
+		}
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)              //parts are [set id, marble id]
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble_id := keyParts[1]
+
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = delete_index(stub, "marble~set", []string{marble_id, from_id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = put_index(stub, "set~setid~marble", []string{into_id, marble_id})  //rewriting an existing entry is harmless
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = put_index(stub, "marble~set", []string{marble_id, into_id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Moved++
+	}
+
+	// emptied, the second set goes away
+	if !result.More {
+		err = stub.DelState(from_id)
+		if err != nil {
+			return shim.Error("Failed to delete set - " + err.Error())
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end merge_sets")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Sweep Expired Reservations - clear up to a batch worth of gifts that were never claimed before they expired
+//
+// A pending gift reserves the marble for whoever holds the claim code, gifts are the only reservations so far. Expiry is
+// compared against the tx timestamp so every endorser agrees. Gifts without an expiry never expire. A tx can only set one
+// event, so a single "gifts_expired" event lists every marble cleared in this batch.
+//
+// Inputs - Array of Strings
+//      0
+//  batch size
+//    "50"
+//
+// Returns:
+// {
+//	"cleared": 50,
+//	"more": true
+// }
+// ============================================================================================================================
+func sweep_expired_reservations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type SweepResult struct {
+		Cleared int  `json:"cleared"`
+		More    bool `json:"more"`                                         //true if expired gifts remain, call again
+	}
+	type ExpiredGiftsEvent struct {
+		MarbleIds []string `json:"marbleIds"`
+	}
+	var result SweepResult
+	var event ExpiredGiftsEvent
+	fmt.Println("starting sweep_expired_reservations")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	batchSize, err := strconv.Atoi(args[0])
+	if err != nil || batchSize <= 0 || batchSize > max_purge_batch {
+		return shim.Error("Batch size must be a number from 1 to " + strconv.Itoa(max_purge_batch))
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find a batch of expired gifts
+	var expired []Marble
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                           //un stringify it aka JSON.parse()
+		if !is_gift_expired(marble, txTime) {
+			continue
+		}
+		if len(expired) == batchSize {                                     //batch is full, leave the rest for next time
+			result.More = true
+			break
+		}
+		expired = append(expired, marble)
+	}
+
+	// clear them
+	for _, marble := range expired {
+		marble.Gift = nil
+		err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		event.MarbleIds = append(event.MarbleIds, marble.Id)
+		result.Cleared++
+	}
+
+	if result.Cleared > 0 {
+		eventAsBytes, _ := json.Marshal(event)                             //convert to array of bytes
+		err = stub.SetEvent("gifts_expired", eventAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end sweep_expired_reservations")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Is Gift Expired - true if the marble has an unclaimed gift with an expiry at or before the tx time
+// ============================================================================================================================
+func is_gift_expired(marble Marble, txTime time.Time) bool {
+	if marble.Gift == nil || len(marble.Gift.ExpiresAt) == 0 {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, marble.Gift.ExpiresAt)
+	if err != nil {                                                        //create_gift checks this, treat junk as no expiry
+		return false
+	}
+	return !txTime.Before(expiresAt)
+}
+
+// ============================================================================================================================
+// Enqueue Transfer - ask for a marble, requests are served first come first served by process_transfer_queue()
+//
+// Requests live under "txnqueue~marble~seq". The next seq number is kept in its own key, "txnqueueseq~marble", so it
+// only ever goes up even as served requests are removed, and every endorser computes the same one.
+//
+// Inputs - Array of Strings
+//       0     ,          1          ,         2
+//  marble id  , requesting owner id , authing company
+// "m999999999", "o99999999999"      , "united marbles"
+// ============================================================================================================================
+func enqueue_transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting enqueue_transfer")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var request TransferRequest
+	request.ObjectType = "transfer_request"
+	request.MarbleId = args[0]
+	request.OwnerId = args[1]
+	authed_by_company := args[2]
+
+	marble, err := get_marble(stub, request.MarbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := require_enabled_owner(stub, request.OwnerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize requests for '" + owner.Company + "'.")
+	}
+	if marble.Owner.Id == owner.Id {
+		return shim.Error("Owner " + owner.Id + " already owns marble " + marble.Id)
+	}
+
+	// take the next seq number
+	seqKey, err := stub.CreateCompositeKey("txnqueueseq~marble", []string{marble.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = get_state_as(stub, seqKey, &request.Seq)                     //missing means nobody has queued yet, seq 0
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	seqAsBytes, _ := json.Marshal(request.Seq + 1)
+	err = stub.PutState(seqKey, seqAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	request.Timestamp = txTime.Format(time.RFC3339)
+
+	// store the request
+	key, err := stub.CreateCompositeKey("txnqueue~marble~seq", []string{marble.Id, fmt.Sprintf("%09d", request.Seq)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestAsBytes, _ := json.Marshal(request)                             //convert to array of bytes
+	err = stub.PutState(key, requestAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end enqueue_transfer")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Process Transfer Queue - admin only, give the marble to the first request in line that can still take it
+//
+// Requests are taken in seq order. A request whose owner no longer exists, is disabled or whose company has no room for
+// the marble is dropped, the reason is listed, and the next one is tried. Once the marble is transferred processing stops,
+// the rest stay in line for next time. If the marble itself can't move (its owner is disabled, it is cooling down, locked
+// as collateral or quarantined) nothing is dropped, the reason comes back as "blocked" and the whole line waits.
+//
+// Inputs - Array of Strings
+//       0
+//  marble id
+// "m999999999"
+//
+// Returns:
+// {
+//	"transferredTo": "o99999999999",
+//	"dropped": 1,
+//	"reasons": ["#3 o88888888888 - Owner o88888888888 is disabled"]
+// }
+// ============================================================================================================================
+func process_transfer_queue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type QueueResult struct {
+		TransferredTo string   `json:"transferredTo"`                      //empty if the queue ran out
+		Dropped       int      `json:"dropped"`
+		Reasons       []string `json:"reasons"`                            //why each dropped request was dropped
+		Blocked       string   `json:"blocked,omitempty"`                  //why the marble can't move right now
+	}
+	result := QueueResult{Reasons: []string{}}
+	fmt.Println("starting process_transfer_queue")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// nobody in line can get a marble that can't move, leave the line alone
+	_, err = require_enabled_owner(stub, marble.Owner.Id)
+	if err == nil {
+		err = check_transfer_cooldown(stub, marble)
+	}
+	if err == nil {
+		err = check_not_collateral(marble)
+	}
+	if err == nil {
+		err = check_not_quarantined(marble)
+	}
+	if err != nil {
+		result.Blocked = err.Error()
+		resultAsBytes, _ := json.Marshal(result)                           //convert to array of bytes
+		fmt.Println("- end process_transfer_queue - blocked")
+		return shim.Success(resultAsBytes)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("txnqueue~marble~seq", []string{marble.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var request TransferRequest
+		json.Unmarshal(queryValAsBytes, &request)                          //un stringify it aka JSON.parse()
+		err = stub.DelState(key)                                           //served or dropped, either way it leaves the line
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		owner, err := require_enabled_owner(stub, request.OwnerId)
+		if err == nil && owner.Id == marble.Owner.Id {
+			err = errors.New("Owner " + owner.Id + " already has the marble")
+		}
+		if err == nil {
+			err = check_can_receive(stub, marble, owner)
+		}
+		if err != nil {                                                    //gone, disabled, already has it, or no room
+			result.Dropped++
+			result.Reasons = append(result.Reasons, "#" + strconv.Itoa(request.Seq) + " " + request.OwnerId + " - " + err.Error())
+			continue
+		}
+
+		err = move_marble(stub, marble, owner, "transfer queue #" + strconv.Itoa(request.Seq)) //checked above
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.TransferredTo = owner.Id
+		break
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end process_transfer_queue")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Delete Transfer Queue - remove every queued request and the seq counter of a marble, used when the marble is deleted
+// ============================================================================================================================
+func delete_transfer_queue(stub shim.ChaincodeStubInterface, marble_id string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("txnqueue~marble~seq", []string{marble_id})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		key, _, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return errors.New("Failed to delete transfer request - " + key)
+		}
+	}
+	return delete_index(stub, "txnqueueseq~marble", []string{marble_id})
+}
+
+// ============================================================================================================================
+// Repaint Marbles By Color - admin only, change up to a page of marbles from one color to another
+//
+// Each repainted marble's color~id index entry moves from the old color to the new one in the same tx. Repainted marbles
+// leave the old color's index, so call again with the same colors while "more" is true. The new color has to be in the
+// palette and stay under its cap, if those are configured. One "marbles_repainted" event summarizes the page.
+//
+// Inputs - Array of Strings
+//      0    ,     1   ,     2
+//  from color, to color, page size
+//    "blue" ,  "red"  ,   "50"
+//
+// Returns:
+// {
+//	"repainted": 50,
+//	"more": true
+// }
+// ============================================================================================================================
+func repaint_marbles_by_color(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type RepaintResult struct {
+		Repainted int  `json:"repainted"`
+		More      bool `json:"more"`                                       //true if marbles of the old color remain, call again
+	}
+	type RepaintEvent struct {
+		FromColor string `json:"fromColor"`
+		ToColor   string `json:"toColor"`
+		Count     int    `json:"count"`
+	}
+	var result RepaintResult
+	fmt.Println("starting repaint_marbles_by_color")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	from_color := normalize_color(args[0])
+	to_color := normalize_color(args[1])
+	if from_color == to_color {
+		return shim.Error("From and to colors are the same - " + to_color)
+	}
+	pageSize, err := strconv.Atoi(args[2])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.check_color(to_color)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find a page of marbles with the old color
+	var ids []string
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("color~id", []string{from_color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		key, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(ids) == pageSize {                                          //page is full, leave the rest for next time
+			result.More = true
+			break
+		}
+		_, keyParts, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		ids = append(ids, keyParts[1])
+	}
+
+	// make sure the new color has room for them
+	if limit, capped := config.ColorCaps[to_color]; capped {
+		count, err := count_index(stub, "color~id", []string{to_color})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if count + len(ids) > limit {
+			return shim.Error("Color " + to_color + " can only hold " + strconv.Itoa(limit - count) + " more marbles")
+		}
+	}
+
+	// repaint them
+	for _, id := range ids {
+		marble, err := get_marble(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = delete_index(stub, "color~id", []string{from_color, id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = put_index(stub, "color~id", []string{to_color, id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble.Color = to_color
+		err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Repainted++
+	}
+
+	if result.Repainted > 0 {
+		err = adjust_color_count(stub, from_color, -result.Repainted)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = adjust_color_count(stub, to_color, result.Repainted)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		eventAsBytes, _ := json.Marshal(RepaintEvent{from_color, to_color, result.Repainted})
+		err = stub.SetEvent("marbles_repainted", eventAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end repaint_marbles_by_color")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Put Marble In Pool - let whoever's enrollment cert carries an attribute value claim the marble
+//
+// Inputs - Array of Strings
+//       0     ,       1       ,        2       ,        3
+//  marble id  , attribute name, attribute value, authing company
+// "m999999999", "department"  , "sales"        , "united marbles"
+// ============================================================================================================================
+func put_marble_in_pool(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting put_marble_in_pool")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	pool := Pool{Attribute: args[1], Value: args[2]}
+	authed_by_company := args[3]
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize pooling for '" + marble.Owner.Company + "'.")
+	}
+
+	// a disabled owner can't give marbles away
+	_, err = require_enabled_owner(stub, marble.Owner.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble.Pool = &pool
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end put_marble_in_pool")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Claim Marbles By Attribute - move every pooled marble whose attribute value matches the caller's cert to an owner
+//
+// The caller's value for the attribute comes from their enrollment cert, not from the args, so only someone fabric-ca
+// enrolled with "department=sales" can claim marbles pooled for sales. Each marble's transfer event is replaced by one
+// "marbles_claimed" event for the whole claim, a tx only keeps one.
+//
+// Inputs - Array of Strings
+//       0       ,        1        ,        2
+//  attribute name,     owner id    , authing company
+//  "department" , "o9999999999999", "united marbles"
+//
+// Returns:
+// {
+//	"claimed": ["m999999999"]
+// }
+// ============================================================================================================================
+func claim_marbles_by_attribute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ClaimResult struct {
+		Claimed []string `json:"claimed"`
+	}
+	type ClaimEvent struct {
+		Attribute string   `json:"attribute"`
+		Value     string   `json:"value"`
+		OwnerId   string   `json:"ownerId"`
+		MarbleIds []string `json:"marbleIds"`
+	}
+	result := ClaimResult{Claimed: []string{}}
+	fmt.Println("starting claim_marbles_by_attribute")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	attribute := args[0]
+	owner_id := args[1]
+	authed_by_company := args[2]
+
+	value, found, err := get_caller_attribute(stub, attribute)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Caller's certificate does not have the attribute '" + attribute + "'")
+	}
+
+	// check the claimer exists and can take marbles
+	owner, err := require_enabled_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize claims for '" + owner.Company + "'.")
+	}
+
+	// find the pooled marbles
+	var pooled []Marble
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		_, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                           //un stringify it aka JSON.parse()
+		if marble.Pool != nil && marble.Pool.Attribute == attribute && marble.Pool.Value == value {
+			pooled = append(pooled, marble)
+		}
+	}
+
+	// claim them
+	for _, marble := range pooled {
+		err = change_owner(stub, marble, owner, "claimed by " + attribute + "=" + value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Claimed = append(result.Claimed, marble.Id)
+	}
+
+	if len(result.Claimed) > 0 {
+		eventAsBytes, _ := json.Marshal(ClaimEvent{attribute, value, owner.Id, result.Claimed})
+		err = stub.SetEvent("marbles_claimed", eventAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end claim_marbles_by_attribute")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Set Owner Public Key - store the key an owner signs transfers with, see transfer_marble_signed()
+//
+// Inputs - Array of Strings
+//           0     ,        1        ,                     2
+//      owner id   , authing company , public key
+// "o9999999999999", "united marbles", "-----BEGIN PUBLIC KEY-----\nMFkw...\n-----END PUBLIC KEY-----"
+// ============================================================================================================================
+func set_owner_public_key(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_owner_public_key")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation - the key is way over the normal length limit and gets parsed instead
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner_id := args[0]
+	authed_by_company := args[1]
+	_, err = parse_public_key(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner, err := get_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//check authorizing company (see note in set_owner() about how this is quirky)
+	if owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize updates for '" + owner.Company + "'.")
+	}
+
+	owner.PublicKey = args[2]
+	err = put_owner(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_owner_public_key")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Transfer Marble Signed - transfer a marble because its current owner signed off on it, whoever submits the tx
+//
+// The owner signs transfer_payload() with the private key matching their stored public key: ECDSA over the SHA-256 of
+// the payload, ASN.1 DER encoded, then base64. The payload includes the marble's lastModified, so a signature is only
+// good until the marble changes and can't be replayed after the transfer.
+//
+// Inputs - Array of Strings
+//       0     ,        1      ,      2     ,          3
+//  marble id  ,  to owner id  ,  signature , reason for the transfer (optional)
+// "m999999999", "o99999999999", "MEUCIQ...", "traded for a steelie"
+// ============================================================================================================================
+func transfer_marble_signed(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting transfer_marble_signed")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// input sanitation - the signature is too long for the normal checks, the memo is free text
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	new_owner_id := args[1]
+	signature := args[2]
+	memo := ""
+	if len(args) == 4 {
+		memo, err = sanitize_memo(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// check the new owner exists and can take marbles
+	owner, err := require_enabled_owner(stub, new_owner_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the signature stands in for the authing company
+	current, err := require_enabled_owner(stub, marble.Owner.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = verify_owner_signature(current, transfer_payload(marble, new_owner_id), signature)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = change_owner(stub, marble, owner, memo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transfer_marble_signed")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Transfer Payload - the exact bytes an owner signs to authorize transfer_marble_signed()
+//
+// "<marble id>\n<to owner id>\n<marble lastModified>"
+// ============================================================================================================================
+func transfer_payload(marble Marble, new_owner_id string) []byte {
+	return []byte(marble.Id + "\n" + new_owner_id + "\n" + marble.LastModified)
+}
+
+// ============================================================================================================================
+// Verify Owner Signature - error unless the base64 DER ECDSA signature over sha256(payload) matches the owner's key
+// ============================================================================================================================
+func verify_owner_signature(owner Owner, payload []byte, signature string) error {
+	if len(owner.PublicKey) == 0 {
+		return errors.New("Owner " + owner.Id + " has no public key to verify signatures with")
+	}
+	key, err := parse_public_key(owner.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("Signature must be base64 - " + err.Error())
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(der, &sig)
+	if err != nil || sig.R == nil || sig.S == nil {
+		return errors.New("Signature must be an ASN.1 DER ECDSA signature")
+	}
+
+	digest := sha256.Sum256(payload)
+	if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+		return errors.New("Signature does not match owner " + owner.Id)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Parse Public Key - decode a PEM ECDSA public key
+// ============================================================================================================================
+func parse_public_key(str string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(str))
+	if block == nil {
+		return nil, errors.New("Public key must be PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Failed to parse public key - " + err.Error())
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key must be an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// ============================================================================================================================
+// Set Secondary Color - give a marble a second color, or take it away with an empty string
+//
+// The color is normalized and checked against the palette like the primary color. Only marbles with a secondary color
+// get a secondary~id index entry.
+//
+// Inputs - Array of Strings
+//       0     ,        1       ,        2
+//  marble id  , secondary color, authing company
+// "m999999999", "white"        , "united marbles"
+// ============================================================================================================================
+func set_secondary_color(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_secondary_color")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation - the color may be empty to clear it
+	err = sanitize_arguments([]string{args[0], args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[1]) > 32 {
+		return shim.Error("Argument 1 must be <= 32 characters")
+	}
+	err = sanitize_utf8([]string{"Marble id", "Secondary color", "Authing company"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	color := normalize_color(args[1])
+	authed_by_company := args[2]
+
+	if len(color) > 0 {
+		config, err := load_config(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = config.check_color(color)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize changes for '" + marble.Owner.Company + "'.")
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// move the index entry
+	if len(marble.SecondaryColor) > 0 {
+		err = delete_index(stub, "secondary~id", []string{marble.SecondaryColor, marble.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if len(color) > 0 {
+		err = put_index(stub, "secondary~id", []string{color, marble.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	marble.SecondaryColor = color
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_secondary_color")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Split Marble - move part of a stack into a new marble with the same color, size, owner and expiry
+//
+// Quantity is conserved, the stack loses exactly what the new marble gets and both keep at least 1. No marbles are minted
+// so color caps don't apply.
+//
+// Inputs - Array of Strings
+//       0     ,       1      ,    2    ,        3
+//  marble id  , new marble id, quantity, authing company
+// "m999999999", "m888888888" ,   "4"   , "united marbles"
+// ============================================================================================================================
+func split_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting split_marble")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	new_id := args[1]
+	authed_by_company := args[3]
+	quantity, err := strconv.Atoi(args[2])
+	if err != nil || quantity <= 0 {
+		return shim.Error("3rd argument must be a positive number")
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize splits for '" + marble.Owner.Company + "'.")
+	}
+	err = check_not_collateral(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if quantity >= marble.quantity() {
+		return shim.Error("Marble " + marble_id + " only has " + strconv.Itoa(marble.quantity()) + ", can split off at most " + strconv.Itoa(marble.quantity() - 1))
+	}
+
+	// the new stack counts against the company like any other marble
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_company_cap(stub, config, marble.Owner.Company, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check if new marble id already exists
+	found, err := get_state_as(stub, new_id, &Marble{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("This id is already in use - " + new_id)
+	}
+
+	// the new stack
+	split := marble
+	split.Id = new_id
+	split.Quantity = quantity
+	split.Gift = nil                                                       //offers on the old stack don't carry over
+	split.Pool = nil
+	split.TransferCount = new(int)                                         //a new stack, nothing has been transferred yet
+	err = put_marble(stub, split)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = put_index(stub, "owner~id", []string{split.Owner.Id, split.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	add_tx_company_count(stub, split.Owner.Company, 1)
+	err = put_index(stub, "color~id", []string{split.Color, split.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = adjust_color_count(stub, split.Color, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(split.SecondaryColor) > 0 {
+		err = put_index(stub, "secondary~id", []string{split.SecondaryColor, split.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	for _, tag := range split.Tags {
+		err = put_index(stub, "tag~id", []string{tag, split.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// what's left of the old one
+	marble.Quantity = marble.quantity() - quantity
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end split_marble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Merge Marbles - add one stack's quantity to another and delete it
+//
+// Both must have the same owner, color, size and expiry. The merged marble goes away like delete_marble(), taking its
+// comments, set memberships and transfer queue with it.
+//
+// Inputs - Array of Strings
+//       0     ,        1        ,        2
+//  marble id  , merged marble id, authing company
+// "m999999999", "m888888888"    , "united marbles"
+// ============================================================================================================================
+func merge_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting merge_marbles")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	authed_by_company := args[2]
+	if args[0] == args[1] {
+		return shim.Error("Can't merge a marble with itself - " + args[0])
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	merged, err := get_marble(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize merges for '" + marble.Owner.Company + "'.")
+	}
+	if marble.Owner.Id != merged.Owner.Id || marble.Color != merged.Color || marble.Size != merged.Size || marble.ExpiresAt != merged.ExpiresAt {
+		return shim.Error("Only marbles with the same owner, color, size and expiry can be merged")
+	}
+
+	err = check_not_collateral(marble)                                     //remove_marble() checks the merged one
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_not_quarantined(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble.Quantity = marble.quantity() + merged.quantity()
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = remove_marble(stub, merged)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end merge_marbles")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Lock As Collateral - lock a marble against a loan, until released or liquidated it can't be transferred or deleted
+//
+// Inputs - Array of Strings
+//       0     ,    1     ,       2       ,        3
+//  marble id  , loan id  ,   lender id   , authing company
+// "m999999999", "loan-42", "o99999999999", "united marbles"
+// ============================================================================================================================
+func lock_as_collateral(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting lock_as_collateral")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	collateral := Collateral{LoanId: args[1], LenderId: args[2]}
+	authed_by_company := args[3]
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize loans for '" + marble.Owner.Company + "'.")
+	}
+	err = check_not_collateral(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the lender has to be able to take it on default
+	lender, err := require_enabled_owner(stub, collateral.LenderId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if lender.Id == marble.Owner.Id {
+		return shim.Error("Owner " + lender.Id + " can't lend against their own marble")
+	}
+
+	marble.Collateral = &collateral
+	marble.Gift = nil                                                      //nobody can claim it while it's locked
+	marble.Pool = nil
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end lock_as_collateral")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Release Collateral - the lender unlocks a marble once its loan is repaid
+//
+// Inputs - Array of Strings
+//       0     ,           1
+//  marble id  , lender's authing company
+// "m999999999", "marble bank"
+// ============================================================================================================================
+func release_collateral(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting release_collateral")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Collateral == nil {
+		return shim.Error("Marble " + marble.Id + " is not locked as collateral")
+	}
+
+	// only the lender's company can let it go
+	lender, err := get_owner(stub, marble.Collateral.LenderId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if lender.Company != args[1] {
+		return shim.Error("The company '" + args[1] + "' cannot authorize releases for '" + lender.Company + "'.")
+	}
+
+	marble.Collateral = nil
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end release_collateral")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Liquidate Collateral - admin only, the loan defaulted so the locked marble goes to the lender
+//
+// The lender is owed the marble, so neither the transfer cooldown nor the lender company's cap can hold it back.
+//
+// Inputs - Array of Strings
+//       0
+//  marble id
+// "m999999999"
+// ============================================================================================================================
+func liquidate_collateral(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting liquidate_collateral")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Collateral == nil {
+		return shim.Error("Marble " + marble.Id + " is not locked as collateral")
+	}
+	lender, err := get_owner(stub, marble.Collateral.LenderId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// unlock it and hand it over
+	loan_id := marble.Collateral.LoanId
+	marble.Collateral = nil
+	err = move_marble(stub, marble, lender, "liquidated for loan " + loan_id)  //no cooldown or cap, see above
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end liquidate_collateral")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Check Not Collateral - error if the marble is locked as collateral
+// ============================================================================================================================
+func check_not_collateral(marble Marble) error {
+	if marble.Collateral != nil {
+		return errors.New("Marble " + marble.Id + " is locked as collateral for loan " + marble.Collateral.LoanId)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Tag Marbles By Query - admin only, add a tag to up to a page of the marbles of a color
+//
+// The query is a color, walked with the color~id index so it works on LevelDB too. Marbles already carrying the tag are
+// skipped and don't count toward the page, so call again with the same args while "more" is true. Running it again
+// after that changes nothing.
+//
+// Inputs - Array of Strings
+//     0   ,    1   ,     2
+//   color ,   tag  , page size
+//   "red" , "promo",   "50"
+//
+// Returns:
+// {
+//	"tagged": 50,
+//	"more": true
+// }
+// ============================================================================================================================
+func tag_marbles_by_query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type TagResult struct {
+		Tagged int  `json:"tagged"`
+		More   bool `json:"more"`                                          //true if untagged marbles of the color remain, call again
+	}
+	var result TagResult
+	fmt.Println("starting tag_marbles_by_query")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = sanitize_utf8([]string{"Color", "Tag", "Page size"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	color := normalize_color(args[0])
+	tag := normalize_tag(args[1])
+	pageSize, err := strconv.Atoi(args[2])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find a page of marbles without the tag
+	var untagged []Marble
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("color~id", []string{color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		indexKey, _, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := get_marble(stub, keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if marble.has_tag(tag) {
+			continue
+		}
+		if len(untagged) == pageSize {                                     //page is full, leave the rest for next time
+			result.More = true
+			break
+		}
+		untagged = append(untagged, marble)
+	}
+
+	// tag them
+	for _, marble := range untagged {
+		marble.Tags = append(marble.Tags, tag)
+		err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = put_index(stub, "tag~id", []string{tag, marble.Id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Tagged++
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end tag_marbles_by_query")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Increment Marble Counter - add a delta to a marble's views or score
+//
+// The read, add and write happen in this one tx, so if two increments race MVCC rejects the second one at commit instead
+// of one silently overwriting the other. Counters stay between 0 and the max int64, a delta that would leave that range
+// is rejected rather than wrapped or clamped. Only the owner's company may bump them, and lastModified is left alone, a
+// counter isn't a change to the marble and must not restart its transfer cooldown.
+//
+// Inputs - Array of Strings
+//       0     ,    1   ,   2  ,        3
+//  marble id  , counter, delta, authing company
+// "m999999999", "views",  "1" , "united marbles"
+// ============================================================================================================================
+func increment_marble_counter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting increment_marble_counter")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	authed_by_company := args[3]
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || delta == 0 {
+		return shim.Error("3rd argument must be a non-zero number")
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize changes for '" + marble.Owner.Company + "'.")
+	}
+
+	var counter *int64
+	switch args[1] {
+	case "views":
+		counter = &marble.Views
+	case "score":
+		counter = &marble.Score
+	default:
+		return shim.Error("Counter must be 'views' or 'score'")
+	}
+
+	if delta > 0 && *counter > math.MaxInt64 - delta {
+		return shim.Error("Counter " + args[1] + " on marble " + marble_id + " would overflow")
+	}
+	if delta < 0 && *counter + delta < 0 {
+		return shim.Error("Counter " + args[1] + " on marble " + marble_id + " can't go below 0")
+	}
+	*counter += delta
+
+	marbleAsBytes, _ := json.Marshal(marble)                               //not put_marble(), keep lastModified
+	err = stub.PutState(marble.Id, marbleAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end increment_marble_counter")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Set Insured Value - admin only, set what a marble is insured for
+//
+// The caller and tx time are stamped on the marble next to the value, so the marble's history (see getHistory()) is the
+// audit trail of every change.
+//
+// Inputs - Array of Strings
+//       0     ,      1
+//  marble id  , insured value
+// "m999999999",    "500"
+// ============================================================================================================================
+func set_insured_value(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_insured_value")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble_id := args[0]
+	value, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || value < 0 {
+		return shim.Error("2nd argument must be a number, 0 or more")
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, cert, err := get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// get marble's current state
+	marble, err := get_marble(stub, marble_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble.InsuredValue = value
+	marble.InsuredValueSet = &AuditStamp{By: mspId + "/" + cert.Subject.CommonName, At: txTime.Format(time_format)}
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_insured_value")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Create Offer - offer a marble in trade for any marble with a color and/or size, see match_offers()
+//
+// An offer is stored under "offer~id" and takes the id of the tx that made it. It is also indexed under "offer~time~id"
+// by its tx timestamp so offers match oldest first. Nothing is shared between offers, so offers made at the same time
+// never conflict.
+//
+// Inputs - Array of Strings
+//       0     ,      1      ,      2     ,        3
+//  marble id  , wanted color, wanted size, authing company
+// "m999999999",   "red"     ,    "0"     , "united marbles"
+//
+// "any" as the color, or "0" as the size, accepts any.
+//
+// Returns:
+// {
+//	"id": "f2c5a1e0..."
+// }
+// ============================================================================================================================
+func create_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting create_offer")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var offer Offer
+	offer.ObjectType = "marble_offer"
+	offer.MarbleId = args[0]
+	offer.WantColor = normalize_color(args[1])
+	if offer.WantColor == "any" {
+		offer.WantColor = ""
+	}
+	offer.WantSize, err = strconv.Atoi(args[2])
+	if err != nil || offer.WantSize < 0 {
+		return shim.Error("3rd argument must be a size, or 0 for any")
+	}
+	authed_by_company := args[3]
+
+	marble, err := get_marble(stub, offer.MarbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Owner.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize offers for '" + marble.Owner.Company + "'.")
+	}
+	err = check_not_collateral(marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = require_enabled_owner(stub, marble.Owner.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer.OwnerId = marble.Owner.Id
+
+	// the tx places it in line
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer.Id = stub.GetTxID()
+	offer.CreatedAt = txTime.Format(time_format)
+
+	err = put_offer(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, _ := json.Marshal(map[string]string{"id": offer.Id})
+	fmt.Println("- end create_offer")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Cancel Offer - withdraw an open offer
+//
+// Inputs - Array of Strings
+//       0      ,        1
+//   offer id   , authing company
+// "f2c5a1e0...", "united marbles"
+// ============================================================================================================================
+func cancel_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting cancel_offer")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, err := get_offer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner, err := get_owner(stub, offer.OwnerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner.Company != args[1] {
+		return shim.Error("The company '" + args[1] + "' cannot authorize offers for '" + owner.Company + "'.")
+	}
+
+	err = delete_offer(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end cancel_offer")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Match Offers - swap the marbles of every pair of open offers that want each other's marble
+//
+// Offers are taken oldest first, and each is paired with the oldest later offer that fits both ways, so nobody gets cut
+// in line. Matched offers are closed. An offer whose marble has changed owner, been deleted, locked or quarantined since
+// is stale and is closed without a swap. Offers that can't go through yet, the marble is cooling down or a company cap
+// is in the way, are left open for a later run. A swap is checked against the caps as a whole, so a company at its cap
+// can still trade one for one. A tx keeps one event, so the transfer events are replaced by one "offers_matched" event
+// with every swap.
+//
+// Returns:
+// {
+//	"matched": [["f2c5a1e0...", "9b07d3c4..."]],
+//	"stale": ["4e81a6f2..."]
+// }
+// ============================================================================================================================
+func match_offers(stub shim.ChaincodeStubInterface) pb.Response {
+	type MatchResult struct {
+		Matched [][2]string `json:"matched"`                           //offer ids of the swapped pairs
+		Stale   []string    `json:"stale"`
+	}
+	type OpenOffer struct {
+		Offer
+		marble Marble
+	}
+	result := MatchResult{Matched: [][2]string{}, Stale: []string{}}
+	fmt.Println("starting match_offers")
+
+	config, err := load_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// gather the open offers that can still happen, oldest first
+	var open []*OpenOffer
+	offer_ids, err := index_ids(stub, "offer~time~id", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, offer_id := range offer_ids {
+		offer := &OpenOffer{}
+		offer.Offer, err = get_offer(stub, offer_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		offer.marble, err = get_marble(stub, offer.MarbleId)
+		if err != nil || offer.marble.Owner.Id != offer.OwnerId || offer.marble.Collateral != nil || offer.marble.Quarantine != nil {
+			err = delete_offer(stub, offer.Offer)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			result.Stale = append(result.Stale, offer.Id)
+			continue
+		}
+		if check_transfer_cooldown(stub, offer.marble) != nil {          //still cooling down, leave it open for a later run
+			continue
+		}
+		open = append(open, offer)
+	}
+
+	wants := func(offer *OpenOffer, marble Marble) bool {
+		return (offer.WantColor == "" || offer.WantColor == marble.Color) && (offer.WantSize == 0 || offer.WantSize == marble.Size)
+	}
+
+	// a swap has room if no company gains more marbles than its cap allows, what it gives away counts
+	has_room := func(a *OpenOffer, aOwner Owner, b *OpenOffer, bOwner Owner) bool {
+		gained := map[string]int{}
+		gained[bOwner.Company]++
+		gained[a.marble.Owner.Company]--
+		gained[aOwner.Company]++
+		gained[b.marble.Owner.Company]--
+		for company, adding := range gained {
+			if adding > 0 && check_company_cap(stub, config, company, adding) != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	// pair them up
+	closed := map[string]bool{}
+	moved := map[string]bool{}                                             //a marble can be in more than one offer
+	for i, a := range open {
+		if closed[a.Id] || moved[a.MarbleId] {
+			continue
+		}
+		for _, b := range open[i + 1:] {
+			if closed[b.Id] || moved[b.MarbleId] || b.OwnerId == a.OwnerId {
+				continue
+			}
+			if !wants(a, b.marble) || !wants(b, a.marble) {
+				continue
+			}
+
+			// swap
+			aOwner, err := require_enabled_owner(stub, a.OwnerId)
+			if err != nil {
+				continue
+			}
+			bOwner, err := require_enabled_owner(stub, b.OwnerId)
+			if err != nil {
+				continue
+			}
+			if !has_room(a, aOwner, b, bOwner) {                           //leave both open, the cap may have room later
+				continue
+			}
+			err = move_marble(stub, a.marble, bOwner, "trade offer " + a.Id)  //cooldowns were checked above
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = move_marble(stub, b.marble, aOwner, "trade offer " + b.Id)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+
+			// close both
+			for _, offer := range []*OpenOffer{a, b} {
+				err = delete_offer(stub, offer.Offer)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				closed[offer.Id] = true
+				moved[offer.MarbleId] = true
+			}
+			result.Matched = append(result.Matched, [2]string{a.Id, b.Id})
+			break
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	if len(result.Matched) > 0 {
+		err = stub.SetEvent("offers_matched", resultAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	fmt.Println("- end match_offers")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Put Offer - store an offer under its id and index it by when it was made
+// ============================================================================================================================
+func put_offer(stub shim.ChaincodeStubInterface, offer Offer) error {
+	key, err := stub.CreateCompositeKey("offer~id", []string{offer.Id})
+	if err != nil {
+		return err
+	}
+	offerAsBytes, _ := json.Marshal(offer)                                 //convert to array of bytes
+	err = stub.PutState(key, offerAsBytes)
+	if err != nil {
+		return err
+	}
+	return put_index(stub, "offer~time~id", []string{offer.CreatedAt, offer.Id})
+}
+
+// ============================================================================================================================
+// Get Offer - get an open offer from ledger
+// ============================================================================================================================
+func get_offer(stub shim.ChaincodeStubInterface, id string) (Offer, error) {
+	var offer Offer
+	key, err := stub.CreateCompositeKey("offer~id", []string{id})
+	if err != nil {
+		return offer, err
+	}
+	found, err := get_state_as(stub, key, &offer)
+	if err != nil {
+		return offer, err
+	}
+	if !found {
+		return offer, errors.New("Offer does not exist - " + id)
+	}
+	return offer, nil
+}
+
+// ============================================================================================================================
+// Delete Offer - remove an offer and its index entry
+// ============================================================================================================================
+func delete_offer(stub shim.ChaincodeStubInterface, offer Offer) error {
+	key, err := stub.CreateCompositeKey("offer~id", []string{offer.Id})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	return delete_index(stub, "offer~time~id", []string{offer.CreatedAt, offer.Id})
+}
+
+// ============================================================================================================================
+// Send Message - send another owner a message about a marble
+//
+// Messages are stored under "msg~toowner~seq" so an inbox reads back in order. Like comments they are kept on the ledger
+// for good, for the audit trail, so an inbox stops taking messages once it is full.
+//
+// Inputs - Array of Strings
+//          0    ,       1      ,      2     ,           3            ,        4
+//  from owner id, to owner id  , marble id  , text                   , authing company
+// "o99999999999", "o88888888888", "m999999999", "trade for your steelie?", "united marbles"
+// ============================================================================================================================
+func send_message(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting send_message")
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	// input sanitation - the text is allowed to be longer than an id
+	err = sanitize_arguments([]string{args[0], args[1], args[2], args[4]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[3]) == 0 {
+		return shim.Error("Message text must be a non-empty string")
+	}
+	if len(args[3]) > max_message_length {
+		return shim.Error("Message text must be <= " + strconv.Itoa(max_message_length) + " characters")
+	}
+	err = sanitize_utf8([]string{"From owner id", "To owner id", "Marble id", "Text", "Authing company"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var message Message
+	message.ObjectType = "marble_message"
+	message.FromOwnerId = args[0]
+	message.ToOwnerId = args[1]
+	message.MarbleId = args[2]
+	message.Text = args[3]
+	authed_by_company := args[4]
+
+	// check the sender, the recipient and the marble
+	sender, err := require_enabled_owner(stub, message.FromOwnerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if sender.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize messages for '" + sender.Company + "'.")
+	}
+	_, err = get_owner(stub, message.ToOwnerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = get_marble(stub, message.MarbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// next sequence number is the number of messages so far, messages are never removed
+	count, err := count_index(stub, "msg~toowner~seq", []string{message.ToOwnerId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if count >= max_inbox_size {
+		return shim.Error("Owner " + message.ToOwnerId + " already has the max of " + strconv.Itoa(max_inbox_size) + " messages")
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	message.Timestamp = txTime.Format(time.RFC3339)
+
+	// store message
+	key, err := stub.CreateCompositeKey("msg~toowner~seq", []string{message.ToOwnerId, fmt.Sprintf("%06d", count)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	messageAsBytes, _ := json.Marshal(message)                             //convert to array of bytes
+	err = stub.PutState(key, messageAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end send_message")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Add Condition Report - append an inspector's report on a marble's condition
+//
+// Only callers whose cert has the "marbles.inspector" attribute may add reports, its value is recorded as the inspector id.
+// Reports are stored under "report~marble~seq" and are never changed or removed, not even with their marble.
+//
+// Inputs - Array of Strings
+//       0     ,           1            ,   2
+//  marble id  , findings               , grade (1-10)
+// "m999999999", "hairline crack, faded", "6"
+// ============================================================================================================================
+func add_condition_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting add_condition_report")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation - the findings are allowed to be longer than an id
+	err = sanitize_arguments([]string{args[0], args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[1]) == 0 {
+		return shim.Error("Findings must be a non-empty string")
+	}
+	if len(args[1]) > max_comment_length {
+		return shim.Error("Findings must be <= " + strconv.Itoa(max_comment_length) + " characters")
+	}
+	err = sanitize_utf8([]string{"Marble id", "Findings", "Grade"}, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var report ConditionReport
+	report.ObjectType = "marble_condition_report"
+	report.MarbleId = args[0]
+	report.Findings = args[1]
+	report.Grade, err = strconv.Atoi(args[2])
+	if err != nil || report.Grade < 1 || report.Grade > 10 {
+		return shim.Error("Grade must be a number from 1 to 10")
+	}
+
+	// only inspectors may report
+	inspector, found, err := get_caller_attribute(stub, inspector_attribute)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found || len(inspector) == 0 {
+		return shim.Error("Caller's certificate does not have the attribute '" + inspector_attribute + "'")
+	}
+	report.InspectorId = inspector
+
+	_, err = get_marble(stub, report.MarbleId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// next sequence number is the number of reports so far, reports are never removed
+	count, err := count_index(stub, "report~marble~seq", []string{report.MarbleId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if count >= max_reports_per_marble {
+		return shim.Error("Marble " + report.MarbleId + " already has the max of " + strconv.Itoa(max_reports_per_marble) + " condition reports")
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.Timestamp = txTime.Format(time.RFC3339)
+
+	// store report
+	key, err := stub.CreateCompositeKey("report~marble~seq", []string{report.MarbleId, fmt.Sprintf("%06d", count)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reportAsBytes, _ := json.Marshal(report)                       //convert to array of bytes
+	err = stub.PutState(key, reportAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_condition_report")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Record Transfer Attempt - log a failed transfer on the marble so retries are coordinated on the ledger
+//
+// Each failure doubles the wait before the next try, starting at transfer_retry_seconds. After max_transfer_attempts the
+// marble is flagged for review and no more attempts are logged until clear_transfer_attempts(). A transfer that goes
+// through clears the log by itself. A failed attempt isn't a change to the marble, lastModified is left alone so the
+// marble still shows up in find_stuck_marbles().
+//
+// Inputs - Array of Strings
+//       0     ,            1            ,        2
+//   marble id ,          error          , authing company
+// "m999999999", "owner o88888888 disabled", "united marbles"
+//
+// Returns:
+// {
+//	"count": 2,
+//	"lastError": "owner o88888888 disabled",
+//	"nextEligible": "2017-06-01T12:01:00.000Z"
+// }
+// ============================================================================================================================
+func record_transfer_attempt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting record_transfer_attempt")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation - the error is free text and gets its own checks
+	err := sanitize_arguments([]string{args[0], args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	lastError, err := sanitize_memo(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company (see note in set_owner() about how this is quirky)
+	if marble.Owner.Company != args[2] {
+		return shim.Error("The company '" + args[2] + "' cannot authorize transfers for '" + marble.Owner.Company + "'.")
+	}
+
+	attempts := TransferAttempts{}
+	if marble.TransferAttempts != nil {
+		attempts = *marble.TransferAttempts
+	}
+	if attempts.NeedsReview {
+		return shim.Error("Marble " + marble.Id + " needs review after " + strconv.Itoa(attempts.Count) + " failed transfers, clear its attempts first")
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	attempts.Count++
+	attempts.LastError = lastError
+	backoff := time.Duration(transfer_retry_seconds) * time.Second << uint(attempts.Count - 1)
+	attempts.NextEligible = txTime.Add(backoff).Format(time_format)
+	attempts.NeedsReview = attempts.Count >= max_transfer_attempts
+	marble.TransferAttempts = &attempts
+
+	marbleAsBytes, _ := json.Marshal(marble)                               //not put_marble(), keep lastModified
+	err = stub.PutState(marble.Id, marbleAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	attemptsAsBytes, _ := json.Marshal(attempts)                           //convert to array of bytes
+	fmt.Println("- end record_transfer_attempt")
+	return shim.Success(attemptsAsBytes)
+}
+
+// ============================================================================================================================
+// Clear Transfer Attempts - forget a marble's failed transfers, once a retry worked or after review
+//
+// Inputs - Array of Strings
+//       0     ,        1
+//   marble id , authing company
+// "m999999999", "united marbles"
+// ============================================================================================================================
+func clear_transfer_attempts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting clear_transfer_attempts")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check authorizing company (see note in set_owner() about how this is quirky)
+	if marble.Owner.Company != args[1] {
+		return shim.Error("The company '" + args[1] + "' cannot authorize transfers for '" + marble.Owner.Company + "'.")
+	}
+
+	if marble.TransferAttempts != nil {                                    //nothing to write if there is nothing logged
+		marble.TransferAttempts = nil
+		err = put_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end clear_transfer_attempts")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Backfill Transfer Counts - admin only, set transferCount on marbles from before it existed by counting their history
+//
+// Marbles that already have a count are left alone, so it is safe to run again. lastModified is left as it was, this is
+// a migration and not a change to the marble. Pass the returned bookmark back until it comes back empty.
+//
+// Inputs - Array of Strings
+//       0     ,     1
+//    bookmark , page size
+//       ""    ,   "50"
+//
+// Returns:
+// {
+//	"backfilled": 12,
+//	"bookmark": "m888888888"
+// }
+// ============================================================================================================================
+func backfill_transfer_counts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type BackfillResult struct {
+		Backfilled int    `json:"backfilled"`
+		Bookmark   string `json:"bookmark"`                                  //last marble checked, empty once done
+	}
+	var result BackfillResult
+	fmt.Println("starting backfill_transfer_counts")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	err := require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	lastKey := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize <= 0 || pageSize > max_page_size {
+		return shim.Error("Page size must be a number from 1 to " + strconv.Itoa(max_page_size))
+	}
+
+	startKey := "m0"
+	if len(lastKey) > 0 {
+		startKey = lastKey
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	checked := 0
+	for resultsIterator.HasNext() {
+		key, queryValAsBytes, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if key == lastKey {                                                //the bookmark was the last one done
+			continue
+		}
+		if checked == pageSize {                                           //page is full, leave the rest for next time
+			result.Bookmark = lastKey
+			break
+		}
+		checked++
+		lastKey = key
+
+		var marble Marble
+		json.Unmarshal(queryValAsBytes, &marble)                           //un stringify it aka JSON.parse()
+		if marble.TransferCount != nil {
+			continue
+		}
+		count, err := count_transfers(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble.TransferCount = &count
+		marbleAsBytes, _ := json.Marshal(marble)                           //not put_marble(), keep lastModified
+		err = stub.PutState(key, marbleAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Backfilled++
+	}
+
+	resultAsBytes, _ := json.Marshal(result)                               //convert to array of bytes
+	fmt.Println("- end backfill_transfer_counts")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================================================================================
+// Quarantine Marble - admin only, flag a marble for investigation
+//
+// A quarantined marble is left out of the marble queries and can't change owner until release_quarantine(). Unlike
+// collateral, which its owner's deal puts on it, this is a moderation action, so the reason and the admin are recorded.
+//
+// Inputs - Array of Strings
+//       0     ,             1
+//   marble id ,           reason
+// "m999999999", "reported stolen, case 1234"
+// ============================================================================================================================
+func quarantine_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting quarantine_marble")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation - the reason is free text and gets its own checks
+	err := sanitize_arguments(args[:1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reason, err := sanitize_memo(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(reason) == 0 {
+		return shim.Error("A reason is required to quarantine a marble")
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, cert, err := get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Quarantine != nil {
+		return shim.Error("Marble " + marble.Id + " is already quarantined")
+	}
+
+	marble.Quarantine = &Quarantine{Reason: reason, AuditStamp: AuditStamp{By: mspId + "/" + cert.Subject.CommonName, At: txTime.Format(time_format)}}
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end quarantine_marble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Release Quarantine - admin only, put a quarantined marble back in circulation
+//
+// Inputs - Array of Strings
+//       0
+//   marble id
+// "m999999999"
+// ============================================================================================================================
+func release_quarantine(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting release_quarantine")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = require_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marble, err := get_marble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marble.Quarantine == nil {
+		return shim.Error("Marble " + marble.Id + " is not quarantined")
+	}
+
+	marble.Quarantine = nil
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end release_quarantine")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Check Not Quarantined - error if an admin has quarantined the marble
+// ============================================================================================================================
+func check_not_quarantined(marble Marble) error {
+	if marble.Quarantine != nil {
+		return errors.New("Marble " + marble.Id + " is quarantined - " + marble.Quarantine.Reason)
+	}
+	return nil
+}
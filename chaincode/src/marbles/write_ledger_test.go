@@ -0,0 +1,1469 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// write() - reserved keys
+// ============================================================================================================================
+func TestWriteRefusesReservedKeys(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "Org1MSP", "mallory", nil)
+
+	must_fail(t, stub.invoke("write", config_key, `{"admins":["Org1MSP"]}`), "reserved")
+	must_fail(t, stub.invoke("write", demo_seed_key, "true"), "reserved")
+	colorCountKey, _ := stub.CreateCompositeKey("colorcount~color", []string{"blue"})
+	must_fail(t, stub.invoke("write", colorCountKey, "99"), "reserved")
+
+	// still not an admin
+	must_fail(t, stub.invoke("quarantine_marble", "m0000000000001", "mine now"), "not an admin")
+
+	// anything else still goes
+	must_ok(t, stub.invoke("write", "abc", "test"))
+	value, _ := stub.GetState("abc")
+	if string(value) != "test" {
+		t.Fatalf("expected abc to be written, got %q", string(value))
+	}
+}
+
+// ============================================================================================================================
+// match_offers() - company caps
+// ============================================================================================================================
+func TestMatchOffersTradesOneForOneAtCompanyCap(t *testing.T) {
+	stub := new_test_stub(t, `{"companyCaps": {"Alpha": 1, "Beta": 1}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000002", "Beta")
+
+	must_ok(t, stub.call(create_offer, "m0000000000001", "blue", "20", "Alpha"))
+	must_ok(t, stub.call(create_offer, "m0000000000002", "red", "10", "Beta"))
+	var result struct {
+		Matched [][2]string `json:"matched"`
+		Stale   []string    `json:"stale"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("match_offers")), &result)
+	if len(result.Matched) != 1 || len(result.Stale) != 0 {
+		t.Fatalf("expected one match and nothing stale, got %+v", result)
+	}
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000002" || stub.get_marble(t, "m0000000000002").Owner.Id != "o0000000000001" {
+		t.Fatal("expected the marbles to be swapped")
+	}
+}
+
+// ============================================================================================================================
+// set_owner() - transfer cooldown
+// ============================================================================================================================
+func TestTransferCooldown(t *testing.T) {
+	stub := new_test_stub(t, `{"transferCooldownSeconds": 60}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	// never transferred, no cooldown yet
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	if stub.get_marble(t, "m0000000000001").LastTransfer != test_start.Format(time_format) {
+		t.Fatal("expected lastTransfer to be stamped with the tx time")
+	}
+
+	// within the cooldown
+	stub.now = test_start.Add(30 * time.Second)
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"), "cooldown")
+
+	// other writes don't restart it
+	stub.now = test_start.Add(59 * time.Second)
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000001", "blue", "Alpha"))
+	stub.now = test_start.Add(61 * time.Second)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000001" {
+		t.Fatal("expected the marble to go back to amy")
+	}
+}
+
+// ============================================================================================================================
+// record_transfer_attempt() - backoff, review and clearing
+// ============================================================================================================================
+func TestRecordTransferAttempt(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	created := stub.get_marble(t, "m0000000000001").LastModified
+
+	var attempts TransferAttempts
+	stub.now = test_start.Add(time.Hour)
+	must_decode(t, must_ok(t, stub.invoke("record_transfer_attempt", "m0000000000001", "owner disabled", "Alpha")), &attempts)
+	if attempts.Count != 1 || attempts.NextEligible != stub.now.Add(30*time.Second).Format(time_format) {
+		t.Fatalf("expected a first attempt retrying in 30s, got %+v", attempts)
+	}
+	must_decode(t, must_ok(t, stub.invoke("record_transfer_attempt", "m0000000000001", "owner disabled", "Alpha")), &attempts)
+	if attempts.Count != 2 || attempts.NextEligible != stub.now.Add(60*time.Second).Format(time_format) {
+		t.Fatalf("expected the backoff to double, got %+v", attempts)
+	}
+	if stub.get_marble(t, "m0000000000001").LastModified != created {
+		t.Fatal("expected a failed attempt to leave lastModified alone")
+	}
+
+	// a stuck retry is still found
+	var report struct {
+		Stuck map[string][]string `json:"stuck"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("find_stuck_marbles", "1800", "", "10")), &report)
+	if len(report.Stuck["transfer_retry"]) != 1 {
+		t.Fatalf("expected the marble to be stuck retrying, got %+v", report)
+	}
+
+	// hitting the max
+	for i := attempts.Count; i < max_transfer_attempts; i++ {
+		must_ok(t, stub.invoke("record_transfer_attempt", "m0000000000001", "owner disabled", "Alpha"))
+	}
+	if !stub.get_marble(t, "m0000000000001").TransferAttempts.NeedsReview {
+		t.Fatal("expected the marble to need review")
+	}
+	must_fail(t, stub.invoke("record_transfer_attempt", "m0000000000001", "owner disabled", "Alpha"), "needs review")
+
+	// cleared, then a transfer that goes through clears the log by itself
+	must_ok(t, stub.invoke("clear_transfer_attempts", "m0000000000001", "Alpha"))
+	must_ok(t, stub.invoke("record_transfer_attempt", "m0000000000001", "owner disabled", "Alpha"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	if stub.get_marble(t, "m0000000000001").TransferAttempts != nil {
+		t.Fatal("expected a successful transfer to clear the attempts")
+	}
+}
+
+// ============================================================================================================================
+// process_transfer_queue() - first in line wins, failures are dropped with a reason
+// ============================================================================================================================
+func TestProcessTransferQueue(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"], "companyCaps": {"Beta": 0}, "transferCooldownSeconds": 60}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.owner(t, "o0000000000004", "dan", "Alpha")
+	stub.owner(t, "o0000000000005", "eve", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	must_ok(t, stub.invoke("enqueue_transfer", "m0000000000001", "o0000000000002", "Beta"))   //no room at Beta
+	must_ok(t, stub.invoke("enqueue_transfer", "m0000000000001", "o0000000000003", "Alpha"))  //disabled below
+	must_ok(t, stub.invoke("enqueue_transfer", "m0000000000001", "o0000000000004", "Alpha"))  //first one that can take it
+	must_ok(t, stub.invoke("enqueue_transfer", "m0000000000001", "o0000000000005", "Alpha"))
+	must_ok(t, stub.invoke("update_owner", "o0000000000003", "Alpha", "false", "none", "false"))
+
+	type QueueResult struct {
+		TransferredTo string   `json:"transferredTo"`
+		Dropped       int      `json:"dropped"`
+		Reasons       []string `json:"reasons"`
+		Blocked       string   `json:"blocked"`
+	}
+	var result QueueResult
+	must_decode(t, must_ok(t, stub.invoke("process_transfer_queue", "m0000000000001")), &result)
+	if result.TransferredTo != "o0000000000004" || result.Dropped != 2 || len(result.Reasons) != 2 {
+		t.Fatalf("expected dan to get the marble after 2 drops, got %+v", result)
+	}
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000004" {
+		t.Fatal("expected dan to own the marble")
+	}
+
+	// cooling down, eve keeps her place in line
+	result = QueueResult{}
+	must_decode(t, must_ok(t, stub.invoke("process_transfer_queue", "m0000000000001")), &result)
+	if result.TransferredTo != "" || result.Dropped != 0 || len(result.Blocked) == 0 {
+		t.Fatalf("expected the queue to be blocked by the cooldown, got %+v", result)
+	}
+	stub.now = test_start.Add(time.Minute)
+	result = QueueResult{}
+	must_decode(t, must_ok(t, stub.invoke("process_transfer_queue", "m0000000000001")), &result)
+	if result.TransferredTo != "o0000000000005" {
+		t.Fatalf("expected eve to get the marble once the cooldown passed, got %+v", result)
+	}
+
+	// the current owner has to be enabled
+	must_ok(t, stub.invoke("enqueue_transfer", "m0000000000001", "o0000000000004", "Alpha"))
+	must_ok(t, stub.invoke("update_owner", "o0000000000005", "Alpha", "false", "none", "false"))
+	stub.now = test_start.Add(2 * time.Minute)
+	result = QueueResult{}
+	must_decode(t, must_ok(t, stub.invoke("process_transfer_queue", "m0000000000001")), &result)
+	if result.TransferredTo != "" || result.Dropped != 0 || len(result.Blocked) == 0 {
+		t.Fatalf("expected a disabled owner to block the queue, got %+v", result)
+	}
+}
+
+// ============================================================================================================================
+// lock_as_collateral() - release and liquidate
+// ============================================================================================================================
+func TestCollateral(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"], "companyCaps": {"Bank": 1}, "transferCooldownSeconds": 3600}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000009", "lender", "Bank")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000009", "gold", 10, "o0000000000009", "Bank")  //the bank is at its cap
+
+	// lock, can't move, release
+	must_ok(t, stub.invoke("lock_as_collateral", "m0000000000001", "loan1", "o0000000000009", "Alpha"))
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"), "collateral")
+	must_ok(t, stub.invoke("release_collateral", "m0000000000001", "Bank"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+
+	// lock and liquidate, a marble cooling down still goes to a lender at its cap
+	must_ok(t, stub.invoke("set_owner", "m0000000000002", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("lock_as_collateral", "m0000000000002", "loan2", "o0000000000009", "Alpha"))
+	must_ok(t, stub.invoke("liquidate_collateral", "m0000000000002"))
+	marble := stub.get_marble(t, "m0000000000002")
+	if marble.Owner.Id != "o0000000000009" || marble.Collateral != nil {
+		t.Fatalf("expected the lender to get the unlocked marble, got %+v", marble)
+	}
+	must_fail(t, stub.invoke("liquidate_collateral", "m0000000000002"), "not locked")
+}
+
+// ============================================================================================================================
+// canonicalize_marbles() - messy marbles and owners, a page at a time, then again
+// ============================================================================================================================
+func TestCanonicalizeMarbles(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000002", "Beta")
+
+	// mess up amy and her marble the way older code wrote them
+	stub.run(func() pb.Response {
+		owner := stub.get_owner(t, "o0000000000001")
+		owner.Username = " AMY "
+		owner.Company = " Alpha "
+		ownerAsBytes, _ := json.Marshal(owner)
+		stub.PutState(owner.Id, ownerAsBytes)
+		delete_index(stub, "company~owner", []string{"Alpha", owner.Id})
+		put_index(stub, "company~owner", []string{" Alpha ", owner.Id})
+
+		marble := stub.get_marble(t, "m0000000000001")
+		marble.Color = "Red "
+		marble.Owner.Username = " AMY "
+		marble.Owner.Company = " Alpha "
+		marbleAsBytes, _ := json.Marshal(marble)
+		stub.PutState(marble.Id, marbleAsBytes)
+		delete_index(stub, "color~id", []string{"red", marble.Id})
+		put_index(stub, "color~id", []string{"Red ", marble.Id})
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	type CanonicalizeResult struct {
+		Scanned          int    `json:"scanned"`
+		Normalized       int    `json:"normalized"`
+		NormalizedOwners int    `json:"normalizedOwners"`
+		Bookmark         string `json:"bookmark"`
+	}
+	canonicalize := func(pageSize string) (CanonicalizeResult, int) {
+		total := CanonicalizeResult{}
+		pages := 0
+		for {
+			var result CanonicalizeResult
+			must_decode(t, must_ok(t, stub.invoke("canonicalize_marbles", total.Bookmark, pageSize)), &result)
+			pages++
+			total.Scanned += result.Scanned
+			total.Normalized += result.Normalized
+			total.NormalizedOwners += result.NormalizedOwners
+			total.Bookmark = result.Bookmark
+			if len(result.Bookmark) == 0 {
+				if result.Scanned == 0 {
+					t.Fatal("expected the last page to come back with an empty bookmark, not one more empty page")
+				}
+				return total, pages
+			}
+		}
+	}
+
+	// a page per key, the last page ends exactly on the last key
+	total, pages := canonicalize("1")
+	if pages != total.Scanned || total.Normalized != 1 || total.NormalizedOwners != 1 {
+		t.Fatalf("expected one marble and one owner fixed a key per page, got %+v over %d pages", total, pages)
+	}
+	marble := stub.get_marble(t, "m0000000000001")
+	if marble.Color != "red" || marble.Owner.Username != "amy" || marble.Owner.Company != "Alpha" {
+		t.Fatalf("expected a canonical marble, got %+v", marble)
+	}
+	owner := stub.get_owner(t, "o0000000000001")
+	if owner.Username != "amy" || owner.Company != "Alpha" {
+		t.Fatalf("expected a canonical owner, got %+v", owner)
+	}
+	if ids, _ := index_ids(stub, "company~owner", []string{"Alpha"}); len(ids) != 1 || ids[0] != "o0000000000001" {
+		t.Fatalf("expected amy under Alpha in the company index, got %v", ids)
+	}
+	if ids, _ := index_ids(stub, "company~owner", []string{" Alpha "}); len(ids) != 0 {
+		t.Fatalf("expected the old company index entry to be gone, got %v", ids)
+	}
+	if ids, _ := index_ids(stub, "color~id", []string{"red"}); len(ids) != 1 {
+		t.Fatalf("expected the marble under red in the color index, got %v", ids)
+	}
+
+	// again, nothing left to do
+	total, pages = canonicalize("100")
+	if pages != 1 || total.Normalized != 0 || total.NormalizedOwners != 0 {
+		t.Fatalf("expected a second run to change nothing, got %+v over %d pages", total, pages)
+	}
+}
+
+// ============================================================================================================================
+// set_owner() - transfer memo in the event
+// ============================================================================================================================
+func TestTransferMemo(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	var event struct {
+		MarbleId    string `json:"marbleId"`
+		FromOwnerId string `json:"fromOwnerId"`
+		ToOwnerId   string `json:"toOwnerId"`
+		Memo        string `json:"memo"`
+	}
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha", "birthday\n present"))
+	must_decode(t, stub.events["marble_transferred"], &event)
+	if event.MarbleId != "m0000000000001" || event.FromOwnerId != "o0000000000001" || event.ToOwnerId != "o0000000000002" || event.Memo != "birthday present" {
+		t.Fatalf("expected the transfer and its cleaned memo in the event, got %+v", event)
+	}
+
+	event.Memo = "left over"
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	must_decode(t, stub.events["marble_transferred"], &event)
+	if event.ToOwnerId != "o0000000000001" || event.Memo != "" {
+		t.Fatalf("expected a transfer without a memo, got %+v", event)
+	}
+}
+
+// ============================================================================================================================
+// match_offers() - compatible offers swap oldest first, incompatible ones stay open
+// ============================================================================================================================
+func TestMatchOffers(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.owner(t, "o0000000000003", "cat", "Gamma")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 20, "o0000000000002", "Beta")
+	stub.marble(t, "m0000000000003", "blue", 20, "o0000000000003", "Gamma")
+
+	// each offer is placed in line by its own tx
+	var offers [3]struct {
+		Id string `json:"id"`
+	}
+	must_decode(t, must_ok(t, stub.call(create_offer, "m0000000000001", "blue", "0", "Alpha")), &offers[0])
+	stub.now = test_start.Add(time.Second)
+	must_decode(t, must_ok(t, stub.call(create_offer, "m0000000000003", "red", "10", "Gamma")), &offers[2])
+	stub.now = test_start.Add(2 * time.Second)
+	must_decode(t, must_ok(t, stub.call(create_offer, "m0000000000002", "red", "10", "Beta")), &offers[1])
+	if offers[0].Id == offers[1].Id || offers[1].Id == offers[2].Id {
+		t.Fatal("expected every offer to get its own id")
+	}
+	if value, _ := stub.GetState("offerseq"); value != nil {
+		t.Fatal("expected no shared offer counter")
+	}
+
+	var result struct {
+		Matched [][2]string `json:"matched"`
+		Stale   []string    `json:"stale"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("match_offers")), &result)
+	if len(result.Matched) != 1 || result.Matched[0] != [2]string{offers[0].Id, offers[2].Id} {
+		t.Fatalf("expected amy to trade with cat, who offered first, got %+v", result)
+	}
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000003" || stub.get_marble(t, "m0000000000003").Owner.Id != "o0000000000001" {
+		t.Fatal("expected amy and cat's marbles to be swapped")
+	}
+
+	// bob's offer is still open, but nobody left has what he wants
+	if _, err := get_offer(stub, offers[1].Id); err != nil {
+		t.Fatalf("expected bob's offer to stay open - %s", err)
+	}
+	must_ok(t, stub.call(create_offer, "m0000000000001", "green", "0", "Gamma"))
+	must_decode(t, must_ok(t, stub.invoke("match_offers")), &result)
+	if len(result.Matched) != 0 {
+		t.Fatalf("expected incompatible offers not to match, got %+v", result)
+	}
+
+	must_fail(t, stub.call(cancel_offer, offers[1].Id, "Alpha"), "cannot authorize")
+	must_ok(t, stub.call(cancel_offer, offers[1].Id, "Beta"))
+	must_fail(t, stub.call(cancel_offer, offers[1].Id, "Beta"), "does not exist")
+}
+
+// ============================================================================================================================
+// add_comment() and get_comments() - a thread reads back in order
+// ============================================================================================================================
+func TestCommentThread(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	var want []string
+	for i := 0; i < 12; i++ {                                      //past 10, so the order isn't just the text order
+		text := "comment " + strconv.Itoa(i)
+		author := "o0000000000001"
+		if i % 2 == 1 {
+			author = "o0000000000002"
+		}
+		must_ok(t, stub.invoke("add_comment", "m0000000000001", author, text))
+		want = append(want, text)
+	}
+	must_fail(t, stub.invoke("add_comment", "m0000000000001", "o0000000000009", "who am i"), "Owner does not exist")
+	must_fail(t, stub.invoke("add_comment", "m0000000000009", "o0000000000001", "no marble"), "Marble does not exist")
+
+	var comments []Comment
+	must_decode(t, must_ok(t, stub.invoke("get_comments", "m0000000000001")), &comments)
+	if len(comments) != len(want) {
+		t.Fatalf("expected %d comments, got %d", len(want), len(comments))
+	}
+	for i, comment := range comments {
+		if comment.Text != want[i] || comment.MarbleId != "m0000000000001" {
+			t.Fatalf("expected %q at %d, got %+v", want[i], i, comment)
+		}
+	}
+}
+
+// ============================================================================================================================
+// create_gift() and claim_gift() - the claim code works once, and only the right one
+// ============================================================================================================================
+func TestGiftClaim(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.owner(t, "o0000000000003", "cat", "Gamma")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+
+	must_fail(t, stub.invoke("create_gift", "m0000000000001", "Alpha"), "claim_code")
+	stub.transient = map[string][]byte{"claim_code": []byte("open sesame")}
+	must_ok(t, stub.invoke("create_gift", "m0000000000001", "Alpha"))
+	gift := stub.get_marble(t, "m0000000000001").Gift
+	if gift == nil || gift.CodeHash != hash_claim_code([]byte("open sesame")) {
+		t.Fatalf("expected only the hash of the code on the marble, got %+v", gift)
+	}
+
+	// wrong code
+	stub.transient = map[string][]byte{"claim_code": []byte("open barley")}
+	must_fail(t, stub.invoke("claim_gift", "m0000000000001", "o0000000000002"), "Wrong claim code")
+
+	// right code
+	stub.transient = map[string][]byte{"claim_code": []byte("open sesame")}
+	must_ok(t, stub.invoke("claim_gift", "m0000000000001", "o0000000000002"))
+	marble := stub.get_marble(t, "m0000000000001")
+	if marble.Owner.Id != "o0000000000002" || marble.Gift != nil {
+		t.Fatalf("expected bob to own the marble and the gift to be gone, got %+v", marble)
+	}
+
+	// used up
+	must_fail(t, stub.invoke("claim_gift", "m0000000000001", "o0000000000003"), "not available to claim")
+
+	// expired
+	must_ok(t, stub.invoke("create_gift", "m0000000000002", "Alpha", test_start.Add(time.Hour).Format(time_format)))
+	stub.now = test_start.Add(2 * time.Hour)
+	must_fail(t, stub.invoke("claim_gift", "m0000000000002", "o0000000000002"), "expired")
+}
+
+// ============================================================================================================================
+// init_marble() - a capped color sells out, an uncapped one never does
+// ============================================================================================================================
+func TestColorCaps(t *testing.T) {
+	stub := new_test_stub(t, `{"colorCaps": {"Red": 2}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	must_fail(t, stub.call(init_marble, "m0000000000003", "red", "10", "o0000000000001", "Alpha"), "sold out")
+
+	for i := 3; i < 13; i++ {
+		stub.marble(t, "m00000000000" + strconv.Itoa(10 + i), "blue", 10, "o0000000000001", "Alpha")
+	}
+}
+
+// ============================================================================================================================
+// update_owner() - only owners that asked to be notified are in the transfer event
+// ============================================================================================================================
+func TestTransferNotify(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	notified := func() string {
+		var event struct {
+			Notify []string `json:"notify"`
+		}
+		must_decode(t, stub.events["marble_transferred"], &event)
+		return strings.Join(event.Notify, ",")
+	}
+
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	if got := notified(); got != "" {
+		t.Fatalf("expected nobody to be notified by default, got %q", got)
+	}
+
+	must_ok(t, stub.invoke("update_owner", "o0000000000001", "Alpha", "true", "email"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	if got := notified(); got != "o0000000000001" {
+		t.Fatalf("expected just amy to be notified, got %q", got)
+	}
+
+	must_ok(t, stub.invoke("update_owner", "o0000000000002", "Alpha", "true", "email"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	if got := notified(); got != "o0000000000001,o0000000000002" {
+		t.Fatalf("expected amy then bob to be notified, got %q", got)
+	}
+
+	must_ok(t, stub.invoke("update_owner", "o0000000000001", "Alpha", "false", "none"))
+	if owner := stub.get_owner(t, "o0000000000001"); owner.Notify || owner.ContactMethod != "none" {
+		t.Fatalf("expected amy's preferences to be updated, got %+v", owner)
+	}
+	must_fail(t, stub.invoke("update_owner", "o0000000000001", "Alpha", "true", "pigeon"), "Contact method")
+	must_fail(t, stub.invoke("update_owner", "o0000000000001", "Beta", "true", "email"), "cannot authorize")
+}
+
+// ============================================================================================================================
+// delete_marble() - with the expected owner id, only deletes if it's still right
+// ============================================================================================================================
+func TestDeleteMarbleExpectedOwner(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+
+	must_fail(t, stub.invoke("delete_marble", "m0000000000001", "Alpha", "o0000000000002"), "Conflict")
+	stub.get_marble(t, "m0000000000001")
+
+	must_ok(t, stub.invoke("delete_marble", "m0000000000001", "Alpha", "o0000000000001"))
+	if found, _ := get_state_as(stub, "m0000000000001", &Marble{}); found {
+		t.Fatal("expected the marble to be deleted")
+	}
+
+	must_ok(t, stub.invoke("delete_marble", "m0000000000002", "Alpha"))          //no owner to check
+	if found, _ := get_state_as(stub, "m0000000000002", &Marble{}); found {
+		t.Fatal("expected the marble to be deleted without an expected owner")
+	}
+}
+
+// ============================================================================================================================
+// sweep_expired_reservations() - only expired gifts are cleared, a batch at a time
+// ============================================================================================================================
+func TestSweepExpiredReservations(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.transient = map[string][]byte{"claim_code": []byte("open sesame")}
+	expiries := []time.Duration{time.Hour, 0, 3 * time.Hour, time.Hour}      //0 never expires
+	for i, expiry := range expiries {
+		id := "m000000000000" + strconv.Itoa(i + 1)
+		stub.marble(t, id, "red", 10, "o0000000000001", "Alpha")
+		args := []string{"create_gift", id, "Alpha"}
+		if expiry > 0 {
+			args = append(args, test_start.Add(expiry).Format(time_format))
+		}
+		must_ok(t, stub.invoke(args...))
+	}
+	stub.marble(t, "m0000000000005", "red", 10, "o0000000000001", "Alpha")   //no gift at all
+
+	type SweepResult struct {
+		Cleared int  `json:"cleared"`
+		More    bool `json:"more"`
+	}
+	sweep := func(batchSize string) (SweepResult, []string) {
+		var result SweepResult
+		var event struct {
+			MarbleIds []string `json:"marbleIds"`
+		}
+		delete(stub.events, "gifts_expired")
+		must_decode(t, must_ok(t, stub.invoke("sweep_expired_reservations", batchSize)), &result)
+		if stub.events["gifts_expired"] != nil {
+			must_decode(t, stub.events["gifts_expired"], &event)
+		}
+		return result, event.MarbleIds
+	}
+
+	// nothing has expired yet
+	if result, cleared := sweep("10"); result.Cleared != 0 || result.More || cleared != nil {
+		t.Fatalf("expected nothing to sweep before an expiry, got %+v %v", result, cleared)
+	}
+
+	// 1 and 4 have, a batch of 1 takes two sweeps
+	stub.now = test_start.Add(2 * time.Hour)
+	if result, cleared := sweep("1"); result.Cleared != 1 || !result.More || strings.Join(cleared, ",") != "m0000000000001" {
+		t.Fatalf("expected the first batch to clear m0000000000001 with more to do, got %+v %v", result, cleared)
+	}
+	if result, cleared := sweep("1"); result.Cleared != 1 || result.More || strings.Join(cleared, ",") != "m0000000000004" {
+		t.Fatalf("expected the second batch to clear m0000000000004, got %+v %v", result, cleared)
+	}
+	for i, expiry := range expiries {
+		marble := stub.get_marble(t, "m000000000000" + strconv.Itoa(i + 1))
+		if (marble.Gift == nil) != (expiry == time.Hour) {
+			t.Fatalf("expected only the expired gifts to be cleared, %s has %+v", marble.Id, marble.Gift)
+		}
+	}
+
+	// the unexpired gift can still be claimed
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	must_ok(t, stub.invoke("claim_gift", "m0000000000003", "o0000000000002"))
+	must_fail(t, stub.invoke("sweep_expired_reservations", "0"), "Batch size")
+}
+
+// ============================================================================================================================
+// repaint_marbles_by_color() - a page at a time, the color~id index only has the new color afterwards
+// ============================================================================================================================
+func TestRepaintMarblesByColor(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"], "colorCaps": {"green": 1}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "blue", 10, "o0000000000001", "Alpha")
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("repaint_marbles_by_color", "blue", "red", "2"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+
+	type RepaintResult struct {
+		Repainted int  `json:"repainted"`
+		More      bool `json:"more"`
+	}
+	var result RepaintResult
+	must_decode(t, must_ok(t, stub.invoke("repaint_marbles_by_color", "Blue", "red", "2")), &result)
+	if result.Repainted != 2 || !result.More {
+		t.Fatalf("expected a full page of 2 with more to do, got %+v", result)
+	}
+	must_decode(t, must_ok(t, stub.invoke("repaint_marbles_by_color", "blue", "red", "2")), &result)
+	if result.Repainted != 1 || result.More {
+		t.Fatalf("expected the last 1, got %+v", result)
+	}
+	var event struct {
+		FromColor string `json:"fromColor"`
+		ToColor   string `json:"toColor"`
+		Count     int    `json:"count"`
+	}
+	must_decode(t, stub.events["marbles_repainted"], &event)
+	if event.FromColor != "blue" || event.ToColor != "red" || event.Count != 1 {
+		t.Fatalf("expected the last page in the event, got %+v", event)
+	}
+
+	blue, _ := index_ids(stub, "color~id", []string{"blue"})
+	red, _ := index_ids(stub, "color~id", []string{"red"})
+	if len(blue) != 0 || strings.Join(red, ",") != "m0000000000001,m0000000000002,m0000000000003,m0000000000004" {
+		t.Fatalf("expected every marble under red and none under blue, got blue %v red %v", blue, red)
+	}
+	for _, id := range red {
+		if color := stub.get_marble(t, id).Color; color != "red" {
+			t.Fatalf("expected %s to be red, got %s", id, color)
+		}
+	}
+
+	// nothing left to do
+	must_decode(t, must_ok(t, stub.invoke("repaint_marbles_by_color", "blue", "red", "2")), &result)
+	if result.Repainted != 0 || result.More {
+		t.Fatalf("expected nothing to repaint, got %+v", result)
+	}
+	must_fail(t, stub.invoke("repaint_marbles_by_color", "red", "green", "2"), "Color green can only hold 1 more marbles")
+	must_fail(t, stub.invoke("repaint_marbles_by_color", "red", "Red", "2"), "the same")
+}
+
+// ============================================================================================================================
+// put_marble_in_pool() and claim_marbles_by_attribute() - only a caller whose cert has the pooled value can claim
+// ============================================================================================================================
+func TestClaimMarblesByAttribute(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	must_ok(t, stub.invoke("put_marble_in_pool", "m0000000000001", "department", "sales", "Alpha"))
+	must_ok(t, stub.invoke("put_marble_in_pool", "m0000000000002", "department", "sales", "Alpha"))
+	must_ok(t, stub.invoke("put_marble_in_pool", "m0000000000003", "department", "legal", "Alpha"))
+	must_fail(t, stub.invoke("put_marble_in_pool", "m0000000000003", "department", "legal", "Beta"), "cannot authorize")
+
+	type ClaimResult struct {
+		Claimed []string `json:"claimed"`
+	}
+	var result ClaimResult
+
+	// no attribute, or the wrong value
+	stub.as(t, "Org1MSP", "bob", nil)
+	must_fail(t, stub.invoke("claim_marbles_by_attribute", "department", "o0000000000002", "Alpha"), "does not have the attribute 'department'")
+	stub.as(t, "Org1MSP", "bob", map[string]string{"department": "marketing"})
+	must_decode(t, must_ok(t, stub.invoke("claim_marbles_by_attribute", "department", "o0000000000002", "Alpha")), &result)
+	if len(result.Claimed) != 0 {
+		t.Fatalf("expected marketing to claim nothing, got %v", result.Claimed)
+	}
+
+	// sales gets the sales marbles and they leave the pool
+	stub.as(t, "Org1MSP", "bob", map[string]string{"department": "sales"})
+	must_decode(t, must_ok(t, stub.invoke("claim_marbles_by_attribute", "department", "o0000000000002", "Alpha")), &result)
+	if strings.Join(result.Claimed, ",") != "m0000000000001,m0000000000002" {
+		t.Fatalf("expected the two sales marbles, got %v", result.Claimed)
+	}
+	for _, id := range []string{"m0000000000001", "m0000000000002"} {
+		if marble := stub.get_marble(t, id); marble.Owner.Id != "o0000000000002" || marble.Pool != nil {
+			t.Fatalf("expected bob to own %s out of the pool, got %+v", id, marble)
+		}
+	}
+	if marble := stub.get_marble(t, "m0000000000003"); marble.Owner.Id != "o0000000000001" || marble.Pool == nil {
+		t.Fatalf("expected the legal marble to stay pooled with amy, got %+v", marble)
+	}
+	var event struct {
+		Value     string   `json:"value"`
+		OwnerId   string   `json:"ownerId"`
+		MarbleIds []string `json:"marbleIds"`
+	}
+	must_decode(t, stub.events["marbles_claimed"], &event)
+	if event.Value != "sales" || event.OwnerId != "o0000000000002" || len(event.MarbleIds) != 2 {
+		t.Fatalf("expected one event for both marbles, got %+v", event)
+	}
+
+	result = ClaimResult{}
+	must_decode(t, must_ok(t, stub.invoke("claim_marbles_by_attribute", "department", "o0000000000002", "Alpha")), &result)
+	if len(result.Claimed) != 0 {
+		t.Fatalf("expected nothing left to claim, got %v", result.Claimed)
+	}
+}
+
+// ============================================================================================================================
+// transfer_marble_signed() - the owner's signature moves the marble, a forged or stale one doesn't
+// ============================================================================================================================
+func TestTransferMarbleSigned(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+
+	new_key := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	sign := func(key *ecdsa.PrivateKey, marble_id string, new_owner_id string) string {
+		digest := sha256.Sum256(transfer_payload(stub.get_marble(t, marble_id), new_owner_id))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		return base64.StdEncoding.EncodeToString(der)
+	}
+	amy := new_key()
+	mallory := new_key()
+
+	must_fail(t, stub.invoke("transfer_marble_signed", "m0000000000001", "o0000000000002", sign(amy, "m0000000000001", "o0000000000002")), "has no public key")
+	publicKeyAsBytes, _ := x509.MarshalPKIXPublicKey(&amy.PublicKey)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyAsBytes}))
+	must_fail(t, stub.invoke("set_owner_public_key", "o0000000000001", "Alpha", "not a key"), "PEM")
+	must_ok(t, stub.invoke("set_owner_public_key", "o0000000000001", "Alpha", publicKey))
+
+	// forged, signed for someone else, and not base64
+	must_fail(t, stub.invoke("transfer_marble_signed", "m0000000000001", "o0000000000002", sign(mallory, "m0000000000001", "o0000000000002")), "Signature does not match owner o0000000000001")
+	must_fail(t, stub.invoke("transfer_marble_signed", "m0000000000001", "o0000000000002", sign(amy, "m0000000000001", "o0000000000001")), "Signature does not match")
+	must_fail(t, stub.invoke("transfer_marble_signed", "m0000000000001", "o0000000000002", "!!!"), "base64")
+	if marble := stub.get_marble(t, "m0000000000001"); marble.Owner.Id != "o0000000000001" {
+		t.Fatalf("expected amy to still own the marble, got %+v", marble.Owner)
+	}
+
+	// valid, from any company
+	signature := sign(amy, "m0000000000001", "o0000000000002")
+	must_ok(t, stub.invoke("transfer_marble_signed", "m0000000000001", "o0000000000002", signature, "sold"))
+	if marble := stub.get_marble(t, "m0000000000001"); marble.Owner.Id != "o0000000000002" {
+		t.Fatalf("expected bob to own the marble, got %+v", marble.Owner)
+	}
+
+	// a signature is stale once the marble changes
+	signature = sign(amy, "m0000000000002", "o0000000000002")
+	stub.now = test_start.Add(time.Minute)
+	must_ok(t, stub.invoke("set_secondary_color", "m0000000000002", "white", "Alpha"))
+	must_fail(t, stub.invoke("transfer_marble_signed", "m0000000000002", "o0000000000002", signature), "Signature does not match")
+}
+
+// ============================================================================================================================
+// split_marble() and merge_marbles() - a stack of 10 splits into 6 and 4 and merges back without losing any
+// ============================================================================================================================
+func TestSplitAndMergeMarbles(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "blue", 10, "o0000000000001", "Alpha")
+	stub.run(func() pb.Response {
+		marble := stub.get_marble(t, "m0000000000001")
+		marble.Quantity = 10
+		put_marble(stub, marble)
+		return shim.Success(nil)
+	}, []string{"seed"})
+
+	must_fail(t, stub.invoke("split_marble", "m0000000000001", "m0000000000002", "10", "Alpha"), "can split off at most 9")
+	must_fail(t, stub.invoke("split_marble", "m0000000000001", "m0000000000003", "4", "Alpha"), "already in use")
+	must_ok(t, stub.invoke("split_marble", "m0000000000001", "m0000000000002", "4", "Alpha"))
+	stack := stub.get_marble(t, "m0000000000001")
+	split := stub.get_marble(t, "m0000000000002")
+	if stack.quantity() != 6 || split.quantity() != 4 || split.Color != "red" || split.Owner.Id != "o0000000000001" {
+		t.Fatalf("expected 6 left and a red stack of 4 for amy, got %+v and %+v", stack, split)
+	}
+	owned, _ := index_ids(stub, "owner~id", []string{"o0000000000001"})
+	red, _ := index_ids(stub, "color~id", []string{"red"})
+	if len(owned) != 3 || len(red) != 2 {
+		t.Fatalf("expected the new stack in the indexes, got %v and %v", owned, red)
+	}
+
+	must_fail(t, stub.invoke("merge_marbles", "m0000000000001", "m0000000000003", "Alpha"), "same owner, color, size and expiry")
+	must_fail(t, stub.invoke("merge_marbles", "m0000000000001", "m0000000000001", "Alpha"), "itself")
+	must_ok(t, stub.invoke("merge_marbles", "m0000000000001", "m0000000000002", "Alpha"))
+	if stack = stub.get_marble(t, "m0000000000001"); stack.quantity() != 10 {
+		t.Fatalf("expected all 10 back together, got %d", stack.quantity())
+	}
+	if found, _ := get_state_as(stub, "m0000000000002", &Marble{}); found {
+		t.Fatal("expected the merged stack to be gone")
+	}
+	red, _ = index_ids(stub, "color~id", []string{"red"})
+	if len(red) != 1 {
+		t.Fatalf("expected the merged stack out of the index, got %v", red)
+	}
+}
+
+// ============================================================================================================================
+// tag_marbles_by_query() - every red marble gets the tag once, running it again changes nothing
+// ============================================================================================================================
+func TestTagMarblesByQuery(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000004", "red", 10, "o0000000000001", "Alpha")
+
+	type TagResult struct {
+		Tagged int  `json:"tagged"`
+		More   bool `json:"more"`
+	}
+	tag := func() TagResult {
+		var result TagResult
+		must_decode(t, must_ok(t, stub.invoke("tag_marbles_by_query", "Red", "Promo", "2")), &result)
+		return result
+	}
+	if result := tag(); result.Tagged != 2 || !result.More {
+		t.Fatalf("expected a full page of 2 with more to do, got %+v", result)
+	}
+	if result := tag(); result.Tagged != 1 || result.More {
+		t.Fatalf("expected the last 1, got %+v", result)
+	}
+	for i := 0; i < 2; i++ {
+		if result := tag(); result.Tagged != 0 || result.More {
+			t.Fatalf("expected a rerun to tag nothing, got %+v", result)
+		}
+	}
+
+	for _, id := range []string{"m0000000000001", "m0000000000003", "m0000000000004"} {
+		if tags := stub.get_marble(t, id).Tags; len(tags) != 1 || tags[0] != "promo" {
+			t.Fatalf("expected %s to be tagged promo once, got %v", id, tags)
+		}
+	}
+	if tags := stub.get_marble(t, "m0000000000002").Tags; len(tags) != 0 {
+		t.Fatalf("expected the blue marble to be left alone, got %v", tags)
+	}
+	tagged, _ := index_ids(stub, "tag~id", []string{"promo"})
+	if strings.Join(tagged, ",") != "m0000000000001,m0000000000003,m0000000000004" {
+		t.Fatalf("expected the red marbles under promo, got %v", tagged)
+	}
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("tag_marbles_by_query", "red", "sale", "2"), "not an admin")
+}
+
+// ============================================================================================================================
+// increment_marble_counter() - counts up and down, stops at 0 and the max int64
+// ============================================================================================================================
+func TestIncrementMarbleCounter(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	lastModified := stub.get_marble(t, "m0000000000001").LastModified
+
+	stub.now = test_start.Add(time.Hour)
+	must_ok(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "5", "Alpha"))
+	must_ok(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "-2", "Alpha"))
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "-4", "Alpha"), "can't go below 0")
+	marble := stub.get_marble(t, "m0000000000001")
+	if marble.Views != 3 || marble.Score != 0 || marble.LastModified != lastModified {
+		t.Fatalf("expected 3 views, no score and the old lastModified, got %+v", marble)
+	}
+
+	// right up to the max, and not one past it
+	must_ok(t, stub.invoke("increment_marble_counter", "m0000000000001", "score", "9223372036854775806", "Alpha"))
+	must_ok(t, stub.invoke("increment_marble_counter", "m0000000000001", "score", "1", "Alpha"))
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "score", "1", "Alpha"), "would overflow")
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "9223372036854775807", "Alpha"), "would overflow")
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "9223372036854775808", "Alpha"), "non-zero number")
+	if marble = stub.get_marble(t, "m0000000000001"); marble.Score != 9223372036854775807 || marble.Views != 3 {
+		t.Fatalf("expected the score at the max and the views untouched, got %d and %d", marble.Score, marble.Views)
+	}
+
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "likes", "1", "Alpha"), "Counter must be")
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "0", "Alpha"), "non-zero number")
+	must_fail(t, stub.invoke("increment_marble_counter", "m0000000000001", "views", "1", "Beta"), "cannot authorize")
+}
+
+// ============================================================================================================================
+// Transfer Fee - the new owner pays the treasury, nothing moves with fees off
+// ============================================================================================================================
+func TestTransferFee(t *testing.T) {
+	balances := func(stub *test_stub, when string, amy int64, bob int64, treasury int64) {
+		if got := stub.get_owner(t, "o0000000000001").Balance; got != amy {
+			t.Fatalf("expected amy's balance to be %d after %s, got %d", amy, when, got)
+		}
+		if got := stub.get_owner(t, "o0000000000002").Balance; got != bob {
+			t.Fatalf("expected bob's balance to be %d after %s, got %d", bob, when, got)
+		}
+		if got := stub.get_owner(t, "o0000000000009").Balance; got != treasury {
+			t.Fatalf("expected the treasury's balance to be %d after %s, got %d", treasury, when, got)
+		}
+	}
+	setup := func(config string) *test_stub {
+		stub := new_test_stub(t, config)
+		stub.owner(t, "o0000000000001", "amy", "Alpha")
+		stub.owner(t, "o0000000000002", "bob", "Alpha")
+		stub.owner(t, "o0000000000009", "treasury", "Alpha")
+		stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+		return stub
+	}
+
+	stub := setup(`{"transferFee": 5, "treasury": "o0000000000009"}`)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	balances(stub, "a transfer to bob", 0, -5, 5)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	balances(stub, "a transfer back to amy", -5, -5, 10)
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000009", "Alpha"))
+	balances(stub, "a transfer to the treasury", -5, -5, 10)
+
+	stub = setup("")
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	balances(stub, "a transfer with fees off", 0, 0, 0)
+
+	// a treasury that isn't there fails the whole transfer
+	stub = setup(`{"transferFee": 5, "treasury": "o0000000000008"}`)
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"), "Treasury owner does not exist")
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000001" {
+		t.Fatal("expected the marble to stay with amy when the fee can't be paid")
+	}
+}
+
+// ============================================================================================================================
+// Messages - an inbox reads back in the order messages were sent
+// ============================================================================================================================
+func TestMessages(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	stub.owner(t, "o0000000000003", "cat", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000003", "Alpha")
+
+	texts := []string{"trade for your red?", "I'll add a blue", "last offer", "ok fine", "please", "one more", "7", "8", "9", "10", "11"}
+	for i, text := range texts {
+		stub.now = test_start.Add(time.Duration(i) * time.Minute)
+		if i % 2 == 0 {
+			must_ok(t, stub.invoke("send_message", "o0000000000001", "o0000000000003", "m0000000000001", text, "Alpha"))
+		} else {
+			must_ok(t, stub.invoke("send_message", "o0000000000002", "o0000000000003", "m0000000000001", text, "Beta"))
+		}
+	}
+
+	var inbox []Message
+	must_decode(t, must_ok(t, stub.invoke("get_messages", "o0000000000003")), &inbox)
+	if len(inbox) != len(texts) {
+		t.Fatalf("expected %d messages, got %d", len(texts), len(inbox))
+	}
+	for i, message := range inbox {                                //past 10 too, the seq is zero padded
+		if message.Text != texts[i] || message.Timestamp != test_start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339) {
+			t.Fatalf("expected message %d to be %q, got %+v", i, texts[i], message)
+		}
+	}
+	if inbox[0].FromOwnerId != "o0000000000001" || inbox[1].FromOwnerId != "o0000000000002" || inbox[0].MarbleId != "m0000000000001" {
+		t.Fatalf("expected the senders and marble to be kept, got %+v and %+v", inbox[0], inbox[1])
+	}
+
+	must_decode(t, must_ok(t, stub.invoke("get_messages", "o0000000000001")), &inbox)
+	if len(inbox) != 0 {
+		t.Fatalf("expected amy's inbox to be empty, got %v", inbox)
+	}
+
+	must_fail(t, stub.invoke("send_message", "o0000000000001", "o0000000000003", "m0000000000001", "hi", "Beta"), "cannot authorize")
+	must_fail(t, stub.invoke("send_message", "o0000000000001", "o0000000000009", "m0000000000001", "hi", "Alpha"), "does not exist")
+	must_fail(t, stub.invoke("send_message", "o0000000000001", "o0000000000003", "m0000000000009", "hi", "Alpha"), "does not exist")
+	must_fail(t, stub.invoke("send_message", "o0000000000001", "o0000000000003", "m0000000000001", "", "Alpha"), "non-empty")
+}
+
+// ============================================================================================================================
+// Condition Reports - only inspectors may add them, they read back oldest first
+// ============================================================================================================================
+func TestConditionReports(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("add_condition_report", "m0000000000001", "looks fine", "9"), "does not have the attribute")
+	stub.as(t, "Org1MSP", "user", map[string]string{"hf.Affiliation": "org1"})
+	must_fail(t, stub.invoke("add_condition_report", "m0000000000001", "looks fine", "9"), "does not have the attribute")
+
+	stub.as(t, "Org1MSP", "inspector", map[string]string{inspector_attribute: "insp-7"})
+	must_ok(t, stub.invoke("add_condition_report", "m0000000000001", "mint", "10"))
+	stub.now = test_start.Add(time.Hour)
+	must_ok(t, stub.invoke("add_condition_report", "m0000000000001", "hairline crack", "6"))
+	stub.as(t, "Org1MSP", "inspector", map[string]string{inspector_attribute: "insp-8"})
+	stub.now = test_start.Add(2 * time.Hour)
+	must_ok(t, stub.invoke("add_condition_report", "m0000000000001", "cracked, faded", "3"))
+
+	must_fail(t, stub.invoke("add_condition_report", "m0000000000001", "perfect", "11"), "Grade must be")
+	must_fail(t, stub.invoke("add_condition_report", "m0000000000001", "", "5"), "non-empty")
+	must_fail(t, stub.invoke("add_condition_report", "m0000000000009", "lost", "1"), "does not exist")
+
+	var reports []ConditionReport
+	must_decode(t, must_ok(t, stub.invoke("get_condition_reports", "m0000000000001")), &reports)
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %v", reports)
+	}
+	want := []ConditionReport{
+		{"marble_condition_report", "m0000000000001", "insp-7", "mint", 10, test_start.Format(time.RFC3339)},
+		{"marble_condition_report", "m0000000000001", "insp-7", "hairline crack", 6, test_start.Add(time.Hour).Format(time.RFC3339)},
+		{"marble_condition_report", "m0000000000001", "insp-8", "cracked, faded", 3, test_start.Add(2 * time.Hour).Format(time.RFC3339)},
+	}
+	for i := range want {
+		if reports[i] != want[i] {
+			t.Fatalf("expected report %d to be %+v, got %+v", i, want[i], reports[i])
+		}
+	}
+
+	// reports outlive their marble
+	must_ok(t, stub.invoke("delete_marble", "m0000000000001", "Alpha"))
+	must_decode(t, must_ok(t, stub.invoke("get_condition_reports", "m0000000000001")), &reports)
+	if len(reports) != 3 {
+		t.Fatalf("expected the reports to be kept after a delete, got %v", reports)
+	}
+}
+
+// ============================================================================================================================
+// Merge Sets - overlapping and distinct members all end up in the first set, in batches, then the second set is gone
+// ============================================================================================================================
+func TestMergeSets(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	for i := 1; i <= 5; i++ {
+		stub.marble(t, "m000000000000" + strconv.Itoa(i), "red", 10, "o0000000000001", "Alpha")
+	}
+	stub.set(t, "s0000000000001", "keepers", "o0000000000001", "Alpha")
+	stub.set(t, "s0000000000002", "extras", "o0000000000001", "Alpha")
+	stub.set(t, "s0000000000003", "bobs", "o0000000000002", "Beta")
+	for _, id := range []string{"1", "2"} {
+		must_ok(t, stub.invoke("add_marble_to_set", "s0000000000001", "m000000000000" + id, "Alpha"))
+	}
+	for _, id := range []string{"2", "3", "4", "5"} {                 //2 is in both
+		must_ok(t, stub.invoke("add_marble_to_set", "s0000000000002", "m000000000000" + id, "Alpha"))
+	}
+
+	members := func(set_id string) string {
+		ids, err := index_ids(stub, "set~setid~marble", []string{set_id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Replace(strings.Join(ids, ","), "m000000000000", "", -1)
+	}
+	merge := func(batch string, moved int, more bool) {
+		var result struct {
+			Moved int  `json:"moved"`
+			More  bool `json:"more"`
+		}
+		must_decode(t, must_ok(t, stub.invoke("merge_sets", "s0000000000001", "s0000000000002", "Alpha", batch)), &result)
+		if result.Moved != moved || result.More != more {
+			t.Fatalf("expected %d moved and more %v, got %+v", moved, more, result)
+		}
+	}
+
+	must_fail(t, stub.invoke("merge_sets", "s0000000000001", "s0000000000001", "Alpha", "10"), "into itself")
+	must_fail(t, stub.invoke("merge_sets", "s0000000000001", "s0000000000003", "Alpha", "10"), "cannot authorize")
+	must_fail(t, stub.invoke("merge_sets", "s0000000000001", "s0000000000009", "Alpha", "10"), "")
+	must_fail(t, stub.invoke("merge_sets", "s0000000000001", "s0000000000002", "Alpha", "0"), "Batch size")
+
+	merge("3", 3, true)
+	if got := members("s0000000000002"); got != "5" {
+		t.Fatalf("expected 5 left to move, got %q", got)
+	}
+	if _, err := get_marble_set(stub, "s0000000000002"); err != nil {
+		t.Fatalf("expected the second set to stay until it is empty - %s", err)
+	}
+	merge("3", 1, false)
+	if got := members("s0000000000001"); got != "1,2,3,4,5" {
+		t.Fatalf("expected every marble once in the merged set, got %q", got)
+	}
+	if got := members("s0000000000002"); got != "" {
+		t.Fatalf("expected the second set to be empty, got %q", got)
+	}
+	must_fail(t, stub.invoke("get_set", "s0000000000002"), "")
+
+	// each marble only remembers the set it is in now
+	for i := 1; i <= 5; i++ {
+		sets, err := index_ids(stub, "marble~set", []string{"m000000000000" + strconv.Itoa(i)})
+		if err != nil || len(sets) != 1 || sets[0] != "s0000000000001" {
+			t.Fatalf("expected m000000000000%d to only be in s0000000000001, got %v %v", i, sets, err)
+		}
+	}
+}
+
+// ============================================================================================================================
+// Company Caps - a marble that would put a company over its cap is refused, one under it is accepted
+// ============================================================================================================================
+func TestCompanyCaps(t *testing.T) {
+	stub := new_test_stub(t, `{"companyCaps": {"Alpha": 2}}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "cat", "Alpha")
+	stub.owner(t, "o0000000000003", "bob", "Beta")
+
+	// the cap is across every owner in the company
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000002", "Alpha")
+	must_fail(t, stub.invoke("init_marble", "m0000000000003", "red", "10", "o0000000000001", "Alpha"), "Company Alpha at capacity, it holds 2 of its 2")
+	for i := 4; i <= 6; i++ {                                       //companies without a cap have no limit
+		stub.marble(t, "m000000000000" + strconv.Itoa(i), "red", 10, "o0000000000003", "Beta")
+	}
+
+	// moving within the company always fits, moving in doesn't
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	must_fail(t, stub.invoke("set_owner", "m0000000000004", "o0000000000001", "Beta"), "at capacity")
+	if stub.get_marble(t, "m0000000000004").Owner.Id != "o0000000000003" {
+		t.Fatal("expected the refused transfer to leave the marble with bob")
+	}
+
+	// room again once one leaves
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000003", "Alpha"))
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+	must_fail(t, stub.invoke("set_owner", "m0000000000004", "o0000000000001", "Beta"), "at capacity")
+}
+
+// ============================================================================================================================
+// Simulate Transfer - a clean transfer is ok, a locked marble says why, every broken rule is listed and nothing is written
+// ============================================================================================================================
+func TestSimulateTransfer(t *testing.T) {
+	stub := new_test_stub(t, `{"transferCooldownSeconds": 3600}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.owner(t, "o0000000000009", "lender", "Bank")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "blue", 10, "o0000000000001", "Alpha")
+
+	type Simulation struct {
+		Ok       bool     `json:"ok"`
+		Problems []string `json:"problems"`
+	}
+	simulate := func(args ...string) Simulation {
+		var simulation Simulation
+		must_decode(t, must_ok(t, stub.invoke(append([]string{"simulate_transfer"}, args...)...)), &simulation)
+		if len(stub.writes) != 0 {
+			t.Fatalf("expected a simulation to write nothing, got %d writes", len(stub.writes))
+		}
+		return simulation
+	}
+
+	if simulation := simulate("m0000000000001", "o0000000000002", "Alpha"); !simulation.Ok || simulation.Problems == nil || len(simulation.Problems) != 0 {
+		t.Fatalf("expected a clean transfer to be ok, got %+v", simulation)
+	}
+	if stub.get_marble(t, "m0000000000001").Owner.Id != "o0000000000001" {
+		t.Fatal("expected the simulation to leave the marble with amy")
+	}
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+
+	// locked, set_owner stops at the same problem
+	must_ok(t, stub.invoke("lock_as_collateral", "m0000000000002", "loan1", "o0000000000009", "Alpha"))
+	simulation := simulate("m0000000000002", "o0000000000002", "Alpha")
+	if simulation.Ok || len(simulation.Problems) != 1 || !strings.Contains(simulation.Problems[0], "collateral") {
+		t.Fatalf("expected the locked marble to be refused as collateral, got %+v", simulation)
+	}
+	must_fail(t, stub.invoke("set_owner", "m0000000000002", "o0000000000002", "Alpha"), simulation.Problems[0])
+
+	// every broken rule at once, the cooldown and the company
+	simulation = simulate("m0000000000001", "o0000000000001", "Beta")
+	if simulation.Ok || len(simulation.Problems) != 2 || !strings.Contains(simulation.Problems[0], "cannot authorize") || !strings.Contains(simulation.Problems[1], "cooldown") {
+		t.Fatalf("expected the company and cooldown problems, got %+v", simulation)
+	}
+	stub.now = test_start.Add(2 * time.Hour)
+	if simulation := simulate("m0000000000001", "o0000000000001", "Alpha"); !simulation.Ok {
+		t.Fatalf("expected the transfer to be ok once cooled down, got %+v", simulation)
+	}
+
+	simulation = simulate("m0000000000009", "o0000000000008", "Alpha")
+	if simulation.Ok || len(simulation.Problems) != 2 || !strings.Contains(simulation.Problems[0], "does not exist") || !strings.Contains(simulation.Problems[1], "does not exist") {
+		t.Fatalf("expected a missing owner and marble, got %+v", simulation)
+	}
+}
+
+// ============================================================================================================================
+// Init Owner With Marble - both written with their indexes, or neither when the marble is bad
+// ============================================================================================================================
+func TestInitOwnerWithMarble(t *testing.T) {
+	stub := new_test_stub(t, `{"palette": ["red", "blue"]}`)
+	must_ok(t, stub.invoke("init_owner_with_marble", "o0000000000001", "Amy", "Alpha", "m0000000000001", "Red", "10"))
+
+	owner := stub.get_owner(t, "o0000000000001")
+	marble := stub.get_marble(t, "m0000000000001")
+	if owner.Username != "amy" || owner.Company != "Alpha" {
+		t.Fatalf("expected amy of Alpha, got %+v", owner)
+	}
+	if marble.Color != "red" || marble.Size != 10 || marble.Owner.Id != "o0000000000001" || marble.Owner.Username != "amy" || marble.TransferCount == nil {
+		t.Fatalf("expected amy's red marble, got %+v", marble)
+	}
+	for _, index := range []struct {
+		name       string
+		attributes []string
+		want       string
+	}{
+		{"company~owner", []string{"Alpha"}, "o0000000000001"},
+		{"owner~id", []string{"o0000000000001"}, "m0000000000001"},
+		{"color~id", []string{"red"}, "m0000000000001"},
+	} {
+		if ids, _ := index_ids(stub, index.name, index.attributes); strings.Join(ids, ",") != index.want {
+			t.Fatalf("expected %s to have %s, got %v", index.name, index.want, ids)
+		}
+	}
+	var count int
+	redKey, _ := stub.CreateCompositeKey("colorcount~color", []string{"red"})
+	if found, _ := get_state_as(stub, redKey, &count); !found || count != 1 {
+		t.Fatalf("expected 1 red counted, got %d", count)
+	}
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))   //usable right away
+
+	// a bad marble is caught before anything is written, not even the owner
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"o0000000000002", "bob", "Alpha", "m0000000000002", "red", "big"}, "must be a numeric string"},
+		{[]string{"o0000000000002", "bob", "Alpha", "m0000000000002", "green", "10"}, "palette"},
+		{[]string{"o0000000000002", "bob", "Alpha", "m0000000000002", "red", "10", "tomorrow"}, "RFC3339"},
+		{[]string{"o0000000000002", "bob", "Alpha", "m0000000000001", "red", "10"}, "already in use - m0000000000001"},
+		{[]string{"o0000000000001", "bob", "Alpha", "m0000000000002", "red", "10"}, "already in use - o0000000000001"},
+		{[]string{"o0000000000002", "bob", "Alpha", "o0000000000002", "red", "10"}, "must be different"},
+	}
+	for _, test := range tests {
+		must_fail(t, stub.invoke(append([]string{"init_owner_with_marble"}, test.args...)...), test.want)
+		if len(stub.writes) != 0 {
+			t.Fatalf("expected %v to write nothing, got %d writes", test.args, len(stub.writes))
+		}
+	}
+}
+
+// ============================================================================================================================
+// Transfer Count - counts real transfers and not transfers to the same owner, and the range query and backfill use it
+// ============================================================================================================================
+func TestTransferCount(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.as(t, "AdminMSP", "admin", nil)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000003", "red", 10, "o0000000000001", "Alpha")
+
+	transfers := func(id string) int {
+		marble := stub.get_marble(t, id)
+		if marble.TransferCount == nil {
+			t.Fatalf("expected %s to have a transferCount", id)
+		}
+		return *marble.TransferCount
+	}
+	if got := transfers("m0000000000001"); got != 0 {
+		t.Fatalf("expected a new marble to start at 0, got %d", got)
+	}
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000001", "Alpha"))
+	must_ok(t, stub.invoke("set_owner", "m0000000000002", "o0000000000001", "Alpha"))   //same owner, not a transfer
+	must_ok(t, stub.invoke("set_owner", "m0000000000003", "o0000000000002", "Alpha"))
+	if a, b, c := transfers("m0000000000001"), transfers("m0000000000002"), transfers("m0000000000003"); a != 2 || b != 0 || c != 1 {
+		t.Fatalf("expected 2, 0 and 1 transfers, got %d, %d and %d", a, b, c)
+	}
+
+	// a marble from before transferCount, moved once
+	for _, owner_id := range []string{"o0000000000001", "o0000000000002"} {
+		must_ok(t, stub.call(func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+			err := stub.PutState("m0000000000004", []byte(`{"docType": "marble", "id": "m0000000000004", "color": "red", "size": 10, "owner": {"id": "` + owner_id + `"}, "lastModified": "2017-01-01T00:00:00Z"}`))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success(nil)
+		}))
+	}
+
+	between := func(min string, max string) string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("queryMarblesByTransferCountRange", min, max)), &marbles)
+		got := []string{}
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+	tests := []struct {
+		min  string
+		max  string
+		want string
+	}{
+		{"0", "0", "2"},
+		{"1", "1", "3"},
+		{"1", "2", "1,3"},
+		{"0", "100", "1,2,3"},
+		{"3", "5", ""},
+	}
+	for _, test := range tests {
+		if got := between(test.min, test.max); got != test.want {
+			t.Fatalf("expected %s to %s transfers to be %q, got %q", test.min, test.max, test.want, got)
+		}
+	}
+
+	// the backfill counts it from history, without touching lastModified
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("backfill_transfer_counts", "", "10"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+	var result struct {
+		Backfilled int    `json:"backfilled"`
+		Bookmark   string `json:"bookmark"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("backfill_transfer_counts", "", "10")), &result)
+	if result.Backfilled != 1 || len(result.Bookmark) != 0 {
+		t.Fatalf("expected just the old marble to be backfilled, got %+v", result)
+	}
+	if got := transfers("m0000000000004"); got != 1 || stub.get_marble(t, "m0000000000004").LastModified != "2017-01-01T00:00:00Z" {
+		t.Fatalf("expected 1 transfer and the old lastModified, got %d", got)
+	}
+	if got := between("1", "1"); got != "3,4" {
+		t.Fatalf("expected the backfilled marble to show up, got %q", got)
+	}
+	must_fail(t, stub.invoke("queryMarblesByTransferCountRange", "2", "1"), "Max must be")
+	must_fail(t, stub.invoke("queryMarblesByTransferCountRange", "-1", "1"), "Min must be")
+}
+
+// ============================================================================================================================
+// Add Set To Set - nesting and diamonds are fine, an addition that would close a loop is refused
+// ============================================================================================================================
+func TestAddSetToSet(t *testing.T) {
+	stub := new_test_stub(t, "")
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Beta")
+	for _, id := range []string{"a", "b", "c", "d"} {
+		stub.set(t, "s000000000000" + id, "set " + id, "o0000000000001", "Alpha")
+	}
+	stub.set(t, "s000000000000e", "bobs", "o0000000000002", "Beta")
+
+	must_ok(t, stub.invoke("add_set_to_set", "s000000000000a", "s000000000000b", "Alpha"))
+	must_ok(t, stub.invoke("add_set_to_set", "s000000000000b", "s000000000000c", "Alpha"))
+	must_ok(t, stub.invoke("add_set_to_set", "s000000000000a", "s000000000000c", "Alpha"))   //two paths to c, not a loop
+	must_ok(t, stub.invoke("add_set_to_set", "s000000000000d", "s000000000000a", "Alpha"))
+	var contents struct {
+		Sets []string `json:"sets"`
+	}
+	must_decode(t, must_ok(t, stub.invoke("get_set", "s000000000000a")), &contents)
+	if strings.Join(contents.Sets, ",") != "s000000000000b,s000000000000c" {
+		t.Fatalf("expected a to hold b and c, got %v", contents.Sets)
+	}
+
+	must_fail(t, stub.invoke("add_set_to_set", "s000000000000c", "s000000000000a", "Alpha"), "Adding set s000000000000a to set s000000000000c would create a cycle")
+	must_fail(t, stub.invoke("add_set_to_set", "s000000000000c", "s000000000000d", "Alpha"), "would create a cycle")
+	must_fail(t, stub.invoke("add_set_to_set", "s000000000000b", "s000000000000a", "Alpha"), "would create a cycle")
+	must_fail(t, stub.invoke("add_set_to_set", "s000000000000c", "s000000000000c", "Alpha"), "to itself would create a cycle")
+	must_fail(t, stub.invoke("add_set_to_set", "s000000000000a", "s000000000000e", "Alpha"), "cannot authorize")
+	if subsets, _ := index_ids(stub, "subset~parent~child", []string{"s000000000000c"}); len(subsets) != 0 {
+		t.Fatalf("expected the refused additions to leave c empty, got %v", subsets)
+	}
+}
+
+// ============================================================================================================================
+// Quarantine - an admin hides a marble from queries and blocks its transfers, and releasing it undoes both
+// ============================================================================================================================
+func TestQuarantineMarble(t *testing.T) {
+	stub := new_test_stub(t, `{"admins": ["AdminMSP"]}`)
+	stub.owner(t, "o0000000000001", "amy", "Alpha")
+	stub.owner(t, "o0000000000002", "bob", "Alpha")
+	stub.marble(t, "m0000000000001", "red", 10, "o0000000000001", "Alpha")
+	stub.marble(t, "m0000000000002", "red", 10, "o0000000000001", "Alpha")
+
+	visible := func() string {
+		var marbles []Marble
+		must_decode(t, must_ok(t, stub.invoke("read_marbles_by_filter", `{"color": "red"}`)), &marbles)
+		got := []string{}
+		for _, marble := range marbles {
+			got = append(got, strings.TrimLeft(marble.Id, "m0"))
+		}
+		return strings.Join(got, ",")
+	}
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("quarantine_marble", "m0000000000001", "reported stolen"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+	must_fail(t, stub.invoke("quarantine_marble", "m0000000000001", ""), "A reason is required")
+	must_fail(t, stub.invoke("release_quarantine", "m0000000000001"), "is not quarantined")
+	stub.now = test_start.Add(time.Hour)
+	must_ok(t, stub.invoke("quarantine_marble", "m0000000000001", "reported stolen"))
+	must_fail(t, stub.invoke("quarantine_marble", "m0000000000001", "again"), "already quarantined")
+
+	quarantine := stub.get_marble(t, "m0000000000001").Quarantine
+	if quarantine == nil || quarantine.Reason != "reported stolen" || quarantine.By != "AdminMSP/admin" || quarantine.At != test_start.Add(time.Hour).Format(time_format) {
+		t.Fatalf("expected the reason and the admin to be recorded, got %+v", quarantine)
+	}
+	if got := visible(); got != "2" {
+		t.Fatalf("expected the quarantined marble to be left out, got %q", got)
+	}
+	must_fail(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"), "quarantined")
+	must_fail(t, stub.invoke("delete_marble", "m0000000000001", "Alpha"), "quarantined")
+
+	stub.as(t, "Org1MSP", "user", nil)
+	must_fail(t, stub.invoke("release_quarantine", "m0000000000001"), "not an admin")
+	stub.as(t, "AdminMSP", "admin", nil)
+	must_ok(t, stub.invoke("release_quarantine", "m0000000000001"))
+	if stub.get_marble(t, "m0000000000001").Quarantine != nil {
+		t.Fatal("expected the quarantine to be cleared")
+	}
+	if got := visible(); got != "1,2" {
+		t.Fatalf("expected the released marble to be back, got %q", got)
+	}
+	must_ok(t, stub.invoke("set_owner", "m0000000000001", "o0000000000002", "Alpha"))
+}
@@ -21,8 +21,13 @@ module.exports = function (logger) {
 			} else {
 				temp.parsed = error_message.toString();
 			}
-			pos = temp.parsed.lastIndexOf(':');
-			if (pos >= 0) temp.parsed = temp.parsed.substring(pos + 2);
+			pos = temp.parsed.indexOf('{"version"');
+			if (pos >= 0) {													//chaincode response envelope
+				temp.parsed = JSON.parse(temp.parsed.substring(pos)).error;
+			} else {
+				pos = temp.parsed.lastIndexOf(':');
+				if (pos >= 0) temp.parsed = temp.parsed.substring(pos + 2);
+			}
 		}
 		catch (e) {
 			logger.error('[fcw] could not format error');
@@ -106,6 +106,9 @@ module.exports = function (logger) {
 					as_obj = JSON.parse(as_string);				//if we can parse it, its great
 				}
 				logger.debug('[fcw] Peer ' + i, 'type', typeof as_obj);
+				if (as_obj && as_obj.version && typeof as_obj.ok === 'boolean') {
+					as_obj = as_obj.data;						//unwrap the chaincode's response envelope
+				}
 				if (ret.parsed === null) ret.parsed = as_obj;	//store the first one here
 			}
 			catch (e) {